@@ -36,7 +36,7 @@ func TestAcceptLoop_ConcurrentClients(t *testing.T) {
 
 	done := make(chan error, 1)
 	go func() {
-		done <- acceptLoop(ctx, ln, remote)
+		done <- acceptLoop(ctx, ln, testTunnel(remote))
 	}()
 
 	const nClients = 3
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"testing"
+)
+
+// TestConnectUpstream_ALPN drives an ALPN-routing front stand-in: the
+// negotiated protocol is on the per-connection tls log line, and -require-alpn turns "the
+// server picked nothing" into a failed dial instead of a silent misroute.
+func TestConnectUpstream_ALPN(t *testing.T) {
+	tests := []struct {
+		name        string
+		serverProto []string
+		alpn        []string
+		require     bool
+		wantErr     string
+		wantLog     string
+	}{
+		{name: "negotiated", serverProto: []string{"x-minecraft", "h2"}, alpn: []string{"h2", "x-minecraft"}, wantLog: " alpn=x-minecraft "},
+		{name: "server without alpn", alpn: []string{"x-minecraft"}, wantLog: " alpn=none "},
+		{name: "required but none", alpn: []string{"x-minecraft"}, require: true, wantErr: "alpn: upstream selected none of x-minecraft"},
+		{name: "required and negotiated", serverProto: []string{"x-minecraft"}, alpn: []string{"x-minecraft"}, require: true, wantLog: " alpn=x-minecraft "},
+		{name: "not offered", serverProto: []string{"h2"}, wantLog: " alpn=none "},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			leaf, key := mustCert(t, serverLeafTemplate("alpn"), nil, nil)
+			ln := mustServeTLS(t, []*x509.Certificate{leaf}, key, func(c *tls.Config) { c.NextProtos = tt.serverProto })
+			defer func() { _ = ln.Close() }()
+
+			opts := tlsOptions{ALPN: tt.alpn, RequireALPN: tt.require}
+			trustOnly(t, &opts, leaf)
+			cfg, err := opts.clientConfig("")
+			if err != nil {
+				t.Fatalf("clientConfig: %v", err)
+			}
+			withUpstreamTLS(t, cfg)
+
+			var buf bytes.Buffer
+			log.SetOutput(&buf)
+			defer log.SetOutput(os.Stderr)
+
+			client, server := net.Pipe()
+			defer func() { _ = client.Close() }()
+			upstream, err := connectUpstream(t.Context(), server, testTunnel(ln.Addr().String()))
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("err=%v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("connectUpstream: %v", err)
+			}
+			_ = upstream.Close()
+			got := buf.String()
+			if !strings.Contains(got, "conn/pipe: tls ") || !strings.Contains(got, tt.wantLog) {
+				t.Fatalf("log=%q, want %q", got, tt.wantLog)
+			}
+		})
+	}
+}
+
+func TestTLSOptions_ALPNValidation(t *testing.T) {
+	for _, tt := range []struct {
+		opts    tlsOptions
+		wantSub string
+	}{
+		{opts: tlsOptions{RequireALPN: true}, wantSub: "-require-alpn"},
+		{opts: tlsOptions{ALPN: []string{""}}, wantSub: "invalid -alpn"},
+		{opts: tlsOptions{ALPN: []string{strings.Repeat("x", 256)}}, wantSub: "invalid -alpn"},
+	} {
+		if _, err := tt.opts.clientConfig(""); err == nil || !strings.Contains(err.Error(), tt.wantSub) {
+			t.Fatalf("%+v: err=%v, want %q", tt.opts, err, tt.wantSub)
+		}
+	}
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"cmp"
+	"fmt"
+	"hash/fnv"
+	"math"
+	"math/rand/v2"
+	"net"
+	"slices"
+	"strings"
+)
+
+// Load balancing strategies (-balance). failover keeps the -t order and only
+// moves on when an upstream fails; the others spread clients across the
+// upstreams and fail over to the rest of the list the same way.
+const (
+	balanceFailover   = "failover"
+	balanceRoundRobin = "round-robin"
+	balanceRandom     = "random"
+	balanceLeastConn  = "least-conn"
+	balanceHash       = "hash"
+)
+
+var balanceModes = []string{balanceFailover, balanceRoundRobin, balanceRandom, balanceLeastConn, balanceHash}
+
+// balanceName is mode for logs, with "" spelled out.
+func balanceName(mode string) string {
+	if mode == "" {
+		return balanceFailover
+	}
+	return mode
+}
+
+// validateBalance checks -balance against the upstream list: weights only
+// mean something when clients are spread.
+func validateBalance(mode string, ups []*upstream) error {
+	if mode != "" && !slices.Contains(balanceModes, mode) {
+		return fmt.Errorf("invalid -balance %q: want %s", mode, strings.Join(balanceModes, ", "))
+	}
+	if mode == "" || mode == balanceFailover {
+		for _, u := range ups {
+			if u.weight != 1 {
+				return fmt.Errorf("weight on %s needs -balance (%s)", u.addr, strings.Join(balanceModes[1:], ", "))
+			}
+		}
+	}
+	return nil
+}
+
+// smoothSchedule is one cycle of nginx's smooth weighted round-robin over
+// ups: weights 5,1,1 give a a b a c a a rather than a a a a a b c.
+func smoothSchedule(ups []*upstream) []int {
+	total := 0
+	for _, u := range ups {
+		total += u.weight
+	}
+	current := make([]int, len(ups))
+	seq := make([]int, 0, total)
+	for range total {
+		best := 0
+		for i, u := range ups {
+			current[i] += u.weight
+			if current[i] > current[best] {
+				best = i
+			}
+		}
+		current[best] -= total
+		seq = append(seq, best)
+	}
+	return seq
+}
+
+// balanceOrder is the order t's strategy wants the upstreams tried in for
+// client; dialOrder then moves recently failed ones to the end. The first
+// entry is the strategy's pick, the rest the failover list after it.
+func (t *tunnel) balanceOrder(client net.Addr) []*upstream {
+	ups := t.upstreams
+	if len(ups) < 2 {
+		return slices.Clone(ups)
+	}
+	switch t.balance {
+	case balanceRoundRobin:
+		first := t.schedule[(t.rr.Add(1)-1)%uint64(len(t.schedule))]
+		return pickFirst(ups, first)
+	case balanceRandom:
+		return weightedShuffle(ups)
+	case balanceLeastConn:
+		order := slices.Clone(ups)
+		// Fewest sessions per unit of weight first; ties keep -t order.
+		slices.SortStableFunc(order, func(a, b *upstream) int {
+			return cmp.Compare(a.active.Load()*int64(b.weight), b.active.Load()*int64(a.weight))
+		})
+		return order
+	case balanceHash:
+		return rendezvousOrder(ups, clientKey(client))
+	}
+	return slices.Clone(ups)
+}
+
+// pickFirst is ups with ups[i] moved to the front.
+func pickFirst(ups []*upstream, i int) []*upstream {
+	order := make([]*upstream, 0, len(ups))
+	order = append(order, ups[i])
+	order = append(order, ups[:i]...)
+	return append(order, ups[i+1:]...)
+}
+
+// weightedShuffle orders ups randomly, heavier upstreams more likely first.
+func weightedShuffle(ups []*upstream) []*upstream {
+	rest := slices.Clone(ups)
+	order := make([]*upstream, 0, len(ups))
+	for len(rest) > 0 {
+		total := 0
+		for _, u := range rest {
+			total += u.weight
+		}
+		n := rand.IntN(total)
+		for i, u := range rest {
+			if n < u.weight {
+				order = append(order, u)
+				rest = slices.Delete(rest, i, i+1)
+				break
+			}
+			n -= u.weight
+		}
+	}
+	return order
+}
+
+// rendezvousOrder ranks ups by weighted rendezvous (highest random weight)
+// hashing of key. A client keeps its upstream as long as that upstream is in
+// the list, and adding or removing one only moves the clients it wins or
+// loses.
+func rendezvousOrder(ups []*upstream, key string) []*upstream {
+	type scored struct {
+		u     *upstream
+		score float64
+	}
+	s := make([]scored, len(ups))
+	for i, u := range ups {
+		h := fnv.New64a()
+		_, _ = h.Write([]byte(key))
+		_, _ = h.Write([]byte{0})
+		_, _ = h.Write([]byte(u.addr))
+		// Map the hash into (0, 1) and weight it as in Schindelhauer and
+		// Schomaker's weighted distributed hash tables.
+		x := (float64(mix64(h.Sum64())>>11) + 0.5) / (1 << 53)
+		s[i] = scored{u: u, score: -float64(u.weight) / math.Log(x)}
+	}
+	slices.SortStableFunc(s, func(a, b scored) int { return cmp.Compare(b.score, a.score) })
+	order := make([]*upstream, len(s))
+	for i, e := range s {
+		order[i] = e.u
+	}
+	return order
+}
+
+// mix64 is the splitmix64 finalizer: FNV alone leaves the high bits of
+// short, similar inputs correlated.
+func mix64(x uint64) uint64 {
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	return x ^ x>>31
+}
+
+// clientKey is what hash balancing sticks on: the client IP, so a client's
+// reconnects from new source ports land on the same upstream.
+func clientKey(addr net.Addr) string {
+	if addr == nil {
+		return ""
+	}
+	if host, _, err := net.SplitHostPort(addr.String()); err == nil {
+		return host
+	}
+	return addr.String()
+}
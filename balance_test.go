@@ -0,0 +1,226 @@
+package main
+
+import (
+	"bufio"
+	"crypto/x509"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// namedUpstreams starts n test upstreams that greet each client with their
+// index, and returns their addresses and certificates.
+func namedUpstreams(t *testing.T, n int) ([]string, []*x509.Certificate) {
+	t.Helper()
+	var addrs []string
+	var certs []*x509.Certificate
+	for i := range n {
+		up := mustTestUpstream(t, says(strconv.Itoa(i)))
+		addrs = append(addrs, up.addr)
+		certs = append(certs, up.cert)
+	}
+	return addrs, certs
+}
+
+// fromAddr is a downstream whose RemoteAddr is a chosen client address.
+type fromAddr struct {
+	net.Conn
+	addr net.Addr
+}
+
+func (c fromAddr) RemoteAddr() net.Addr { return c.addr }
+
+// reach connects through tun as client and returns the index of the
+// upstream that answered.
+func reach(t *testing.T, tun *tunnel, client string) int {
+	t.Helper()
+	a, b := net.Pipe()
+	t.Cleanup(func() { _ = a.Close() })
+	down := fromAddr{Conn: b, addr: &net.TCPAddr{IP: net.ParseIP(client), Port: 40000}}
+	up, err := connectUpstream(t.Context(), down, tun)
+	if err != nil {
+		t.Fatalf("connectUpstream: %v", err)
+	}
+	defer func() { _ = up.Close() }()
+	_ = up.SetDeadline(time.Now().Add(5 * time.Second))
+	line, err := bufio.NewReader(up).ReadString('\n')
+	if err != nil {
+		t.Fatalf("read greeting: %v", err)
+	}
+	i, err := strconv.Atoi(strings.TrimSuffix(line, "\n"))
+	if err != nil {
+		t.Fatalf("greeting %q", line)
+	}
+	return i
+}
+
+func TestParseRemotes_Weights(t *testing.T) {
+	ups, err := parseRemotes("a:443=3, b:443,c:443=1000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, u := range ups {
+		got = append(got, u.addr+"="+strconv.Itoa(u.weight))
+	}
+	if want := "a:443=3 b:443=1 c:443=1000"; strings.Join(got, " ") != want {
+		t.Fatalf("parseRemotes = %v, want %s", got, want)
+	}
+	for _, spec := range []string{"a:443=0", "a:443=x", "a:443=1001", "a:443="} {
+		if _, err := parseRemotes(spec); err == nil || !strings.Contains(err.Error(), "invalid -t weight") {
+			t.Errorf("parseRemotes(%q) err=%v", spec, err)
+		}
+	}
+}
+
+func TestValidateBalance(t *testing.T) {
+	plain, _ := parseRemotes("a:443,b:443")
+	weighted, _ := parseRemotes("a:443=2,b:443")
+	for _, mode := range balanceModes {
+		if err := validateBalance(mode, plain); err != nil {
+			t.Errorf("%s: %v", mode, err)
+		}
+	}
+	if err := validateBalance("", plain); err != nil {
+		t.Errorf("default: %v", err)
+	}
+	if err := validateBalance("fastest", plain); err == nil || !strings.Contains(err.Error(), "want failover, round-robin") {
+		t.Errorf("unknown mode: err=%v", err)
+	}
+	for _, mode := range []string{"", balanceFailover} {
+		if err := validateBalance(mode, weighted); err == nil || !strings.Contains(err.Error(), "weight on a:443 needs -balance") {
+			t.Errorf("weights with %q: err=%v", mode, err)
+		}
+	}
+	if err := validateBalance(balanceRoundRobin, weighted); err != nil {
+		t.Errorf("weights with round-robin: %v", err)
+	}
+}
+
+func TestSmoothSchedule(t *testing.T) {
+	ups, _ := parseRemotes("a:1=5,b:1,c:1")
+	if got, want := smoothSchedule(ups), []int{0, 0, 1, 0, 2, 0, 0}; !slices.Equal(got, want) {
+		t.Fatalf("schedule = %v, want %v", got, want)
+	}
+}
+
+// TestBalance_RoundRobin: clients go to the upstreams in weighted turn, all
+// through real TLS handshakes.
+func TestBalance_RoundRobin(t *testing.T) {
+	addrs, certs := namedUpstreams(t, 4)
+	tun := mustSetupTunnel(t, &tunnel{remote: addrs[0] + "=2," + strings.Join(addrs[1:], ","), balance: balanceRoundRobin}, certs...)
+	counts := make([]int, 4)
+	for range 10 {
+		counts[reach(t, tun, "192.0.2.1")]++
+	}
+	if want := []int{4, 2, 2, 2}; !slices.Equal(counts, want) {
+		t.Fatalf("connections per upstream = %v, want %v", counts, want)
+	}
+}
+
+// TestBalance_RoundRobinSkipsFailed: a dead upstream's turn falls through to
+// the next one and the others keep their share.
+func TestBalance_RoundRobinSkipsFailed(t *testing.T) {
+	addrs, certs := namedUpstreams(t, 2)
+	dead := closedAddr(t)
+	tun := mustSetupTunnel(t, &tunnel{remote: addrs[0] + "," + dead + "," + addrs[1], balance: balanceRoundRobin}, certs...)
+	captureLog(t)
+	counts := make([]int, 2)
+	for range 6 {
+		counts[reach(t, tun, "192.0.2.1")]++
+	}
+	if counts[0] < 2 || counts[1] < 2 {
+		t.Fatalf("connections per upstream = %v", counts)
+	}
+}
+
+func TestBalance_Random(t *testing.T) {
+	ups, _ := parseRemotes("a:1=3,b:1")
+	tun := &tunnel{balance: balanceRandom, upstreams: ups}
+	first := map[string]int{}
+	for range 4000 {
+		order := tun.balanceOrder(nil)
+		if len(order) != 2 || order[0] == order[1] {
+			t.Fatalf("order = %v", order)
+		}
+		first[order[0].addr]++
+	}
+	// a should come first about 3000 times.
+	if n := first["a:1"]; n < 2700 || n > 3300 {
+		t.Fatalf("a first %d of 4000 times, want about 3000", n)
+	}
+}
+
+func TestBalance_LeastConn(t *testing.T) {
+	addrs, certs := namedUpstreams(t, 3)
+	tun := mustSetupTunnel(t, &tunnel{remote: addrs[0] + "," + addrs[1] + "=2," + addrs[2], balance: balanceLeastConn}, certs...)
+	tun.upstreams[0].active.Store(2)
+	tun.upstreams[1].active.Store(3)
+	tun.upstreams[2].active.Store(1)
+	if got := reach(t, tun, "192.0.2.1"); got != 2 {
+		t.Fatalf("reached %d, want the least busy upstream 2", got)
+	}
+	// 3 sessions at weight 2 is lighter than 2 at weight 1.
+	tun.upstreams[2].active.Store(4)
+	if got := reach(t, tun, "192.0.2.1"); got != 1 {
+		t.Fatalf("reached %d, want upstream 1 (fewest sessions per weight)", got)
+	}
+}
+
+// TestBalance_Hash: a client IP keeps its upstream across connections, many
+// clients spread over all upstreams, and dropping an upstream only moves
+// the clients it had.
+func TestBalance_Hash(t *testing.T) {
+	addrs, certs := namedUpstreams(t, 3)
+	tun := mustSetupTunnel(t, &tunnel{remote: strings.Join(addrs, ","), balance: balanceHash}, certs...)
+	for _, ip := range []string{"192.0.2.7", "2001:db8::1"} {
+		first := reach(t, tun, ip)
+		for range 3 {
+			if got := reach(t, tun, ip); got != first {
+				t.Fatalf("%s moved from upstream %d to %d", ip, first, got)
+			}
+		}
+	}
+
+	counts := make([]int, 3)
+	before := map[string]*upstream{}
+	for i := range 300 {
+		ip := net.IPv4(10, byte(i>>8), byte(i), 1).String()
+		u := tun.balanceOrder(&net.TCPAddr{IP: net.ParseIP(ip)})[0]
+		before[ip] = u
+		counts[slices.Index(tun.upstreams, u)]++
+	}
+	for i, n := range counts {
+		if n < 60 {
+			t.Fatalf("upstream %d got %d of 300 clients: %v", i, n, counts)
+		}
+	}
+
+	// Dropping upstream 0 from the list only moves the clients it had.
+	rest := &tunnel{balance: balanceHash, upstreams: tun.upstreams[1:]}
+	for ip, u := range before {
+		got := rest.balanceOrder(&net.TCPAddr{IP: net.ParseIP(ip)})[0]
+		if u != tun.upstreams[0] && got != u {
+			t.Fatalf("%s moved from %s to %s when another upstream left", ip, u.addr, got.addr)
+		}
+	}
+}
+
+func TestClientKey(t *testing.T) {
+	for _, tt := range []struct {
+		addr net.Addr
+		want string
+	}{
+		{&net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 1234}, "192.0.2.1"},
+		{&net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 1234}, "2001:db8::1"},
+		{&net.UnixAddr{Name: "@", Net: "unix"}, "@"},
+		{nil, ""},
+	} {
+		if got := clientKey(tt.addr); got != tt.want {
+			t.Errorf("clientKey(%v) = %q, want %q", tt.addr, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+const defaultBreakerCooldown = 30 * time.Second
+
+// breakerConfig is the -breaker-* flags: after Failures dials in a row fail,
+// an upstream's circuit opens and clients are not dialled to it for
+// Cooldown. Then one client is let through as a probe (half-open): if it
+// connects the circuit closes, otherwise it opens for another Cooldown.
+// Failures 0 disables the breaker.
+type breakerConfig struct {
+	Failures int
+	Cooldown time.Duration
+	// Message is written to a client rejected because every circuit is
+	// open, before it is closed; "" just closes it.
+	Message string
+}
+
+func (b breakerConfig) enabled() bool { return b.Failures > 0 }
+
+func (b breakerConfig) validate() error {
+	if b.Failures < 0 {
+		return fmt.Errorf("invalid -breaker-failures %d: must be >= 0 (0 disables)", b.Failures)
+	}
+	if b.enabled() && b.Cooldown <= 0 {
+		return fmt.Errorf("invalid -breaker-cooldown %v: must be > 0", b.Cooldown)
+	}
+	if !b.enabled() && b.Message != "" {
+		return errors.New("-breaker-message needs -breaker-failures > 0")
+	}
+	return nil
+}
+
+// String is b for reload logs.
+func (b breakerConfig) String() string {
+	if !b.enabled() {
+		return "off"
+	}
+	s := fmt.Sprintf("open after %d failure(s) for %v", b.Failures, b.Cooldown)
+	if b.Message != "" {
+		s += fmt.Sprintf(" message %q", b.Message)
+	}
+	return s
+}
+
+// errCircuitOpen is the dial error when every upstream's circuit is open.
+var errCircuitOpen = errors.New("upstream circuit open; client rejected")
+
+// circuit is an upstream's breaker state.
+type circuit struct {
+	mu        sync.Mutex
+	failures  int       // consecutive failed dials
+	openUntil time.Time // zero while closed
+	probing   bool      // a half-open probe dial is in flight
+}
+
+// isOpen reports whether clients should pass over the upstream at now
+// without asking allow: open and cooling down, or already being probed.
+func (c *circuit) isOpen(now time.Time) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.probing || now.Before(c.openUntil)
+}
+
+// allow reports whether a client may dial the upstream at now, and whether
+// that dial is the half-open probe: once the cool-down is over, the first
+// caller gets to probe and the others are turned away until it reports back
+// through done.
+func (c *circuit) allow(now time.Time) (ok, probe bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	switch {
+	case c.openUntil.IsZero():
+		return true, false
+	case c.probing || now.Before(c.openUntil):
+		return false, false
+	}
+	c.probing = true
+	return true, true
+}
+
+// done records the outcome of a dial allow let through and reports whether
+// it opened the circuit. A dial abandoned because the client or process went
+// away says nothing about the upstream; if it was the probe, the next client
+// probes instead.
+func (c *circuit) done(b breakerConfig, label, addr string, now time.Time, probe bool, err error, abandoned bool) (opened bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if probe {
+		c.probing = false
+	}
+	switch {
+	case abandoned:
+	case err == nil:
+		if !c.openUntil.IsZero() {
+			log.Printf("info: %supstream %s circuit closed: dial succeeded", label, addr)
+		}
+		c.failures, c.openUntil = 0, time.Time{}
+	case probe:
+		c.openUntil = now.Add(b.Cooldown)
+		log.Printf("warning: %supstream %s circuit reopened for %v: probe failed: %s", label, addr, b.Cooldown, err)
+		return true
+	default:
+		c.failures++
+		if c.failures >= b.Failures && c.openUntil.IsZero() {
+			c.openUntil = now.Add(b.Cooldown)
+			log.Printf("warning: %supstream %s circuit open for %v after %d failed dial(s): %s", label, addr, b.Cooldown, c.failures, err)
+			return true
+		}
+	}
+	return false
+}
+
+// inherit copies prev's counters, for an upstream carried over a reload.
+func (c *circuit) inherit(prev *circuit) {
+	prev.mu.Lock()
+	failures, openUntil := prev.failures, prev.openUntil
+	prev.mu.Unlock()
+	c.mu.Lock()
+	c.failures, c.openUntil = failures, openUntil
+	c.mu.Unlock()
+}
+
+// rejectClient sends b.Message, if any, to a client turned away because
+// every circuit is open. The caller closes the connection.
+func rejectClient(b breakerConfig, c net.Conn) {
+	if b.Message == "" {
+		return
+	}
+	_ = c.SetWriteDeadline(time.Now().Add(time.Second))
+	_, _ = c.Write([]byte(b.Message))
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBreakerConfig_Validate(t *testing.T) {
+	for _, tt := range []struct {
+		b    breakerConfig
+		want string
+	}{
+		{b: breakerConfig{}},
+		{b: breakerConfig{Failures: 3, Cooldown: time.Second, Message: "busy\n"}},
+		{b: breakerConfig{Failures: -1}, want: "invalid -breaker-failures -1"},
+		{b: breakerConfig{Failures: 3}, want: "invalid -breaker-cooldown 0s"},
+		{b: breakerConfig{Cooldown: time.Second, Message: "busy\n"}, want: "-breaker-message needs -breaker-failures"},
+	} {
+		err := tt.b.validate()
+		if tt.want == "" && err != nil || tt.want != "" && (err == nil || !strings.Contains(err.Error(), tt.want)) {
+			t.Errorf("%+v: err=%v, want %q", tt.b, err, tt.want)
+		}
+	}
+}
+
+// TestCircuit walks the breaker through closed, open, half-open and back.
+func TestCircuit(t *testing.T) {
+	logs := captureLog(t)
+	b := breakerConfig{Failures: 2, Cooldown: time.Minute}
+	var c circuit
+	now := time.Now()
+	fail := errors.New("refused")
+	dial := func(err error) {
+		t.Helper()
+		ok, probe := c.allow(now)
+		if !ok {
+			t.Fatal("dial not allowed")
+		}
+		c.done(b, "tunnel a: breaker: ", "up:443", now, probe, err, false)
+	}
+
+	dial(fail)
+	if ok, _ := c.allow(now); !ok || c.isOpen(now) {
+		t.Fatal("circuit opened after one failure")
+	}
+	dial(fail)
+	if ok, _ := c.allow(now); ok || !c.isOpen(now) {
+		t.Fatal("circuit still closed after two failures")
+	}
+
+	now = now.Add(time.Minute)
+	if c.isOpen(now) {
+		t.Fatal("circuit still open after the cool-down")
+	}
+	ok, probe := c.allow(now)
+	if !ok || !probe {
+		t.Fatalf("first client after the cool-down: ok=%v probe=%v, want the probe", ok, probe)
+	}
+	if ok, _ := c.allow(now); ok || !c.isOpen(now) {
+		t.Fatal("second client let through while the probe is in flight")
+	}
+	// A probe abandoned by its client hands over to the next one.
+	c.done(b, "tunnel a: breaker: ", "up:443", now, probe, fail, true)
+	dial(fail)
+	if ok, _ := c.allow(now); ok {
+		t.Fatal("circuit closed after a failed probe")
+	}
+
+	now = now.Add(time.Minute)
+	dial(nil)
+	if ok, probe := c.allow(now); !ok || probe {
+		t.Fatal("circuit not closed after a successful probe")
+	}
+
+	out := logs()
+	for _, want := range []string{
+		"warning: tunnel a: breaker: upstream up:443 circuit open for 1m0s after 2 failed dial(s): refused",
+		"warning: tunnel a: breaker: upstream up:443 circuit reopened for 1m0s: probe failed: refused",
+		"info: tunnel a: breaker: upstream up:443 circuit closed: dial succeeded",
+	} {
+		if strings.Count(out, want) != 1 {
+			t.Errorf("log should have %q once:\n%s", want, out)
+		}
+	}
+}
+
+// TestConnectUpstream_BreakerRejects: once the only upstream's circuit is
+// open, clients get the message and are closed without a dial.
+func TestConnectUpstream_BreakerRejects(t *testing.T) {
+	captureLog(t)
+	old := dialTimeout
+	dialTimeout = 5 * time.Second
+	t.Cleanup(func() { dialTimeout = old })
+	tun := mustSetupTunnel(t, &tunnel{remote: closedAddr(t)})
+	tun.breaker = breakerConfig{Failures: 2, Cooldown: time.Hour, Message: "busy\n"}
+
+	for range 2 {
+		client, server := net.Pipe()
+		if _, err := connectUpstream(t.Context(), server, tun); err == nil || errors.Is(err, errCircuitOpen) {
+			t.Fatalf("dial before the circuit opened: err=%v", err)
+		}
+		_ = client.Close()
+	}
+
+	client, server := net.Pipe()
+	defer func() { _ = client.Close() }()
+	got := make(chan string, 1)
+	go func() {
+		b, _ := io.ReadAll(client)
+		got <- string(b)
+	}()
+	start := time.Now()
+	_, err := connectUpstream(t.Context(), server, tun)
+	if !errors.Is(err, errCircuitOpen) {
+		t.Fatalf("err=%v, want the circuit open", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("rejection took %v", elapsed)
+	}
+	if msg := <-got; msg != "busy\n" {
+		t.Fatalf("client got %q, want the breaker message then EOF", msg)
+	}
+}
+
+// TestConnectUpstream_BreakerSkipsOpen: with a failover list, clients skip
+// an upstream whose circuit is open, and the probe after the cool-down does
+// not cost its client the connection.
+func TestConnectUpstream_BreakerSkipsOpen(t *testing.T) {
+	logs := captureLog(t)
+	dead := closedAddr(t)
+	goodUp := mustTestUpstream(t, nil)
+	good := goodUp.addr
+	tun := mustSetupTunnel(t, &tunnel{remote: dead + "," + good}, goodUp.cert)
+	tun.breaker = breakerConfig{Failures: 1, Cooldown: time.Hour}
+	connect := func() {
+		t.Helper()
+		client, server := net.Pipe()
+		defer func() { _ = client.Close() }()
+		up, err := connectUpstream(t.Context(), server, tun)
+		if err != nil {
+			t.Fatalf("connectUpstream: %v", err)
+		}
+		if got := up.RemoteAddr().String(); got != good {
+			t.Fatalf("connected to %s", got)
+		}
+		_ = up.Close()
+	}
+
+	connect()
+	if !strings.Contains(logs(), "upstream "+dead+" circuit open for 1h0m0s") {
+		t.Fatalf("circuit did not open:\n%s", logs())
+	}
+	// failedAt alone would only move dead to the back; the open circuit
+	// keeps it out of the list.
+	tun.upstreams[0].failedAt.Store(0)
+	before := logs()
+	connect()
+	if after := strings.TrimPrefix(logs(), before); strings.Contains(after, "upstream "+dead+" failed") {
+		t.Fatalf("client dialled the open upstream:\n%s", after)
+	}
+
+	tun.upstreams[0].circuit.mu.Lock()
+	tun.upstreams[0].circuit.openUntil = time.Now().Add(-time.Second)
+	tun.upstreams[0].circuit.mu.Unlock()
+	tun.upstreams[0].failedAt.Store(0)
+	connect()
+	if !strings.Contains(logs(), "upstream "+dead+" circuit reopened for 1h0m0s: probe failed") {
+		t.Fatalf("no probe after the cool-down:\n%s", logs())
+	}
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"os"
+	"strings"
+	"sync/atomic"
+
+	"github.com/youmark/pkcs8"
+	pkcs12 "software.sslmate.com/src/go-pkcs12"
+)
+
+// clientCertStore holds the client certificate presented to the upstream.
+// A SIGHUP reload sets up a new store from the rotated files, so in-flight
+// handshakes keep the certificate they started with and new dials pick up
+// the rotated one.
+type clientCertStore struct {
+	opts *tlsOptions
+	cert atomic.Pointer[tls.Certificate]
+}
+
+// newClientCertStore loads the configured client certificate, or returns nil
+// when mutual TLS is not configured.
+func newClientCertStore(o *tlsOptions) (*clientCertStore, error) {
+	if o.ClientCert == "" && o.ClientKey == "" && o.ClientPKCS12 == "" {
+		if o.ClientKeyPassFile != "" {
+			return nil, fmt.Errorf("-client-key-pass-file needs -client-cert or -client-pkcs12")
+		}
+		return nil, nil
+	}
+	if o.ClientPKCS12 != "" && (o.ClientCert != "" || o.ClientKey != "") {
+		return nil, fmt.Errorf("-client-pkcs12 cannot be combined with -client-cert/-client-key")
+	}
+	if o.ClientPKCS12 == "" && o.ClientCert == "" {
+		return nil, fmt.Errorf("-client-key needs -client-cert")
+	}
+	s := &clientCertStore{opts: o}
+	if err := s.reload(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// reload reads the certificate files. On error the previous certificate,
+// if any, stays in use.
+func (s *clientCertStore) reload() error {
+	cert, err := loadClientCert(s.opts)
+	if err != nil {
+		return err
+	}
+	s.cert.Store(cert)
+	return nil
+}
+
+// getClientCertificate is the tls.Config hook. It always offers the loaded
+// certificate; the upstream decides whether it is acceptable.
+func (s *clientCertStore) getClientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	return s.cert.Load(), nil
+}
+
+func loadClientCert(o *tlsOptions) (*tls.Certificate, error) {
+	var password string
+	if o.ClientKeyPassFile != "" {
+		b, err := os.ReadFile(o.ClientKeyPassFile)
+		if err != nil {
+			return nil, fmt.Errorf("read client key password: %w", err)
+		}
+		password = strings.TrimRight(string(b), "\r\n")
+	}
+	if o.ClientPKCS12 != "" {
+		return loadClientPKCS12(o.ClientPKCS12, password)
+	}
+	return loadClientPEM(o.ClientCert, o.ClientKey, password)
+}
+
+// loadClientPEM reads a certificate chain (leaf first, then intermediates)
+// and its private key. keyFile may be empty when both live in certFile. An
+// encrypted key is decrypted with password.
+func loadClientPEM(certFile, keyFile, password string) (*tls.Certificate, error) {
+	certPEM, err := os.ReadFile(certFile)
+	if err != nil {
+		return nil, fmt.Errorf("read client certificate: %w", err)
+	}
+	keyPEM := certPEM
+	if keyFile != "" {
+		if keyPEM, err = os.ReadFile(keyFile); err != nil {
+			return nil, fmt.Errorf("read client key: %w", err)
+		}
+	}
+
+	var chain [][]byte
+	for block, rest := pem.Decode(certPEM); block != nil; block, rest = pem.Decode(rest) {
+		if block.Type == "CERTIFICATE" {
+			chain = append(chain, block.Bytes)
+		}
+	}
+	if len(chain) == 0 {
+		return nil, fmt.Errorf("client certificate %s: no PEM certificates found", certFile)
+	}
+	keyName := keyFile
+	if keyName == "" {
+		keyName = certFile
+	}
+	var keyBlock *pem.Block
+	for block, rest := pem.Decode(keyPEM); block != nil; block, rest = pem.Decode(rest) {
+		if block.Type == "PRIVATE KEY" || block.Type == "ENCRYPTED PRIVATE KEY" || strings.HasSuffix(block.Type, " PRIVATE KEY") {
+			keyBlock = block
+			break
+		}
+	}
+	if keyBlock == nil {
+		return nil, fmt.Errorf("client key %s: no PEM private key found", keyName)
+	}
+	keyBlock, err = decryptKeyBlock(keyBlock, password)
+	if err != nil {
+		return nil, fmt.Errorf("client key %s: %w", keyName, err)
+	}
+	var certs []byte
+	for _, der := range chain {
+		certs = append(certs, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})...)
+	}
+	// tls.X509KeyPair does the key type detection and the leaf/key match
+	// check for us.
+	cert, err := tls.X509KeyPair(certs, pem.EncodeToMemory(keyBlock))
+	if err != nil {
+		return nil, fmt.Errorf("client certificate %s: %w", certFile, err)
+	}
+	return &cert, nil
+}
+
+// loadClientPKCS12 reads a .p12/.pfx bundle. Any CA certificates in the
+// bundle are sent as the chain after the leaf.
+func loadClientPKCS12(file, password string) (*tls.Certificate, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("read client PKCS#12: %w", err)
+	}
+	key, leaf, cas, err := pkcs12.DecodeChain(data, password)
+	if err != nil {
+		return nil, fmt.Errorf("client PKCS#12 %s: %w", file, err)
+	}
+	cert := &tls.Certificate{
+		Certificate: [][]byte{leaf.Raw},
+		PrivateKey:  key,
+		Leaf:        leaf,
+	}
+	for _, ca := range cas {
+		cert.Certificate = append(cert.Certificate, ca.Raw)
+	}
+	return cert, nil
+}
+
+// decryptKeyBlock returns b as an unencrypted key block. It handles PKCS#8
+// ("ENCRYPTED PRIVATE KEY", what current OpenSSL writes) and legacy OpenSSL
+// PEM encryption (Proc-Type: 4,ENCRYPTED); other blocks come back as is.
+func decryptKeyBlock(b *pem.Block, password string) (*pem.Block, error) {
+	//nolint:staticcheck // legacy PEM encryption is insecure but still common in the wild.
+	legacy := x509.IsEncryptedPEMBlock(b)
+	if b.Type != "ENCRYPTED PRIVATE KEY" && !legacy {
+		return b, nil
+	}
+	if password == "" {
+		return nil, fmt.Errorf("key is encrypted; set -client-key-pass-file")
+	}
+	if legacy {
+		//nolint:staticcheck // see above.
+		der, err := x509.DecryptPEMBlock(b, []byte(password))
+		if err != nil {
+			return nil, fmt.Errorf("decrypt key: %w", err)
+		}
+		return &pem.Block{Type: b.Type, Bytes: der}, nil
+	}
+	key, err := pkcs8.ParsePKCS8PrivateKey(b.Bytes, []byte(password))
+	if err != nil {
+		return nil, fmt.Errorf("decrypt key: %w", err)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, fmt.Errorf("decrypt key: %w", err)
+	}
+	return &pem.Block{Type: "PRIVATE KEY", Bytes: der}, nil
+}
@@ -0,0 +1,685 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// options is what the command line sets. The process flags fill cmdline;
+// `untls check` parses into options of its own, so checking changes nothing
+// the running process reads.
+type options struct {
+	// configFile is the -config path; "" means the command line is the
+	// config.
+	configFile                        string
+	localPorts                        intList
+	listenAddrs, remotes, tunnelNames stringList
+	unixMode, unixOwner               string
+	balance                           string
+	health                            healthCheck
+	breaker                           breakerConfig
+	pool                              poolConfig
+	// tls is the TLS flags. Every tunnel starts from a copy.
+	tls                         tlsOptions
+	dialTimeout, certExpiryWarn time.Duration
+	// logTimestamps prefixes log lines with date and time. journald and
+	// most supervisors add their own, so -log-timestamps=false avoids
+	// doubling them.
+	logTimestamps    bool
+	sessionCacheSize int
+	sessionCacheFile string
+	// stdio (-stdio) proxies stdin/stdout instead of listening, for
+	// ssh -o ProxyCommand='untls -stdio -t host:443'.
+	stdio bool
+	// inetd (-inetd) insists on serving the client inetd passed on stdin.
+	inetd bool
+}
+
+// config is everything main needs to start: the tunnels plus the
+// process-wide settings. It comes from the flags or from a -config file.
+type config struct {
+	tunnels          []*tunnel
+	dialTimeout      time.Duration
+	certExpiryWarn   time.Duration
+	sessionCacheSize int
+	sessionCacheFile string
+	unixMode         string
+	unixOwner        string
+	logTimestamps    bool
+	// file is the -config path c was read from; "" for the flags.
+	file string
+	// listenFlags is set when the flags gave -l or -listen.
+	listenFlags bool
+	// inetd is -inetd: stdin must be the client. Without it, a connected
+	// stream socket on stdin is still picked up unless c asks for
+	// listeners (see passedConn).
+	inetd bool
+}
+
+// listens reports whether c asks for listeners of its own: a -config file
+// names one for every tunnel, the flags only with -l or -listen.
+func (c *config) listens() bool {
+	return c.file != "" || c.listenFlags
+}
+
+// singleTunnel is the tunnel mode serves when there is no listener to tell
+// several apart.
+func (c *config) singleTunnel(mode string) (*tunnel, error) {
+	switch {
+	case len(c.tunnels) == 1:
+		return c.tunnels[0], nil
+	case c.file != "":
+		return nil, fmt.Errorf("%s needs a config with exactly one tunnel; %s has %d", mode, c.file, len(c.tunnels))
+	}
+	return nil, fmt.Errorf("%s serves a single -t, got %d", mode, len(c.tunnels))
+}
+
+// loadConfig reads -config when given and the flags otherwise. The two do
+// not mix: with -config every other flag is an error, so there is a single
+// place to look for the effective setting. -inetd and -stdio are the
+// exceptions: they say how the tunnel is served, not what it is
+// (stdioTunnel then refuses the file with a reason).
+func loadConfig(fs *flag.FlagSet, o *options) (*config, error) {
+	if o.configFile == "" {
+		return configFromFlags(o)
+	}
+	var set []string
+	fs.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "config", "inetd", "stdio":
+		default:
+			set = append(set, "-"+f.Name)
+		}
+	})
+	if len(set) > 0 {
+		return nil, fmt.Errorf("%s cannot be combined with -config; set it in %s", strings.Join(set, ", "), o.configFile)
+	}
+	c, err := loadConfigFile(o.configFile)
+	if err != nil {
+		return nil, err
+	}
+	c.inetd = o.inetd
+	return c, nil
+}
+
+func configFromFlags(o *options) (*config, error) {
+	tunnels, err := tunnelsFromFlags(o.tunnelNames, o.remotes, o.listenAddrs, o.localPorts, o.tls)
+	if err != nil {
+		return nil, err
+	}
+	for _, t := range tunnels {
+		t.balance = o.balance
+		t.health = o.health
+		t.breaker = o.breaker
+		t.pool = o.pool
+	}
+	return &config{
+		tunnels:          tunnels,
+		dialTimeout:      o.dialTimeout,
+		certExpiryWarn:   o.certExpiryWarn,
+		sessionCacheSize: o.sessionCacheSize,
+		sessionCacheFile: o.sessionCacheFile,
+		unixMode:         o.unixMode,
+		unixOwner:        o.unixOwner,
+		logTimestamps:    o.logTimestamps,
+		listenFlags:      len(o.listenAddrs) > 0 || len(o.localPorts) > 0,
+		inetd:            o.inetd,
+	}, nil
+}
+
+// validate checks the process-wide settings and every tunnel's TLS config
+// without side effects: it reads the certificate, key and CRL files, but
+// opens nothing for writing, loads no session cache and changes no global.
+// This is all `untls check` does.
+func (c *config) validate() error {
+	if err := c.check(); err != nil {
+		return err
+	}
+	for _, t := range c.tunnels {
+		if _, _, err := t.check(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// apply validates the process-wide settings, installs them and sets up
+// every tunnel. Nothing is bound yet.
+func (c *config) apply() error {
+	if err := c.check(); err != nil {
+		return err
+	}
+	unixPerms, _ = parseUnixPerms(c.unixMode, c.unixOwner)
+	setLogTimestamps(c.logTimestamps)
+	upstreamSessions = nil
+	if c.sessionCacheSize > 0 {
+		cache, err := newSessionCache(c.sessionCacheSize, c.sessionCacheFile)
+		if err != nil {
+			return err
+		}
+		upstreamSessions = cache
+	}
+	return c.setupTunnels()
+}
+
+// check validates the process-wide settings without installing them.
+func (c *config) check() error {
+	if c.dialTimeout <= 0 {
+		return fmt.Errorf("invalid -dial-timeout %v: must be > 0", c.dialTimeout)
+	}
+	if c.certExpiryWarn < 0 {
+		return fmt.Errorf("invalid -cert-expiry-warn %v: must be >= 0 (0 disables)", c.certExpiryWarn)
+	}
+	if c.sessionCacheSize < 0 {
+		return fmt.Errorf("invalid -session-cache-size %d: must be >= 0", c.sessionCacheSize)
+	}
+	if c.sessionCacheSize == 0 && c.sessionCacheFile != "" {
+		return errors.New("-session-cache-file needs -session-cache-size > 0")
+	}
+	if (c.unixMode != "" || c.unixOwner != "") && !slices.ContainsFunc(c.tunnels, func(t *tunnel) bool {
+		return strings.HasPrefix(t.listen, unixPrefix)
+	}) {
+		return errors.New("-unix-mode/-unix-owner need a unix: -listen address")
+	}
+	_, err := parseUnixPerms(c.unixMode, c.unixOwner)
+	return err
+}
+
+// setupTunnels gives every tunnel c's dial timeout and expiry window and
+// builds its TLS config, reading the certificate, key and CRL files it names.
+func (c *config) setupTunnels() error {
+	for _, t := range c.tunnels {
+		t.dialTimeout, t.certExpiryWarn = c.dialTimeout, c.certExpiryWarn
+		if t.opts.KeyLogFile == "" {
+			t.opts.KeyLogFile = os.Getenv("SSLKEYLOGFILE")
+		}
+		if err := t.setup(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func setLogTimestamps(on bool) {
+	if on {
+		log.SetFlags(log.LstdFlags)
+	} else {
+		log.SetFlags(0)
+	}
+}
+
+// fileConfig is the -config file format. Keys are the flag names; "tls"
+// holds the TLS flags shared by every tunnel, and a tunnel's own "tls"
+// overrides just the keys it sets.
+type fileConfig struct {
+	Tunnels          []fileTunnel `json:"tunnels"`
+	TLS              *tlsOptions  `json:"tls"`
+	DialTimeout      string       `json:"dial-timeout"`
+	CertExpiryWarn   string       `json:"cert-expiry-warn"`
+	SessionCacheSize *int         `json:"session-cache-size"`
+	SessionCacheFile string       `json:"session-cache-file"`
+	UnixMode         string       `json:"unix-mode"`
+	UnixOwner        string       `json:"unix-owner"`
+	LogTimestamps    *bool        `json:"log-timestamps"`
+}
+
+type fileTunnel struct {
+	Name   string `json:"name"`
+	Listen string `json:"listen"`
+	// Remote is "host:port" or a failover list: a JSON array or the -t
+	// comma-separated form.
+	Remote  json.RawMessage `json:"remote"`
+	Balance string          `json:"balance"`
+	Health  *fileHealth     `json:"health"`
+	Breaker *fileBreaker    `json:"breaker"`
+	Pool    *filePool       `json:"pool"`
+	TLS     *tlsOptions     `json:"tls"`
+}
+
+// fileHealth is a tunnel's "health" block: the -health-* flags without
+// their prefix.
+type fileHealth struct {
+	Check    string `json:"check"`
+	Interval string `json:"interval"`
+	Timeout  string `json:"timeout"`
+	Send     string `json:"send"`
+	Expect   string `json:"expect"`
+	Rise     *int   `json:"rise"`
+	Fall     *int   `json:"fall"`
+}
+
+// healthCheck fills in the defaults for the keys fh leaves out. On error,
+// field is the offending key's path under "health" (".interval"), if any.
+func (fh *fileHealth) healthCheck() (healthCheck, string, error) {
+	h := healthCheck{Mode: healthOff, Interval: defaultHealthInterval, Rise: defaultHealthRise, Fall: defaultHealthFall}
+	if fh == nil {
+		return h, "", nil
+	}
+	if fh.Check != "" {
+		h.Mode = fh.Check
+	}
+	if fh.Interval != "" {
+		d, err := time.ParseDuration(fh.Interval)
+		if err != nil || d <= 0 {
+			return h, ".interval", fmt.Errorf("invalid duration %q: want e.g. 10s, must be > 0", fh.Interval)
+		}
+		h.Interval = d
+	}
+	if fh.Timeout != "" {
+		d, err := time.ParseDuration(fh.Timeout)
+		if err != nil || d <= 0 {
+			return h, ".timeout", fmt.Errorf("invalid duration %q: want e.g. 5s, must be > 0", fh.Timeout)
+		}
+		h.Timeout = d
+	}
+	h.Send, h.Expect = fh.Send, fh.Expect
+	if fh.Rise != nil {
+		h.Rise = *fh.Rise
+	}
+	if fh.Fall != nil {
+		h.Fall = *fh.Fall
+	}
+	return h, "", h.validate()
+}
+
+// remoteSpec turns a "remote" value into the -t form.
+func remoteSpec(raw json.RawMessage) (string, error) {
+	if len(raw) == 0 {
+		return "", nil
+	}
+	var one string
+	if err := json.Unmarshal(raw, &one); err == nil {
+		return one, nil
+	}
+	var list []string
+	if err := json.Unmarshal(raw, &list); err != nil {
+		return "", errors.New("want \"host:port\" or a list of them")
+	}
+	return strings.Join(list, ","), nil
+}
+
+// fileBreaker is a tunnel's "breaker" block: the -breaker-* flags without
+// their prefix.
+type fileBreaker struct {
+	Failures int    `json:"failures"`
+	Cooldown string `json:"cooldown"`
+	Message  string `json:"message"`
+}
+
+// breakerConfig is like fileHealth.healthCheck.
+func (fb *fileBreaker) breakerConfig() (breakerConfig, string, error) {
+	b := breakerConfig{Cooldown: defaultBreakerCooldown}
+	if fb == nil {
+		return b, "", nil
+	}
+	b.Failures, b.Message = fb.Failures, fb.Message
+	if fb.Cooldown != "" {
+		d, err := time.ParseDuration(fb.Cooldown)
+		if err != nil || d <= 0 {
+			return b, ".cooldown", fmt.Errorf("invalid duration %q: want e.g. 30s, must be > 0", fb.Cooldown)
+		}
+		b.Cooldown = d
+	}
+	return b, "", b.validate()
+}
+
+// filePool is a tunnel's "pool" block: the -pool-* flags without their
+// prefix.
+type filePool struct {
+	Size    int    `json:"size"`
+	MaxIdle string `json:"max-idle"`
+}
+
+// poolConfig is like fileHealth.healthCheck.
+func (fp *filePool) poolConfig() (poolConfig, string, error) {
+	p := poolConfig{MaxIdle: defaultPoolMaxIdle}
+	if fp == nil {
+		return p, "", nil
+	}
+	p.Size = fp.Size
+	if fp.MaxIdle != "" {
+		d, err := time.ParseDuration(fp.MaxIdle)
+		if err != nil || d <= 0 {
+			return p, ".max-idle", fmt.Errorf("invalid duration %q: want e.g. 30s, must be > 0", fp.MaxIdle)
+		}
+		p.MaxIdle = d
+	}
+	return p, "", p.validate()
+}
+
+// rawTLS re-reads the "tls" objects untyped so a tunnel's block can be laid
+// over the shared one key by key.
+type rawTLS struct {
+	TLS     json.RawMessage `json:"tls"`
+	Tunnels []struct {
+		TLS json.RawMessage `json:"tls"`
+	} `json:"tunnels"`
+}
+
+// configError is a problem at a line of a -config file.
+type configError struct {
+	file string
+	line int
+	path string // JSON path, e.g. tunnels[1].remote; "" for syntax errors
+	err  error
+}
+
+func (e *configError) Error() string {
+	if e.path == "" {
+		return fmt.Sprintf("%s:%d: %s", e.file, e.line, e.err)
+	}
+	return fmt.Sprintf("%s:%d: %s: %s", e.file, e.line, e.path, e.err)
+}
+
+func (e *configError) Unwrap() error { return e.err }
+
+// loadConfigFile parses and validates a JSON config file. Errors carry the
+// file name and line of the offending key.
+func loadConfigFile(path string) (*config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read config: %w", err)
+	}
+	var fc fileConfig
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&fc); err != nil {
+		return nil, jsonDecodeError(path, data, err)
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return nil, &configError{file: path, line: lineAt(data, dec.InputOffset()), err: errors.New("unexpected data after the top-level object")}
+	}
+	var raw rawTLS
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, jsonDecodeError(path, data, err)
+	}
+
+	lines := jsonLines(data)
+	errAt := func(key string, err error) error {
+		return &configError{file: path, line: lines.find(key), path: key, err: err}
+	}
+
+	c := &config{
+		dialTimeout:      defaultDialTimeout,
+		certExpiryWarn:   defaultCertExpiryWarn,
+		sessionCacheSize: 64,
+		sessionCacheFile: fc.SessionCacheFile,
+		unixMode:         fc.UnixMode,
+		unixOwner:        fc.UnixOwner,
+		logTimestamps:    true,
+		file:             path,
+	}
+	if fc.DialTimeout != "" {
+		d, err := time.ParseDuration(fc.DialTimeout)
+		if err != nil || d <= 0 {
+			return nil, errAt("dial-timeout", fmt.Errorf("invalid duration %q: want e.g. 10s, must be > 0", fc.DialTimeout))
+		}
+		c.dialTimeout = d
+	}
+	if fc.CertExpiryWarn != "" {
+		d, err := time.ParseDuration(fc.CertExpiryWarn)
+		if err != nil || d < 0 {
+			return nil, errAt("cert-expiry-warn", fmt.Errorf("invalid duration %q: want e.g. 336h, 0 disables", fc.CertExpiryWarn))
+		}
+		c.certExpiryWarn = d
+	}
+	if fc.SessionCacheSize != nil {
+		if *fc.SessionCacheSize < 0 {
+			return nil, errAt("session-cache-size", fmt.Errorf("must be >= 0"))
+		}
+		c.sessionCacheSize = *fc.SessionCacheSize
+	}
+	if fc.SessionCacheFile != "" && c.sessionCacheSize == 0 {
+		return nil, errAt("session-cache-file", errors.New("needs session-cache-size > 0"))
+	}
+	if _, err := parseUnixPerms(fc.UnixMode, ""); err != nil {
+		return nil, errAt("unix-mode", err)
+	}
+	if _, err := parseUnixPerms("", fc.UnixOwner); err != nil {
+		return nil, errAt("unix-owner", err)
+	}
+	if fc.LogTimestamps != nil {
+		c.logTimestamps = *fc.LogTimestamps
+	}
+
+	if len(fc.Tunnels) == 0 {
+		return nil, errAt("tunnels", errors.New("at least one tunnel is required"))
+	}
+	seen := map[string]bool{}
+	for i, ft := range fc.Tunnels {
+		key := "tunnels[" + strconv.Itoa(i) + "]"
+		if ft.Name == "" {
+			return nil, errAt(key, errors.New("missing name"))
+		}
+		if err := validateTunnelName(ft.Name); err != nil {
+			return nil, errAt(key+".name", err)
+		}
+		if seen[ft.Name] {
+			return nil, errAt(key+".name", fmt.Errorf("duplicate tunnel name %q", ft.Name))
+		}
+		seen[ft.Name] = true
+		if ft.Listen == "" {
+			return nil, errAt(key, errors.New("missing listen address"))
+		}
+		listen, err := listenAddress(ft.Listen, 0)
+		if err != nil {
+			return nil, errAt(key+".listen", err)
+		}
+		remote, err := remoteSpec(ft.Remote)
+		var ups []*upstream
+		if err == nil {
+			ups, err = parseRemotes(remote)
+		}
+		if err != nil {
+			return nil, errAt(key+".remote", err)
+		}
+		if err := validateBalance(ft.Balance, ups); err != nil {
+			if ft.Balance == "" {
+				return nil, errAt(key+".remote", err)
+			}
+			return nil, errAt(key+".balance", err)
+		}
+		health, field, err := ft.Health.healthCheck()
+		if err != nil {
+			return nil, errAt(key+".health"+field, err)
+		}
+		breaker, field, err := ft.Breaker.breakerConfig()
+		if err != nil {
+			return nil, errAt(key+".breaker"+field, err)
+		}
+		pool, field, err := ft.Pool.poolConfig()
+		if err != nil {
+			return nil, errAt(key+".pool"+field, err)
+		}
+
+		// Fresh unmarshals every time so no two tunnels share slices.
+		var opts tlsOptions
+		tlsKey := "tls"
+		if len(raw.TLS) > 0 {
+			_ = json.Unmarshal(raw.TLS, &opts)
+		}
+		if len(raw.Tunnels[i].TLS) > 0 {
+			_ = json.Unmarshal(raw.Tunnels[i].TLS, &opts)
+			tlsKey = key + ".tls"
+		}
+		c.tunnels = append(c.tunnels, &tunnel{
+			name:    ft.Name,
+			listen:  listen,
+			remote:  remote,
+			balance: ft.Balance,
+			health:  health,
+			breaker: breaker,
+			pool:    pool,
+			opts:    opts,
+			// TLS problems surface in setup; point them at the block.
+			origin: fmt.Sprintf("%s:%d: %s", path, lines.find(tlsKey), tlsKey),
+		})
+	}
+	return c, nil
+}
+
+// jsonDecodeError turns an encoding/json error into a line-numbered one.
+func jsonDecodeError(file string, data []byte, err error) error {
+	var syntax *json.SyntaxError
+	var typ *json.UnmarshalTypeError
+	switch {
+	case errors.As(err, &syntax):
+		return &configError{file: file, line: lineBefore(data, syntax.Offset), err: errors.New(strings.TrimPrefix(syntax.Error(), "json: "))}
+	case errors.As(err, &typ):
+		return &configError{file: file, line: lineBefore(data, typ.Offset), path: typ.Field,
+			err: fmt.Errorf("cannot use %s as %s", typ.Value, typ.Type)}
+	case errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, io.EOF):
+		return &configError{file: file, line: lineBefore(data, int64(len(data))), err: errors.New("unexpected end of file")}
+	}
+	// DisallowUnknownFields reports `json: unknown field "x"` without an
+	// offset; find the key ourselves.
+	if name, ok := strings.CutPrefix(err.Error(), "json: unknown field "); ok {
+		name, _ = strconv.Unquote(name)
+		return &configError{file: file, line: jsonLines(data).findKey(name), err: fmt.Errorf("unknown key %q", name)}
+	}
+	return fmt.Errorf("%s: %w", file, err)
+}
+
+// lineAt is the 1-based line of data[offset], skipping the separators
+// encoding/json leaves between a reported offset and the value itself.
+func lineAt(data []byte, offset int64) int {
+	off := int(min(offset, int64(len(data))))
+	for off < len(data) && strings.IndexByte(" \t\r\n,:", data[off]) >= 0 {
+		off++
+	}
+	return bytes.Count(data[:off], []byte("\n")) + 1
+}
+
+// lineBefore is the line of the byte just before offset: encoding/json
+// reports syntax and type errors just past the offending byte or value.
+func lineBefore(data []byte, offset int64) int {
+	off := int(min(max(offset-1, 0), int64(len(data))))
+	return bytes.Count(data[:off], []byte("\n")) + 1
+}
+
+// jsonPositions maps JSON paths (tunnels[1].tls.pin) to the line of their
+// key or, for array elements, their first token.
+type jsonPositions map[string]int
+
+// jsonLines walks data token by token. It is only used to place errors, so a
+// malformed tail just stops the walk.
+func jsonLines(data []byte) jsonPositions {
+	pos := jsonPositions{}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	var walk func(path string) error
+	walk = func(path string) error {
+		tok, err := dec.Token()
+		if err != nil {
+			return err
+		}
+		switch tok {
+		case json.Delim('{'):
+			for dec.More() {
+				start := dec.InputOffset()
+				k, err := dec.Token()
+				if err != nil {
+					return err
+				}
+				p := k.(string)
+				if path != "" {
+					p = path + "." + p
+				}
+				pos[p] = lineAt(data, start)
+				if err := walk(p); err != nil {
+					return err
+				}
+			}
+			_, err = dec.Token()
+		case json.Delim('['):
+			for i := 0; dec.More(); i++ {
+				p := path + "[" + strconv.Itoa(i) + "]"
+				pos[p] = lineAt(data, dec.InputOffset())
+				if err := walk(p); err != nil {
+					return err
+				}
+			}
+			_, err = dec.Token()
+		}
+		return err
+	}
+	_ = walk("")
+	return pos
+}
+
+// find returns the line of path or of its closest parent, or 1.
+func (p jsonPositions) find(path string) int {
+	for path != "" {
+		if line, ok := p[path]; ok {
+			return line
+		}
+		i := strings.LastIndexAny(path, ".[")
+		if i < 0 {
+			break
+		}
+		path = path[:i]
+	}
+	return 1
+}
+
+// findKey returns the first line holding a key called name, or 1.
+func (p jsonPositions) findKey(name string) int {
+	line := 0
+	for path, l := range p {
+		if (path == name || strings.HasSuffix(path, "."+name)) && (line == 0 || l < line) {
+			line = l
+		}
+	}
+	return max(line, 1)
+}
+
+const checkUsage = `usage: untls check [-config <file> | tunnel flags...]
+
+Validates the configuration the same way startup does, including loading
+CA, client certificate and CRL files, without binding any listener.
+`
+
+// checkCommand implements `untls check ...` and returns the exit code.
+func checkCommand(args []string, stdout, stderr io.Writer) int {
+	var o options
+	flags := flag.NewFlagSet("check", flag.ContinueOnError)
+	registerFlags(flags, &o)
+	flags.SetOutput(stderr)
+	flags.Usage = func() {
+		_, _ = fmt.Fprint(stderr, checkUsage)
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if flags.NArg() > 0 {
+		flags.Usage()
+		return 2
+	}
+	c, err := loadConfig(flags, &o)
+	if err == nil {
+		err = c.validate()
+	}
+	if err != nil {
+		_, _ = fmt.Fprintf(stderr, "untls check: %s\n", err)
+		return 1
+	}
+	for _, t := range c.tunnels {
+		name := t.name
+		if name == "" {
+			name = "(unnamed)"
+		}
+		_, _ = fmt.Fprintf(stdout, "tunnel %s: %s -> %s\n", name, t.listen, t.remote)
+	}
+	_, _ = fmt.Fprintf(stdout, "configuration OK: %d tunnel(s)\n", len(c.tunnels))
+	return 0
+}
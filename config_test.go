@@ -0,0 +1,315 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeConfig(t *testing.T, body string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "untls.json")
+	if err := os.WriteFile(path, []byte(body), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadConfigFile(t *testing.T) {
+	path := writeConfig(t, `{
+  "dial-timeout": "3s",
+  "cert-expiry-warn": "0s",
+  "session-cache-size": 8,
+  "log-timestamps": false,
+  "tls": {"ca-file": ["/etc/ca.pem"], "alpn": ["h2"], "tls-min": "1.2"},
+  "tunnels": [
+    {"name": "mc", "listen": "127.0.0.1:25565", "remote": "mc.example.com:443"},
+    {"name": "db", "listen": "unix:/run/db.sock", "remote": "db.example.com:5433",
+     "tls": {"alpn": ["postgresql"], "sni": "pg.internal"}}
+  ]
+}
+`)
+	c, err := loadConfigFile(path)
+	if err != nil {
+		t.Fatalf("loadConfigFile: %v", err)
+	}
+	if c.dialTimeout != 3*time.Second || c.certExpiryWarn != 0 || c.sessionCacheSize != 8 || c.logTimestamps {
+		t.Fatalf("settings = %+v", c)
+	}
+	if len(c.tunnels) != 2 {
+		t.Fatalf("got %d tunnels", len(c.tunnels))
+	}
+	mc, db := c.tunnels[0], c.tunnels[1]
+	if mc.name != "mc" || mc.listen != "127.0.0.1:25565" || mc.remote != "mc.example.com:443" {
+		t.Fatalf("mc = %+v", mc)
+	}
+	if !slices.Equal(mc.opts.ALPN, []string{"h2"}) || mc.opts.MinVersion != "1.2" {
+		t.Fatalf("mc did not get the shared tls block: %+v", mc.opts)
+	}
+	// The tunnel block overrides alpn and adds sni; the rest is inherited.
+	if !slices.Equal(db.opts.ALPN, []string{"postgresql"}) || db.opts.ServerName != "pg.internal" ||
+		!slices.Equal(db.opts.CAFiles, []string{"/etc/ca.pem"}) || db.opts.MinVersion != "1.2" {
+		t.Fatalf("db overlay = %+v", db.opts)
+	}
+	if !slices.Equal(mc.opts.ALPN, []string{"h2"}) {
+		t.Fatalf("overlay leaked into mc: %v", mc.opts.ALPN)
+	}
+}
+
+func TestLoadConfigFile_Defaults(t *testing.T) {
+	c, err := loadConfigFile(writeConfig(t, `{"tunnels": [{"name": "a", "listen": ":0", "remote": "a:443"}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.dialTimeout != defaultDialTimeout || c.certExpiryWarn != defaultCertExpiryWarn || c.sessionCacheSize != 64 || !c.logTimestamps {
+		t.Fatalf("defaults = %+v", c)
+	}
+}
+
+func TestLoadConfigFile_Errors(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+		want string // file:line prefix is checked separately
+		line int
+	}{
+		{name: "syntax", body: "{\n  \"tunnels\": [\n    {\"name\": \"a\",}\n  ]\n}\n", want: "invalid character '}'", line: 3},
+		{name: "truncated", body: "{\n  \"tunnels\": [\n", want: "unexpected end of file", line: 2},
+		{name: "wrong type", body: "{\n  \"session-cache-size\": \"big\"\n}\n", want: "cannot use string as int", line: 2},
+		{name: "unknown key", body: "{\n  \"tunnels\": [],\n  \"tls\": {\n    \"ca_file\": []\n  }\n}\n", want: `unknown key "ca_file"`, line: 4},
+		{name: "trailing data", body: "{\"tunnels\": []}\n{}\n", want: "unexpected data", line: 2},
+		{name: "no tunnels", body: "{\n  \"tunnels\": []\n}\n", want: "tunnels: at least one tunnel", line: 2},
+		{name: "bad remote", body: "{\"tunnels\": [\n  {\"name\": \"a\", \"listen\": \":1\", \"remote\": \"a:443\"},\n  {\"name\": \"b\",\n   \"listen\": \":2\",\n   \"remote\": \"b\"}\n]}\n",
+			want: `tunnels[1].remote: invalid -t address "b"`, line: 5},
+		{name: "bad balance", body: "{\"tunnels\": [\n  {\"name\": \"a\", \"listen\": \":1\", \"remote\": [\"a:443\", \"b:443\"],\n   \"balance\": \"fastest\"}\n]}\n",
+			want: `tunnels[0].balance: invalid -balance "fastest"`, line: 3},
+		{name: "weight without balance", body: "{\"tunnels\": [\n  {\"name\": \"a\", \"listen\": \":1\", \"remote\": [\"a:443=2\", \"b:443\"]}\n]}\n",
+			want: "tunnels[0].remote: weight on a:443 needs -balance", line: 2},
+		{name: "bad health", body: "{\"tunnels\": [\n  {\"name\": \"a\", \"listen\": \":1\", \"remote\": \"a:443\",\n   \"health\": {\"check\": \"ping\"}}\n]}\n",
+			want: `tunnels[0].health: invalid -health-check "ping"`, line: 3},
+		{name: "bad health interval", body: "{\"tunnels\": [\n  {\"name\": \"a\", \"listen\": \":1\", \"remote\": \"a:443\",\n   \"health\": {\"check\": \"tcp\",\n              \"interval\": \"5\"}}\n]}\n",
+			want: `tunnels[0].health.interval: invalid duration "5"`, line: 4},
+		{name: "bad breaker cooldown", body: "{\"tunnels\": [\n  {\"name\": \"a\", \"listen\": \":1\", \"remote\": \"a:443\",\n   \"breaker\": {\"failures\": 5,\n               \"cooldown\": \"-1s\"}}\n]}\n",
+			want: `tunnels[0].breaker.cooldown: invalid duration "-1s"`, line: 4},
+		{name: "breaker message without failures", body: "{\"tunnels\": [\n  {\"name\": \"a\", \"listen\": \":1\", \"remote\": \"a:443\",\n   \"breaker\": {\"message\": \"busy\"}}\n]}\n",
+			want: "tunnels[0].breaker: -breaker-message needs -breaker-failures", line: 3},
+		{name: "bad pool size", body: "{\"tunnels\": [\n  {\"name\": \"a\", \"listen\": \":1\", \"remote\": \"a:443\",\n   \"pool\": {\"size\": 1000}}\n]}\n",
+			want: "tunnels[0].pool: invalid -pool-size 1000", line: 3},
+		{name: "bad pool max-idle", body: "{\"tunnels\": [\n  {\"name\": \"a\", \"listen\": \":1\", \"remote\": \"a:443\",\n   \"pool\": {\"size\": 2,\n            \"max-idle\": \"soon\"}}\n]}\n",
+			want: `tunnels[0].pool.max-idle: invalid duration "soon"`, line: 4},
+		{name: "bad listen", body: "{\"tunnels\": [\n  {\"name\": \"a\", \"listen\": \"nope\", \"remote\": \"a:443\"}\n]}\n", want: "tunnels[0].listen: invalid -listen", line: 2},
+		{name: "missing listen", body: "{\"tunnels\": [\n\n  {\"name\": \"a\", \"remote\": \"a:443\"}\n]}\n", want: "tunnels[0]: missing listen", line: 3},
+		{name: "missing name", body: "{\"tunnels\": [\n  {\"listen\": \":1\", \"remote\": \"a:443\"}\n]}\n", want: "tunnels[0]: missing name", line: 2},
+		{name: "duplicate name", body: "{\"tunnels\": [\n  {\"name\": \"a\", \"listen\": \":1\", \"remote\": \"a:443\"},\n  {\"name\": \"a\", \"listen\": \":2\", \"remote\": \"b:443\"}\n]}\n", want: "duplicate tunnel name", line: 3},
+		{name: "bad duration", body: "{\n  \"dial-timeout\": \"10\",\n  \"tunnels\": []\n}\n", want: "dial-timeout: invalid duration", line: 2},
+		{name: "bad unix mode", body: "{\n  \"unix-mode\": \"777x\"\n}\n", want: "unix-mode: invalid -unix-mode", line: 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := writeConfig(t, tt.body)
+			_, err := loadConfigFile(path)
+			if err == nil {
+				t.Fatal("expected error")
+			}
+			var ce *configError
+			if !errors.As(err, &ce) {
+				t.Fatalf("err %T %q is not a configError", err, err)
+			}
+			if ce.line != tt.line || !strings.Contains(err.Error(), tt.want) {
+				t.Fatalf("err=%q (line %d), want line %d mentioning %q", err, ce.line, tt.line, tt.want)
+			}
+			if !strings.HasPrefix(err.Error(), path+":") {
+				t.Fatalf("err=%q does not start with the file name", err)
+			}
+		})
+	}
+}
+
+// TestConfig_ApplyTLSErrorLine: TLS problems found while building a tunnel
+// point at the tls block they came from.
+func TestConfig_ApplyTLSErrorLine(t *testing.T) {
+	path := writeConfig(t, `{
+  "session-cache-size": 0,
+  "tls": {"alpn": ["h2"]},
+  "tunnels": [
+    {"name": "ok", "listen": ":1", "remote": "a:443"},
+    {"name": "bad", "listen": ":2", "remote": "b:443",
+     "tls": {"pin-mode": "replace"}}
+  ]
+}
+`)
+	c, err := loadConfigFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keepGlobals(t)
+	err = c.apply()
+	want := path + ":7: tunnels[1].tls: tunnel bad: -pin-mode replace needs at least one -pin"
+	if err == nil || err.Error() != want {
+		t.Fatalf("apply err=%v\nwant %s", err, want)
+	}
+}
+
+func TestCheckCommand(t *testing.T) {
+	keepGlobals(t)
+	ok := writeConfig(t, `{"session-cache-size": 0, "tunnels": [{"name": "mc", "listen": "127.0.0.1:25565", "remote": "mc.example.com:443"}]}`)
+	var stdout, stderr bytes.Buffer
+	if code := checkCommand([]string{"-config", ok}, &stdout, &stderr); code != 0 {
+		t.Fatalf("exit %d, stderr=%q", code, stderr.String())
+	}
+	if !strings.Contains(stdout.String(), "tunnel mc: 127.0.0.1:25565 -> mc.example.com:443") ||
+		!strings.Contains(stdout.String(), "configuration OK: 1 tunnel(s)") {
+		t.Fatalf("stdout=%q", stdout.String())
+	}
+
+	bad := writeConfig(t, "{\n  \"tunnels\": [\n    {\"name\": \"mc\", \"listen\": \":1\", \"remote\": \"mc\"}\n  ]\n}\n")
+	stdout.Reset()
+	stderr.Reset()
+	if code := checkCommand([]string{"-config", bad}, &stdout, &stderr); code != 1 {
+		t.Fatalf("exit %d for a bad config", code)
+	}
+	if want := "untls check: " + bad + ":3: tunnels[0].remote"; !strings.HasPrefix(stderr.String(), want) {
+		t.Fatalf("stderr=%q, want prefix %q", stderr.String(), want)
+	}
+
+	stderr.Reset()
+	if code := checkCommand([]string{"-config", ok, "-alpn", "h2"}, &stdout, &stderr); code != 1 ||
+		!strings.Contains(stderr.String(), "-alpn cannot be combined with -config") {
+		t.Fatalf("exit %d, stderr=%q", code, stderr.String())
+	}
+
+	if code := checkCommand([]string{"extra"}, &stdout, &stderr); code != 2 {
+		t.Fatalf("exit %d for a stray argument", code)
+	}
+}
+
+// TestCheckCommand_NoSideEffects: check reads the config but creates no
+// file, loads no session cache and leaves the process globals alone.
+func TestCheckCommand_NoSideEffects(t *testing.T) {
+	keepGlobals(t)
+	logs := captureLog(t)
+	dir := t.TempDir()
+	keyLog := filepath.Join(dir, "env-keys.log")
+	t.Setenv("SSLKEYLOGFILE", keyLog)
+	sessions := filepath.Join(dir, "sessions.json")
+	if err := os.WriteFile(sessions, []byte("{"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	path := writeConfig(t, fmt.Sprintf(`{"dial-timeout": "3s", "log-timestamps": false, "session-cache-file": %q,
+  "tunnels": [{"name": "a", "listen": "127.0.0.1:1", "remote": "a.example:443",
+               "tls": {"keylog-file": %q}}]}`, sessions, filepath.Join(dir, "keys.log")))
+	flags, timeout, cache := log.Flags(), dialTimeout, upstreamSessions
+	opts := cmdline
+
+	var stdout, stderr bytes.Buffer
+	if code := checkCommand([]string{"-config", path}, &stdout, &stderr); code != 0 {
+		t.Fatalf("exit %d, stderr=%q", code, stderr.String())
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Fatalf("check created files: %v", entries)
+	}
+	if log.Flags() != flags || dialTimeout != timeout || upstreamSessions != cache || !reflect.DeepEqual(cmdline, opts) {
+		t.Fatal("check changed process globals")
+	}
+	if strings.Contains(logs(), "WARNING") {
+		t.Fatalf("check logged:\n%s", logs())
+	}
+}
+
+// keepGlobals restores what config.apply overwrites.
+func keepGlobals(t *testing.T) {
+	t.Helper()
+	oldPerms, oldSessions := unixPerms, upstreamSessions
+	t.Cleanup(func() {
+		unixPerms, upstreamSessions = oldPerms, oldSessions
+	})
+}
+
+// TestLoadConfig_ServeModes: the flags that pick how the tunnel is served
+// may be given alongside -config.
+func TestLoadConfig_ServeModes(t *testing.T) {
+	path := writeConfig(t, `{"tunnels": [{"name": "a", "listen": "127.0.0.1:1", "remote": "a.example:443"}]}`)
+	for _, flagName := range []string{"-inetd", "-stdio"} {
+		t.Run(flagName, func(t *testing.T) {
+			var o options
+			fs := flag.NewFlagSet("untls", flag.ContinueOnError)
+			registerFlags(fs, &o)
+			if err := fs.Parse([]string{"-config", path, flagName}); err != nil {
+				t.Fatal(err)
+			}
+			c, err := loadConfig(fs, &o)
+			if err != nil {
+				t.Fatalf("loadConfig: %v", err)
+			}
+			if len(c.tunnels) != 1 || c.tunnels[0].name != "a" {
+				t.Fatalf("tunnels = %v", c.tunnels)
+			}
+		})
+	}
+}
+
+func TestLoadConfigFile_RemoteList(t *testing.T) {
+	c, err := loadConfigFile(writeConfig(t, `{"tunnels": [
+  {"name": "a", "listen": "127.0.0.1:1", "remote": ["a.example:443", "b.example:443"]},
+  {"name": "b", "listen": "127.0.0.1:2", "remote": "a.example:443,b.example:443"}
+]}`))
+	if err != nil {
+		t.Fatalf("loadConfigFile: %v", err)
+	}
+	for _, tun := range c.tunnels {
+		if tun.remote != "a.example:443,b.example:443" {
+			t.Fatalf("tunnel %s remote = %q", tun.name, tun.remote)
+		}
+	}
+
+	path := writeConfig(t, `{"tunnels": [
+  {"name": "a", "listen": "127.0.0.1:1",
+   "remote": [443]}
+]}`)
+	_, err = loadConfigFile(path)
+	if want := path + ":3: tunnels[0].remote: want \"host:port\" or a list of them"; err == nil || err.Error() != want {
+		t.Fatalf("err=%v, want %q", err, want)
+	}
+}
+
+func TestLoadConfigFile_UpstreamBlocks(t *testing.T) {
+	c, err := loadConfigFile(writeConfig(t, `{"tunnels": [
+  {"name": "a", "listen": "127.0.0.1:1", "remote": "a.example:443"},
+  {"name": "b", "listen": "127.0.0.1:2", "remote": "b.example:443",
+   "health": {"check": "tls", "interval": "5s", "timeout": "2s", "send": "PING\r\n", "expect": "+PONG", "fall": 1},
+   "breaker": {"failures": 5, "message": "busy\n"},
+   "pool": {"size": 4, "max-idle": "10s"}}
+]}`))
+	if err != nil {
+		t.Fatalf("loadConfigFile: %v", err)
+	}
+	if h := c.tunnels[0].health; h.enabled() || h.Interval != defaultHealthInterval {
+		t.Fatalf("default health = %+v", h)
+	}
+	if p := c.tunnels[1].pool; p != (poolConfig{Size: 4, MaxIdle: 10 * time.Second}) {
+		t.Fatalf("pool = %+v", p)
+	}
+	if p := c.tunnels[0].pool; p.enabled() || p.MaxIdle != defaultPoolMaxIdle {
+		t.Fatalf("default pool = %+v", p)
+	}
+	if b := c.tunnels[1].breaker; b != (breakerConfig{Failures: 5, Cooldown: defaultBreakerCooldown, Message: "busy\n"}) {
+		t.Fatalf("breaker = %+v", b)
+	}
+	want := healthCheck{Mode: healthTLS, Interval: 5 * time.Second, Timeout: 2 * time.Second, Send: "PING\r\n", Expect: "+PONG", Rise: defaultHealthRise, Fall: 1}
+	if h := c.tunnels[1].health; h != want {
+		t.Fatalf("health = %+v, want %+v", h, want)
+	}
+}
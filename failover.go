@@ -0,0 +1,225 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// upstream is one address a tunnel dials. A tunnel has one per -t entry, in
+// priority order.
+type upstream struct {
+	addr string
+	// weight is the share of clients -balance sends here (-t host:port=N);
+	// 1 unless given.
+	weight int
+	// tls is the config for new dials; a reload that keeps the upstream
+	// swaps it while the pool and health check keep running.
+	tls atomic.Pointer[tls.Config]
+	// failedAt is when the last dial or handshake to addr failed
+	// (UnixNano); 0 once a dial succeeds.
+	failedAt atomic.Int64
+	// active counts the sessions proxied to addr, for least-conn.
+	active atomic.Int64
+	// down is set while -health-check considers addr unhealthy.
+	down atomic.Bool
+	// circuit is the -breaker-failures state.
+	circuit circuit
+	// pool holds pre-handshaked connections to addr; nil without -pool-size.
+	pool *connPool
+}
+
+// upstreamConn is an upstream TLS connection: a fresh *tls.Conn, or a
+// *pooledConn.
+type upstreamConn interface {
+	net.Conn
+	ConnectionState() tls.ConnectionState
+}
+
+// failoverHold is how long a failed upstream is tried only after the others.
+// Overridable in tests.
+var failoverHold = 30 * time.Second
+
+// parseRemotes splits -t into its upstream list: "a:443,b:443" tries a
+// first, then b. An entry may end in =N to weigh it for -balance.
+func parseRemotes(spec string) ([]*upstream, error) {
+	if spec == "" {
+		return nil, validateRemote("")
+	}
+	var ups []*upstream
+	for _, a := range strings.Split(spec, ",") {
+		u := &upstream{addr: strings.TrimSpace(a), weight: 1}
+		if addr, w, ok := strings.Cut(u.addr, "="); ok {
+			n, err := strconv.Atoi(w)
+			if err != nil || n < 1 || n > 1000 {
+				return nil, fmt.Errorf("invalid -t weight %q: want 1-1000", a)
+			}
+			u.addr, u.weight = addr, n
+		}
+		if err := validateRemote(u.addr); err != nil {
+			return nil, err
+		}
+		if slices.ContainsFunc(ups, func(o *upstream) bool { return o.addr == u.addr }) {
+			return nil, fmt.Errorf("invalid -t %q: %s is listed twice", spec, u.addr)
+		}
+		ups = append(ups, u)
+	}
+	return ups, nil
+}
+
+// dialOrder is the order to try t's upstreams in at now for client: the
+// -balance order, except that upstreams which failed within failoverHold go
+// last (oldest failure first), so a dead endpoint does not cost every client
+// a timeout. Upstreams the health checks marked down are left out, unless
+// all of them are: then a check may be wrong, and trying beats refusing.
+// Upstreams whose circuit is open are always left out.
+func (t *tunnel) dialOrder(now time.Time, client net.Addr) []*upstream {
+	var order, held, down []*upstream
+	for _, u := range t.balanceOrder(client) {
+		switch f := u.failedAt.Load(); {
+		case t.breaker.enabled() && u.circuit.isOpen(now):
+		case u.down.Load():
+			down = append(down, u)
+		case f != 0 && now.Sub(time.Unix(0, f)) < failoverHold:
+			held = append(held, u)
+		default:
+			order = append(order, u)
+		}
+	}
+	if len(order) == 0 && len(held) == 0 {
+		return down
+	}
+	slices.SortStableFunc(held, func(a, b *upstream) int {
+		return cmp.Compare(a.failedAt.Load(), b.failedAt.Load())
+	})
+	return append(order, held...)
+}
+
+// dialUpstream tries t's upstreams in dialOrder until one completes the TLS
+// handshake. ctx bounds the whole attempt; each upstream gets an equal share
+// of what is left, so a blackholed first choice still leaves time for the
+// next. An idle connection from an upstream's pool is used instead of
+// dialing it while the upstream is in good standing (see poolUsable). It
+// returns the upstream that answered, or errCircuitOpen when the breaker
+// let it try none.
+func dialUpstream(ctx context.Context, client net.Addr, label string, t *tunnel) (upstreamConn, *upstream, error) {
+	order := t.dialOrder(time.Now(), client)
+	var errs upstreamErrors
+	for i, u := range order {
+		probe := false
+		if t.breaker.enabled() {
+			var ok bool
+			if ok, probe = u.circuit.allow(time.Now()); !ok {
+				continue
+			}
+		}
+		if !probe && u.poolUsable(time.Now()) {
+			if c := u.pool.take(time.Now(), u.tls.Load()); c != nil {
+				logWarnings(label, c.warnings)
+				return c, u, nil
+			}
+		}
+		attemptCtx, cancel := attemptContext(ctx, len(order)-i)
+		conn, warnings, err := u.dial(attemptCtx, u.tls.Load())
+		cancel()
+		if t.breaker.enabled() {
+			// Idle connections to an upstream the breaker gave up on are
+			// not handed out any more; do not keep them open either.
+			if u.circuit.done(t.breaker, t.logArea("breaker"), u.addr, time.Now(), probe, err, errors.Is(ctx.Err(), context.Canceled)) {
+				u.pool.closeIdle()
+			}
+		}
+		if err == nil {
+			u.failedAt.Store(0)
+			logWarnings(label, warnings)
+			return conn, u, nil
+		}
+		u.failedAt.Store(time.Now().UnixNano())
+		if len(order) == 1 {
+			return nil, u, err
+		}
+		errs = append(errs, fmt.Errorf("%s: %w", u.addr, err))
+		if ctx.Err() != nil {
+			break
+		}
+		if i < len(order)-1 {
+			log.Printf("%s: upstream %s failed: %s; trying %s", label, u.addr, err, order[i+1].addr)
+		}
+	}
+	if len(errs) == 0 {
+		return nil, nil, errCircuitOpen
+	}
+	return nil, nil, errs
+}
+
+// dial connects to u and completes the TLS handshake with cfg, normally
+// u.tls.Load(). What soft -revocation let through is returned as warnings
+// for the caller to log under its own label.
+func (u *upstream) dial(ctx context.Context, cfg *tls.Config) (*tls.Conn, []string, error) {
+	var warnings []string
+	if verify := cfg.VerifyConnection; verify != nil {
+		cfg = cfg.Clone()
+		cfg.VerifyConnection = func(cs tls.ConnectionState) error {
+			err := verify(cs)
+			var w *revocationWarning
+			if errors.As(err, &w) {
+				warnings = append(warnings, w.Error())
+				return nil
+			}
+			return err
+		}
+	}
+	c, err := (&tls.Dialer{Config: cfg}).DialContext(ctx, "tcp", u.addr)
+	if err != nil {
+		return nil, nil, err
+	}
+	return c.(*tls.Conn), warnings, nil
+}
+
+// logWarnings logs each of a connection's dial warnings under label.
+func logWarnings(label string, warnings []string) {
+	for _, w := range warnings {
+		log.Printf("%s: warning: %s", label, w)
+	}
+}
+
+// poolUsable reports whether u's idle connections may be handed out at now:
+// not while the health checks have it down or a dial to it failed within
+// failoverHold. They were handshaked before that, so they say nothing about
+// whether it still answers; a fresh dial finds out.
+func (u *upstream) poolUsable(now time.Time) bool {
+	f := u.failedAt.Load()
+	return !u.down.Load() && (f == 0 || now.Sub(time.Unix(0, f)) >= failoverHold)
+}
+
+// attemptContext gives the next of remaining attempts an equal share of the
+// time ctx has left.
+func attemptContext(ctx context.Context, remaining int) (context.Context, context.CancelFunc) {
+	deadline, ok := ctx.Deadline()
+	if !ok || remaining <= 1 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, time.Until(deadline)/time.Duration(remaining))
+}
+
+// upstreamErrors is every upstream's dial error, on one log line.
+type upstreamErrors []error
+
+func (e upstreamErrors) Error() string {
+	s := make([]string, len(e))
+	for i, err := range e {
+		s[i] = err.Error()
+	}
+	return "all upstreams failed: " + strings.Join(s, "; ")
+}
+
+func (e upstreamErrors) Unwrap() []error { return e }
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseRemotes(t *testing.T) {
+	tests := []struct {
+		spec    string
+		want    []string
+		wantErr string
+	}{
+		{spec: "a.example:443", want: []string{"a.example:443"}},
+		{spec: "a.example:443,b.example:8443", want: []string{"a.example:443", "b.example:8443"}},
+		{spec: "a.example:443, [::1]:443", want: []string{"a.example:443", "[::1]:443"}},
+		{spec: "", wantErr: "missing tcp socket"},
+		{spec: "a.example:443,", wantErr: "missing tcp socket"},
+		{spec: "a.example:443,b.example", wantErr: "want host:port"},
+		{spec: "a.example:443,a.example:443", wantErr: "listed twice"},
+	}
+	for _, tt := range tests {
+		got, err := parseRemotes(tt.spec)
+		if tt.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("parseRemotes(%q) err=%v, want %q", tt.spec, err, tt.wantErr)
+			}
+			continue
+		}
+		var addrs []string
+		for _, u := range got {
+			addrs = append(addrs, u.addr)
+		}
+		if err != nil || strings.Join(addrs, " ") != strings.Join(tt.want, " ") {
+			t.Errorf("parseRemotes(%q) = %v, %v; want %v", tt.spec, got, err, tt.want)
+		}
+	}
+}
+
+func closedAddr(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	_ = ln.Close()
+	return addr
+}
+
+// TestConnectUpstream_Failover: a refused dial and a failed handshake both
+// move on to the next upstream, the choice is logged, and the failed ones
+// are tried last afterwards.
+func TestConnectUpstream_Failover(t *testing.T) {
+	logs := captureLog(t)
+	dead := closedAddr(t)
+	untrusted := mustTestUpstream(t, nil).addr
+	goodUp := mustTestUpstream(t, nil)
+	good := goodUp.addr
+	tun := mustSetupTunnel(t, &tunnel{remote: dead + "," + untrusted + "," + good}, goodUp.cert)
+
+	client, server := net.Pipe()
+	defer func() { _ = client.Close() }()
+	up, err := connectUpstream(t.Context(), server, tun)
+	if err != nil {
+		t.Fatalf("connectUpstream: %v", err)
+	}
+	if got := up.RemoteAddr().String(); got != good {
+		t.Fatalf("connected to %s, want %s", got, good)
+	}
+	_ = up.Close()
+
+	out := logs()
+	for _, want := range []string{
+		"upstream " + dead + " failed: ",
+		"; trying " + untrusted,
+		"upstream " + untrusted + " failed: ",
+		"conn/pipe: upstream " + good + "\n",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("log lacks %q:\n%s", want, out)
+		}
+	}
+
+	order := tun.dialOrder(time.Now(), nil)
+	if order[0].addr != good || order[1].addr != dead || order[2].addr != untrusted {
+		t.Fatalf("order after failures = %s, %s, %s", order[0].addr, order[1].addr, order[2].addr)
+	}
+}
+
+func TestDialOrder(t *testing.T) {
+	tun := &tunnel{upstreams: []*upstream{{addr: "a"}, {addr: "b"}, {addr: "c"}}}
+	now := time.Now()
+	names := func() string {
+		var s []string
+		for _, u := range tun.dialOrder(now, nil) {
+			s = append(s, u.addr)
+		}
+		return strings.Join(s, ",")
+	}
+	if got := names(); got != "a,b,c" {
+		t.Fatalf("healthy order = %s", got)
+	}
+	tun.upstreams[0].failedAt.Store(now.Add(-time.Second).UnixNano())
+	tun.upstreams[1].failedAt.Store(now.Add(-2 * time.Second).UnixNano())
+	if got := names(); got != "c,b,a" {
+		t.Fatalf("order with a and b failed = %s, want c then the older failure first", got)
+	}
+	tun.upstreams[0].failedAt.Store(now.Add(-failoverHold - time.Second).UnixNano())
+	if got := names(); got != "a,c,b" {
+		t.Fatalf("order once a's hold expired = %s", got)
+	}
+}
+
+// TestConnectUpstream_FailoverBudget: an upstream that accepts TCP but never
+// finishes the handshake only gets its share of dialTimeout, leaving time
+// for the next one.
+func TestConnectUpstream_FailoverBudget(t *testing.T) {
+	old := dialTimeout
+	dialTimeout = 600 * time.Millisecond
+	t.Cleanup(func() { dialTimeout = old })
+
+	hung, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = hung.Close() }()
+	good := mustTestUpstream(t, nil)
+	tun := mustSetupTunnel(t, &tunnel{remote: hung.Addr().String() + "," + good.addr}, good.cert)
+
+	client, server := net.Pipe()
+	defer func() { _ = client.Close() }()
+	start := time.Now()
+	up, err := connectUpstream(t.Context(), server, tun)
+	if err != nil {
+		t.Fatalf("connectUpstream: %v", err)
+	}
+	defer func() { _ = up.Close() }()
+	if elapsed := time.Since(start); elapsed > dialTimeout {
+		t.Fatalf("took %v, over the %v budget", elapsed, dialTimeout)
+	}
+	go func() { _, _ = io.Copy(up, server) }()
+	if _, err := client.Write([]byte("x")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestConnectUpstream_AllUpstreamsFail(t *testing.T) {
+	a, b := closedAddr(t), closedAddr(t)
+	tun := mustSetupTunnel(t, &tunnel{remote: a + "," + b})
+
+	client, server := net.Pipe()
+	defer func() { _ = client.Close() }()
+	_, err := connectUpstream(t.Context(), server, tun)
+	if err == nil || !strings.HasPrefix(err.Error(), "all upstreams failed: "+a+": ") || !strings.Contains(err.Error(), "; "+b+": ") {
+		t.Fatalf("err=%v", err)
+	}
+	if _, werr := server.Write([]byte("x")); werr == nil {
+		t.Fatal("downstream left open after every upstream failed")
+	}
+}
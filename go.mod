@@ -1,3 +1,9 @@
 module github.com/lucasew/untls
 
-go 1.22.6
+go 1.24
+
+require (
+	github.com/youmark/pkcs8 v0.0.0-20240726163527-a2c0da244d78
+	golang.org/x/crypto v0.33.0
+	software.sslmate.com/src/go-pkcs12 v0.7.3
+)
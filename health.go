@@ -0,0 +1,208 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+// Health check kinds (-health-check). tcp only connects; tls completes the
+// handshake with the tunnel's own TLS settings, and can then send
+// -health-send and require the reply to start with -health-expect.
+const (
+	healthOff = "off"
+	healthTCP = "tcp"
+	healthTLS = "tls"
+)
+
+const (
+	defaultHealthInterval = 10 * time.Second
+	defaultHealthRise     = 2
+	defaultHealthFall     = 3
+)
+
+// healthCheck is how a tunnel probes its upstreams in the background. An
+// upstream is marked down after Fall failed checks in a row and up again
+// after Rise passed ones, so one lost probe does not flap it.
+type healthCheck struct {
+	Mode     string
+	Interval time.Duration
+	// Timeout bounds one check; 0 means the tunnel's -dial-timeout, the
+	// limit clients get.
+	Timeout time.Duration
+	Send    string
+	Expect  string
+	Rise    int
+	Fall    int
+}
+
+func (h healthCheck) enabled() bool {
+	return h.Mode == healthTCP || h.Mode == healthTLS
+}
+
+func (h healthCheck) validate() error {
+	switch h.Mode {
+	case "", healthOff:
+		return nil
+	case healthTCP, healthTLS:
+	default:
+		return fmt.Errorf("invalid -health-check %q: want %s, %s or %s", h.Mode, healthOff, healthTCP, healthTLS)
+	}
+	if h.Interval <= 0 {
+		return fmt.Errorf("invalid -health-interval %v: must be > 0", h.Interval)
+	}
+	if h.Timeout < 0 {
+		return fmt.Errorf("invalid -health-timeout %v: must be >= 0", h.Timeout)
+	}
+	if h.Rise < 1 || h.Fall < 1 {
+		return errors.New("-health-rise and -health-fall must be >= 1")
+	}
+	if (h.Send != "" || h.Expect != "") && h.Mode != healthTLS {
+		return errors.New("-health-send/-health-expect need -health-check tls")
+	}
+	return nil
+}
+
+// String is h for reload logs.
+func (h healthCheck) String() string {
+	if !h.enabled() {
+		return healthOff
+	}
+	s := fmt.Sprintf("%s every %v (rise %d, fall %d)", h.Mode, h.Interval, h.Rise, h.Fall)
+	if h.Timeout != 0 {
+		s += fmt.Sprintf(" timeout %v", h.Timeout)
+	}
+	if h.Send != "" {
+		s += fmt.Sprintf(" send %q", h.Send)
+	}
+	if h.Expect != "" {
+		s += fmt.Sprintf(" expect %q", h.Expect)
+	}
+	return s
+}
+
+// probe runs one check against u within the check's timeout. It does not
+// depend on the interval: a short interval must not fail a handshake that a
+// client's dial would have waited out. watch runs the checks one at a time,
+// so a hung upstream cannot stack them up either way.
+func (h healthCheck) probe(ctx context.Context, u *upstream) error {
+	timeout := h.Timeout
+	if timeout == 0 {
+		timeout = dialTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	if h.Mode == healthTCP {
+		c, err := (&net.Dialer{}).DialContext(ctx, "tcp", u.addr)
+		if err != nil {
+			return err
+		}
+		return c.Close()
+	}
+	// Soft -revocation warnings are left to the clients' dials to log.
+	c, _, err := u.dial(ctx, u.tls.Load())
+	if err != nil {
+		return err
+	}
+	defer func() { _ = c.Close() }()
+	if h.Send == "" && h.Expect == "" {
+		return nil
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = c.SetDeadline(deadline)
+	}
+	if h.Send != "" {
+		if _, err := io.WriteString(c, h.Send); err != nil {
+			return fmt.Errorf("send probe: %w", err)
+		}
+	}
+	if h.Expect != "" {
+		got := make([]byte, len(h.Expect))
+		n, err := io.ReadFull(c, got)
+		if string(got[:n]) != h.Expect[:n] {
+			return fmt.Errorf("reply %q, want %q", got[:n], h.Expect)
+		}
+		if err != nil {
+			return fmt.Errorf("read reply: %w", err)
+		}
+	}
+	return nil
+}
+
+// watch checks u every Interval until ctx is done, marking it down and up
+// with hysteresis. Only the transitions are logged.
+func (h healthCheck) watch(ctx context.Context, label string, u *upstream) {
+	passed, failed := 0, 0
+	tick := time.NewTicker(h.Interval)
+	defer tick.Stop()
+	for {
+		err := h.probe(ctx, u)
+		if ctx.Err() != nil {
+			return
+		}
+		if err == nil {
+			passed, failed = passed+1, 0
+			if passed >= h.Rise && u.down.CompareAndSwap(true, false) {
+				log.Printf("info: %supstream %s up after %d passed check(s)", label, u.addr, passed)
+			}
+		} else {
+			passed, failed = 0, failed+1
+			if failed >= h.Fall && u.down.CompareAndSwap(false, true) {
+				log.Printf("warning: %supstream %s down after %d failed check(s): %s", label, u.addr, failed, err)
+				u.pool.closeIdle()
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-tick.C:
+		}
+	}
+}
+
+// startHealthChecks watches each of t's upstreams until ctx is done or the
+// returned stop is called; stop waits for the probes to finish.
+func (t *tunnel) startHealthChecks(ctx context.Context) (stop func()) {
+	ctx, cancel := context.WithCancel(ctx)
+	var wg sync.WaitGroup
+	if t.health.enabled() {
+		label := t.logArea("health")
+		h := t.health
+		if h.Timeout == 0 {
+			h.Timeout = t.dialLimit()
+		}
+		for _, u := range t.upstreams {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				h.watch(ctx, label, u)
+			}()
+		}
+	}
+	return func() {
+		cancel()
+		wg.Wait()
+	}
+}
+
+// inheritState carries upstream state over from prev, the definition t
+// replaces on reload, for every address both list: a down upstream stays
+// down until it passes its checks again rather than until it fails them.
+func (t *tunnel) inheritState(prev *tunnel) {
+	for _, u := range t.upstreams {
+		for _, p := range prev.upstreams {
+			if p.addr == u.addr {
+				u.down.Store(p.down.Load() && t.health.enabled())
+				u.failedAt.Store(p.failedAt.Load())
+				if t.breaker.enabled() {
+					u.circuit.inherit(&p.circuit)
+				}
+			}
+		}
+	}
+}
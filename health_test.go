@@ -0,0 +1,240 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestHealthCheck_Validate(t *testing.T) {
+	ok := healthCheck{Mode: healthTLS, Interval: time.Second, Rise: 1, Fall: 1}
+	tests := []struct {
+		name string
+		edit func(h *healthCheck)
+		want string
+	}{
+		{name: "tls", edit: func(*healthCheck) {}},
+		{name: "off ignores the rest", edit: func(h *healthCheck) { *h = healthCheck{Mode: healthOff} }},
+		{name: "unset", edit: func(h *healthCheck) { *h = healthCheck{} }},
+		{name: "probe", edit: func(h *healthCheck) { h.Send, h.Expect = "PING\r\n", "+PONG" }},
+		{name: "mode", edit: func(h *healthCheck) { h.Mode = "http" }, want: `invalid -health-check "http"`},
+		{name: "interval", edit: func(h *healthCheck) { h.Interval = 0 }, want: "invalid -health-interval"},
+		{name: "timeout", edit: func(h *healthCheck) { h.Timeout = -time.Second }, want: "invalid -health-timeout"},
+		{name: "rise", edit: func(h *healthCheck) { h.Rise = 0 }, want: "-health-rise and -health-fall"},
+		{name: "fall", edit: func(h *healthCheck) { h.Fall = -1 }, want: "-health-rise and -health-fall"},
+		{name: "probe over tcp", edit: func(h *healthCheck) { h.Mode, h.Expect = healthTCP, "x" }, want: "need -health-check tls"},
+	}
+	for _, tt := range tests {
+		h := ok
+		tt.edit(&h)
+		err := h.validate()
+		if tt.want == "" && err != nil || tt.want != "" && (err == nil || !strings.Contains(err.Error(), tt.want)) {
+			t.Errorf("%s: err=%v, want %q", tt.name, err, tt.want)
+		}
+	}
+}
+
+func TestHealthCheck_Probe(t *testing.T) {
+	up := mustTestUpstream(t, nil)
+	other := mustTestUpstream(t, nil)
+	plain, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = plain.Close() }()
+	go func() {
+		for {
+			c, err := plain.Accept()
+			if err != nil {
+				return
+			}
+			_ = c.Close()
+		}
+	}()
+	echo := mustSetupTunnel(t, &tunnel{remote: up.addr}, up.cert).upstreams[0]
+	untrusted := mustSetupTunnel(t, &tunnel{remote: up.addr}, other.cert).upstreams[0]
+	dead := &upstream{addr: closedAddr(t)}
+
+	h := healthCheck{Interval: time.Second}
+	for _, tt := range []struct {
+		name         string
+		mode         string
+		send, expect string
+		u            *upstream
+		want         string
+	}{
+		{name: "tcp", mode: healthTCP, u: &upstream{addr: plain.Addr().String()}},
+		{name: "tcp refused", mode: healthTCP, u: dead, want: "refused"},
+		{name: "tls", mode: healthTLS, u: echo},
+		{name: "tls untrusted", mode: healthTLS, u: untrusted, want: "certificate"},
+		{name: "probe", mode: healthTLS, send: "PING\r\n", expect: "PING", u: echo},
+		{name: "probe mismatch", mode: healthTLS, send: "PING\r\n", expect: "PONG", u: echo, want: `reply "PING", want "PONG"`},
+	} {
+		h.Mode, h.Send, h.Expect = tt.mode, tt.send, tt.expect
+		err := h.probe(t.Context(), tt.u)
+		if tt.want == "" && err != nil || tt.want != "" && (err == nil || !strings.Contains(err.Error(), tt.want)) {
+			t.Errorf("%s: err=%v, want %q", tt.name, err, tt.want)
+		}
+	}
+}
+
+// TestHealthCheck_Probe_NoReply: a probe that gets no answer fails at its
+// timeout instead of hanging.
+func TestHealthCheck_Probe_NoReply(t *testing.T) {
+	up := mustTestUpstream(t, nil)
+	u := mustSetupTunnel(t, &tunnel{remote: up.addr}, up.cert).upstreams[0]
+	h := healthCheck{Mode: healthTLS, Interval: time.Hour, Timeout: 200 * time.Millisecond, Expect: "hello"}
+	start := time.Now()
+	if err := h.probe(t.Context(), u); err == nil || !strings.Contains(err.Error(), "timeout") {
+		t.Fatalf("err=%v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("probe took %v", elapsed)
+	}
+}
+
+// TestHealthCheck_Probe_ShortInterval: the interval does not cut a probe
+// short; a handshake that takes longer than it still passes.
+func TestHealthCheck_Probe_ShortInterval(t *testing.T) {
+	up := mustTestUpstream(t, nil)
+	u := mustSetupTunnel(t, &tunnel{remote: up.addr}, up.cert).upstreams[0]
+	h := healthCheck{Mode: healthTLS, Interval: time.Microsecond}
+	if err := h.probe(t.Context(), u); err != nil {
+		t.Fatalf("probe: %v", err)
+	}
+}
+
+func waitUntil(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting until %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// TestHealthCheck_Watch: an upstream goes down only after fall failed
+// checks and comes back only after rise passed ones; each transition is
+// logged once.
+func TestHealthCheck_Watch(t *testing.T) {
+	logs := captureLog(t)
+	var healthy atomic.Bool
+	healthy.Store(true)
+	up := mustTestUpstream(t, func(*tls.Conn) string {
+		if healthy.Load() {
+			return "ok"
+		}
+		return "no"
+	})
+	tun := mustSetupTunnel(t, &tunnel{name: "a", remote: up.addr}, up.cert)
+	tun.health = healthCheck{Mode: healthTLS, Interval: 50 * time.Millisecond, Expect: "ok", Rise: 3, Fall: 2}
+	u := tun.upstreams[0]
+	stop := tun.startHealthChecks(t.Context())
+	defer stop()
+
+	time.Sleep(200 * time.Millisecond)
+	if u.down.Load() {
+		t.Fatal("healthy upstream marked down")
+	}
+	healthy.Store(false)
+	waitUntil(t, "the upstream is down", u.down.Load)
+	healthy.Store(true)
+	waitUntil(t, "the upstream is up", func() bool { return !u.down.Load() })
+	stop()
+
+	out := logs()
+	for _, want := range []string{
+		fmt.Sprintf("warning: tunnel a: health: upstream %s down after 2 failed check(s): reply \"no\", want \"ok\"", u.addr),
+		fmt.Sprintf("info: tunnel a: health: upstream %s up after 3 passed check(s)", u.addr),
+	} {
+		if strings.Count(out, want) != 1 {
+			t.Errorf("log should have %q once:\n%s", want, out)
+		}
+	}
+}
+
+func TestDialOrder_SkipsDown(t *testing.T) {
+	tun := &tunnel{upstreams: []*upstream{{addr: "a"}, {addr: "b"}, {addr: "c"}}}
+	now := time.Now()
+	names := func() string {
+		var s []string
+		for _, u := range tun.dialOrder(now, nil) {
+			s = append(s, u.addr)
+		}
+		return strings.Join(s, ",")
+	}
+	tun.upstreams[0].down.Store(true)
+	tun.upstreams[1].failedAt.Store(now.UnixNano())
+	if got := names(); got != "c,b" {
+		t.Fatalf("order = %s, want a left out", got)
+	}
+	tun.upstreams[1].down.Store(true)
+	tun.upstreams[2].down.Store(true)
+	if got := names(); got != "a,b,c" {
+		t.Fatalf("order with every upstream down = %s, want all of them", got)
+	}
+}
+
+// TestTunnelSet_HealthSkipsDown: once the checks mark an upstream down,
+// clients go straight to the next one instead of paying for a failed dial.
+func TestTunnelSet_HealthSkipsDown(t *testing.T) {
+	logs := captureLog(t)
+	dead := closedAddr(t)
+	good := mustTestUpstream(t, says("good"))
+	set := startTunnelSet(t, mustReloadConfig(t, fmt.Sprintf(`{"tunnels": [
+  {"name": "a", "listen": "127.0.0.1:0", "remote": [%q, %q],
+   "health": {"check": "tcp", "interval": "10ms", "fall": 1},
+   "tls": {"ca-file": [%q], "no-system-ca": true}}
+]}`, dead, good.addr, good.caFile)))
+	set.mu.Lock()
+	tun := set.running["a"].t
+	set.mu.Unlock()
+	waitUntil(t, dead+" is down", tun.upstreams[0].down.Load)
+	if !strings.Contains(logs(), "warning: tunnel a: health: upstream "+dead+" down after 1 failed check(s)") {
+		t.Fatalf("no down line:\n%s", logs())
+	}
+
+	tun.upstreams[0].failedAt.Store(0)
+	before := logs()
+	if _, _, got := greet(t, set, "a"); got != "good" {
+		t.Fatalf("reached %s", got)
+	}
+	if after := strings.TrimPrefix(logs(), before); strings.Contains(after, "upstream "+dead+" failed") {
+		t.Fatalf("client dialled the down upstream:\n%s", after)
+	}
+}
+
+// TestTunnelSet_ReloadKeepsHealth: a reload that keeps an address keeps it
+// down until it passes its checks, and logs a health change.
+func TestTunnelSet_ReloadKeepsHealth(t *testing.T) {
+	logs := captureLog(t)
+	dead := closedAddr(t)
+	good := mustTestUpstream(t, says("good"))
+	body := func(interval string) string {
+		return fmt.Sprintf(`{"tunnels": [
+  {"name": "a", "listen": "127.0.0.1:0", "remote": [%q, %q],
+   "health": {"check": "tcp", "interval": %q, "fall": 1},
+   "tls": {"ca-file": [%q], "no-system-ca": true}}
+]}`, dead, good.addr, interval, good.caFile)
+	}
+	set := startTunnelSet(t, mustReloadConfig(t, body("10ms")))
+	set.mu.Lock()
+	rt := set.running["a"]
+	set.mu.Unlock()
+	waitUntil(t, dead+" is down", rt.t.upstreams[0].down.Load)
+
+	next := mustReloadConfig(t, body("1h"))
+	set.reload(next)
+	if cur := rt.t.current(); cur != next.tunnels[0] || !cur.upstreams[0].down.Load() || cur.upstreams[1].down.Load() {
+		t.Fatal("reload lost the upstreams' health")
+	}
+	if want := "info: reload: tunnel a: health tcp every 10ms (rise 2, fall 1) -> tcp every 1h0m0s (rise 2, fall 1)"; !strings.Contains(logs(), want) {
+		t.Fatalf("log lacks %q:\n%s", want, logs())
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// stdinFD is where inetd and systemd StandardInput=socket put the client.
+// Overridable in tests.
+var stdinFD = 0
+
+// passedConn returns the client when untls was started for a single,
+// already accepted connection, and nil otherwise:
+//
+//   - systemd Accept=yes: LISTEN_FDS=1 and FD 3 is a connected socket
+//     (a listening one is ordinary socket activation, see listenFDs);
+//   - inetd, xinetd or StandardInput=socket: stdin is a connected stream
+//     socket, or -inetd says it must be.
+//
+// source names the mode for logs. cfg is the loaded configuration.
+func passedConn(cfg *config) (c net.Conn, source string, err error) {
+	fd, source := stdinFD, "inetd"
+	switch {
+	case systemdActivated():
+		if os.Getenv("LISTEN_FDS") != "1" {
+			return nil, "", nil
+		}
+		fd, source = listenFdsStart, "systemd"
+	case !cfg.inetd:
+		if cfg.listens() || !connectedStream(fd) {
+			return nil, "", nil
+		}
+	case cfg.listenFlags:
+		return nil, source, errors.New("-inetd does not listen; drop -l/-listen")
+	}
+	stream, listening, err := socketKind(fd)
+	if err != nil || listening {
+		if source == "inetd" {
+			return nil, source, errors.New("-inetd: stdin is not a connected socket")
+		}
+		// A listener for the usual path.
+		return nil, "", nil
+	}
+	if source == "systemd" {
+		for _, v := range []string{"LISTEN_PID", "LISTEN_FDS", "LISTEN_FDNAMES"} {
+			_ = os.Unsetenv(v)
+		}
+	}
+	if !stream {
+		return nil, source, fmt.Errorf("%s passed a datagram socket; untls proxies streams", source)
+	}
+	f := os.NewFile(uintptr(fd), source)
+	c, err = net.FileConn(f)
+	_ = f.Close()
+	if err != nil {
+		return nil, source, fmt.Errorf("%s connection: %w", source, err)
+	}
+	return c, source, nil
+}
+
+// servePassedConn proxies the one client untls was started for through t
+// with the usual serveConn path, then returns so the process can exit.
+// SIGTERM ends the session. cfg is what t came from.
+func servePassedConn(c net.Conn, source string, cfg *config, t *tunnel) {
+	// inetd also hands the client socket over as stderr; log lines written
+	// there would end up inside the proxied stream. Any other socket there
+	// (journald's, under systemd) keeps the logs.
+	if sameSocket(c, 2) {
+		log.SetOutput(io.Discard)
+	}
+	if cfg.file != "" {
+		log.Printf("info: %s serves the passed connection; tunnel %s does not bind its listen %s", source, displayName(t), t.listen)
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	go func() {
+		<-ctx.Done()
+		_ = c.Close()
+	}()
+	log.Printf("%s: accepted from %s", t.connLabel(c.RemoteAddr()), source)
+	serveConn(ctx, c, t)
+}
@@ -0,0 +1,306 @@
+package main
+
+import (
+	"flag"
+	"io"
+	"net"
+	"os"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+// acceptedFile returns the server side of a fresh TCP connection as a file,
+// the way inetd or systemd Accept=yes would pass it, plus the client side.
+func acceptedFile(t *testing.T) (*os.File, net.Conn) {
+	t.Helper()
+	if runtime.GOOS == "windows" {
+		t.Skip("per-connection mode is Unix-only")
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = ln.Close() }()
+	client, err := net.DialTimeout("tcp", ln.Addr().String(), 2*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = client.Close() })
+	server, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = server.Close() }()
+	f, err := server.(*net.TCPConn).File()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return f, client
+}
+
+// proxyThroughPassedConn runs the per-connection path for client against a
+// TLS echo upstream and checks the bytes make the round trip.
+func proxyThroughPassedConn(t *testing.T, client net.Conn, wantSource string) {
+	t.Helper()
+	up := mustTestUpstream(t, nil)
+	tun := mustSetupTunnel(t, &tunnel{remote: up.addr}, up.cert)
+	proxyThroughPassedConnConfig(t, client, wantSource, &config{tunnels: []*tunnel{tun}})
+}
+
+// proxyThroughPassedConnConfig is proxyThroughPassedConn for a loaded cfg
+// whose single tunnel is already set up.
+func proxyThroughPassedConnConfig(t *testing.T, client net.Conn, wantSource string, cfg *config) {
+	t.Helper()
+	c, source, err := passedConn(cfg)
+	if err != nil || c == nil {
+		t.Fatalf("passedConn = %v, %q, %v", c, source, err)
+	}
+	if source != wantSource {
+		t.Fatalf("source = %q, want %q", source, wantSource)
+	}
+	tun, err := cfg.singleTunnel(source)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		servePassedConn(c, source, cfg, tun)
+		close(done)
+	}()
+	_ = client.SetDeadline(time.Now().Add(2 * time.Second))
+	if _, err := client.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	got := make([]byte, 5)
+	if _, err := io.ReadFull(client, got); err != nil || string(got) != "hello" {
+		t.Fatalf("echo = %q, %v", got, err)
+	}
+	_ = client.Close()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("servePassedConn did not return after the client left")
+	}
+}
+
+func TestPassedConn_Inetd(t *testing.T) {
+	t.Setenv("LISTEN_PID", "")
+	f, client := acceptedFile(t)
+	withStdinFD(t, f)
+	up := mustTestUpstream(t, nil)
+	tun := mustSetupTunnel(t, &tunnel{remote: up.addr}, up.cert)
+	proxyThroughPassedConnConfig(t, client, "inetd", &config{tunnels: []*tunnel{tun}, inetd: true})
+}
+
+// TestPassedConn_InetdDetected: a connected socket on stdin is served
+// without -inetd.
+func TestPassedConn_InetdDetected(t *testing.T) {
+	t.Setenv("LISTEN_PID", "")
+	f, client := acceptedFile(t)
+	withStdinFD(t, f)
+	proxyThroughPassedConn(t, client, "inetd")
+}
+
+func TestPassedConn_SystemdAcceptYes(t *testing.T) {
+	f, client := acceptedFile(t)
+	passSockets(t, "connection", f)
+	proxyThroughPassedConn(t, client, "systemd")
+	for _, v := range []string{"LISTEN_PID", "LISTEN_FDS", "LISTEN_FDNAMES"} {
+		if _, ok := os.LookupEnv(v); ok {
+			t.Errorf("%s still set", v)
+		}
+	}
+}
+
+// TestPassedConn_NotPassed: listeners, several systemd sockets, a stdin that
+// is not a connected socket, and a stdin socket next to -listen all leave the
+// normal accept path in charge.
+func TestPassedConn_NotPassed(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("per-connection mode is Unix-only")
+	}
+	check := func(t *testing.T, cfg *config) {
+		t.Helper()
+		c, _, err := passedConn(cfg)
+		if c != nil || err != nil {
+			t.Fatalf("passedConn = %v, %v; want nothing", c, err)
+		}
+	}
+	t.Run("stdin file", func(t *testing.T) {
+		t.Setenv("LISTEN_PID", "")
+		f, err := os.Open(os.DevNull)
+		if err != nil {
+			t.Fatal(err)
+		}
+		withStdinFD(t, f)
+		check(t, &config{})
+	})
+	t.Run("stdin listening socket", func(t *testing.T) {
+		t.Setenv("LISTEN_PID", "")
+		f, _ := listeningFile(t)
+		withStdinFD(t, f)
+		check(t, &config{})
+	})
+	t.Run("stdin socket with -listen", func(t *testing.T) {
+		t.Setenv("LISTEN_PID", "")
+		f, _ := acceptedFile(t)
+		withStdinFD(t, f)
+		check(t, &config{listenFlags: true})
+	})
+	t.Run("listening socket", func(t *testing.T) {
+		f, _ := listeningFile(t)
+		passSockets(t, "web", f)
+		check(t, &config{})
+		if os.Getenv("LISTEN_FDS") != "1" {
+			t.Fatal("LISTEN_FDS cleared for the listenFDs path")
+		}
+	})
+	t.Run("several sockets", func(t *testing.T) {
+		a, _ := acceptedFile(t)
+		b, _ := acceptedFile(t)
+		passSockets(t, "a:b", a, b)
+		check(t, &config{})
+	})
+}
+
+// TestPassedConn_StdinNotSocketListens: started from a shell, stdin is a
+// file, pipe or terminal. With only -t given, untls listens on its default
+// address rather than failing or serving stdin.
+func TestPassedConn_StdinNotSocketListens(t *testing.T) {
+	t.Setenv("LISTEN_PID", "")
+	var o options
+	fs := flag.NewFlagSet("untls", flag.ContinueOnError)
+	registerFlags(fs, &o)
+	if err := fs.Parse([]string{"-t", "a.example:443"}); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := loadConfig(fs, &o)
+	if err != nil {
+		t.Fatalf("loadConfig: %v", err)
+	}
+	if cfg.listens() {
+		t.Fatal("no -l/-listen, yet the config asks for listeners of its own")
+	}
+	want, err := listenAddress("", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdins := map[string]func(t *testing.T) *os.File{
+		"file": func(t *testing.T) *os.File {
+			f, err := os.Open(os.DevNull)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return f
+		},
+		"pipe": func(t *testing.T) *os.File {
+			r, w, err := os.Pipe()
+			if err != nil {
+				t.Fatal(err)
+			}
+			t.Cleanup(func() { _ = w.Close() })
+			return r
+		},
+	}
+	for name, open := range stdins {
+		t.Run(name, func(t *testing.T) {
+			withStdinFD(t, open(t))
+			if c, source, err := passedConn(cfg); c != nil || source != "" || err != nil {
+				t.Fatalf("passedConn = %v, %q, %v; want the listener", c, source, err)
+			}
+			if got := cfg.tunnels[0].listen; got != want {
+				t.Fatalf("listen = %q; want the default %q", got, want)
+			}
+		})
+	}
+}
+
+// TestPassedConn_Config: a -config file names a listen address for every
+// tunnel, so a connected stdin is only served with -inetd, and then the
+// listen address it does not bind is logged.
+func TestPassedConn_Config(t *testing.T) {
+	t.Setenv("LISTEN_PID", "")
+	logs := captureLog(t)
+	up := mustTestUpstream(t, nil)
+	load := func(t *testing.T, tunnels ...string) *config {
+		t.Helper()
+		var o options
+		fs := flag.NewFlagSet("untls", flag.ContinueOnError)
+		registerFlags(fs, &o)
+		if err := fs.Parse([]string{"-config", writeConfig(t, configJSON(tunnels...))}); err != nil {
+			t.Fatal(err)
+		}
+		cfg, err := loadConfig(fs, &o)
+		if err != nil {
+			t.Fatalf("loadConfig: %v", err)
+		}
+		if err := cfg.setupTunnels(); err != nil {
+			t.Fatalf("setupTunnels: %v", err)
+		}
+		return cfg
+	}
+	one := load(t, tunnelJSON("a", "127.0.0.1:0", up))
+	two := load(t, tunnelJSON("a", "127.0.0.1:0", up), tunnelJSON("b", "127.0.0.1:0", up))
+
+	for name, cfg := range map[string]*config{"one tunnel": one, "two tunnels": two} {
+		t.Run(name, func(t *testing.T) {
+			f, _ := acceptedFile(t)
+			withStdinFD(t, f)
+			if c, _, err := passedConn(cfg); c != nil || err != nil {
+				t.Fatalf("passedConn = %v, %v; want the listeners", c, err)
+			}
+		})
+	}
+
+	one.inetd = true
+	f, client := acceptedFile(t)
+	withStdinFD(t, f)
+	proxyThroughPassedConnConfig(t, client, "inetd", one)
+	if !strings.Contains(logs(), "info: inetd serves the passed connection; tunnel a does not bind its listen 127.0.0.1:0") {
+		t.Fatalf("unbound listen address not logged:\n%s", logs())
+	}
+	if _, err := two.singleTunnel("inetd per-connection mode"); err == nil || !strings.Contains(err.Error(), "needs a config with exactly one tunnel") {
+		t.Fatalf("two tunnels: err=%v", err)
+	}
+}
+
+// TestPassedConn_InetdErrors: with -inetd, a stdin that is not a connected
+// stream socket, or a listen flag, is an error rather than a silent fallback
+// to listening.
+func TestPassedConn_InetdErrors(t *testing.T) {
+	t.Setenv("LISTEN_PID", "")
+	f, err := os.Open(os.DevNull)
+	if err != nil {
+		t.Fatal(err)
+	}
+	withStdinFD(t, f)
+	if _, _, err := passedConn(&config{inetd: true}); err == nil || !strings.Contains(err.Error(), "stdin is not a connected socket") {
+		t.Fatalf("stdin is a file: err=%v", err)
+	}
+	if _, _, err := passedConn(&config{listenFlags: true, inetd: true}); err == nil || !strings.Contains(err.Error(), "drop -l/-listen") {
+		t.Fatalf("with -listen: err=%v", err)
+	}
+}
+
+func TestPassedConn_Datagram(t *testing.T) {
+	t.Setenv("LISTEN_PID", "")
+	if runtime.GOOS == "windows" {
+		t.Skip("per-connection mode is Unix-only")
+	}
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := pc.(*net.UDPConn).File()
+	_ = pc.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	withStdinFD(t, f)
+	if _, _, err := passedConn(&config{inetd: true}); err == nil || !strings.Contains(err.Error(), "datagram") {
+		t.Fatalf("err=%v", err)
+	}
+}
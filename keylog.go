@@ -0,0 +1,39 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sync"
+)
+
+// keyLogs shares one open key log per path across upstream configs, so
+// rebuilding a config does not reopen (or re-warn about) the same file.
+var (
+	keyLogsMu sync.Mutex
+	keyLogs   = map[string]*os.File{}
+)
+
+// openKeyLog opens path for appending NSS key log lines (the SSLKEYLOGFILE
+// format Wireshark reads) and restricts it to the owner. It warns loudly the
+// first time: whoever can read the file can decrypt the upstream traffic.
+func openKeyLog(path string) (io.Writer, error) {
+	keyLogsMu.Lock()
+	defer keyLogsMu.Unlock()
+	if f, ok := keyLogs[path]; ok {
+		return f, nil
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("open TLS key log: %w", err)
+	}
+	// OpenFile's mode only applies to new files; tighten an existing one.
+	if err := f.Chmod(0o600); err != nil {
+		_ = f.Close()
+		return nil, fmt.Errorf("restrict TLS key log %s: %w", path, err)
+	}
+	keyLogs[path] = f
+	log.Printf("WARNING: writing upstream TLS session keys to %s; anyone who can read it can decrypt the traffic. Debug use only.", path)
+	return f, nil
+}
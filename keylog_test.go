@@ -0,0 +1,88 @@
+package main
+
+import (
+	"bytes"
+	"crypto/x509"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+// TestConnectUpstream_KeyLog: an upstream handshake appends NSS key log
+// lines, an existing world-readable file is tightened to the owner, and the
+// startup warning is printed.
+func TestConnectUpstream_KeyLog(t *testing.T) {
+	leaf, key := mustCert(t, serverLeafTemplate("keylog"), nil, nil)
+	ln := mustServeTLS(t, []*x509.Certificate{leaf}, key, nil)
+	defer func() { _ = ln.Close() }()
+
+	path := filepath.Join(t.TempDir(), "keys.log")
+	if err := os.WriteFile(path, []byte("# earlier session\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		keyLogsMu.Lock()
+		defer keyLogsMu.Unlock()
+		if f, ok := keyLogs[path]; ok {
+			_ = f.Close()
+			delete(keyLogs, path)
+		}
+	})
+
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+
+	tun := &tunnel{remote: ln.Addr().String(), opts: tlsOptions{KeyLogFile: path}}
+	trustOnly(t, &tun.opts, leaf)
+	if err := tun.setup(); err != nil {
+		t.Fatalf("setup: %v", err)
+	}
+	// A second setup for the same file must not reopen or warn again.
+	if err := (&tunnel{remote: tun.remote, opts: tun.opts}).setup(); err != nil {
+		t.Fatalf("second setup: %v", err)
+	}
+
+	if n := strings.Count(buf.String(), "WARNING: writing upstream TLS session keys to "+path); n != 1 {
+		t.Fatalf("log=%q, want exactly one key log warning", buf.String())
+	}
+
+	client, server := net.Pipe()
+	defer func() { _ = client.Close() }()
+	upstream, err := connectUpstream(t.Context(), server, tun)
+	if err != nil {
+		t.Fatalf("connectUpstream: %v", err)
+	}
+	_ = upstream.Close()
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(string(data), "# earlier session\n") {
+		t.Fatalf("key log was truncated: %q", data)
+	}
+	if !strings.Contains(string(data), "CLIENT_HANDSHAKE_TRAFFIC_SECRET ") && !strings.Contains(string(data), "CLIENT_RANDOM ") {
+		t.Fatalf("no NSS key log lines written: %q", data)
+	}
+	if runtime.GOOS != "windows" {
+		fi, err := os.Stat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if perm := fi.Mode().Perm(); perm != 0o600 {
+			t.Fatalf("key log mode %o, want 600", perm)
+		}
+	}
+}
+
+func TestTunnel_KeyLogOpenError(t *testing.T) {
+	tun := &tunnel{remote: "up:443", opts: tlsOptions{KeyLogFile: filepath.Join(t.TempDir(), "missing-dir", "keys.log")}}
+	if err := tun.setup(); err == nil || !strings.Contains(err.Error(), "TLS key log") {
+		t.Fatalf("err=%v, want key log open error", err)
+	}
+}
@@ -1,9 +1,10 @@
 package main
 
 import (
+	"fmt"
 	"net"
-	"os"
 	"strconv"
+	"strings"
 )
 
 /**
@@ -37,35 +38,66 @@ func GetFreePort() (port int, err error) {
 }
 
 /**
- * CreateListener initializes a TCP listener, prioritizing systemd socket activation.
+ * CreateListener binds addr (see listenAddress): TCP host:port, or a Unix
+ * socket for "unix:<path>" (see listenUnix). Sockets passed by systemd do not
+ * come through here; see listenFDs.
  *
- * Logic:
- * - Checks if `LISTEN_PID` matches the current PID. If so, it assumes systemd passed
- *   the socket via file descriptor 3 (SD_LISTEN_FDS_START).
- * - If not running under systemd, it falls back to listening on `127.0.0.1:<port>`.
- *
- * @param {int} port - The fallback port to listen on if systemd is not detected.
+ * @param {string} addr - The host:port or unix:<path> to listen on.
  * @returns {net.Listener} - The initialized listener.
- * @returns {string} - A description of the listener source ("systemd" or "127.0.0.1:<port>").
+ * @returns {string} - A description of the listener source (addr).
  * @returns {error} - Error if listener creation fails.
  */
-const sdListenFdsStart = 3
-
-func CreateListener(port int) (net.Listener, string, error) {
-	if os.Getenv("LISTEN_PID") == strconv.Itoa(os.Getpid()) {
-		// systemd run
-		f := os.NewFile(sdListenFdsStart, "from systemd")
-		l, err := net.FileListener(f)
+func CreateListener(addr string) (net.Listener, string, error) {
+	if path, ok := strings.CutPrefix(addr, unixPrefix); ok {
+		l, err := listenUnix(path)
 		if err != nil {
-			return nil, "systemd", err
+			return nil, addr, err
 		}
-		return l, "systemd", nil
+		return l, addr, nil
 	}
-	// manual run
-	addr := net.JoinHostPort("127.0.0.1", strconv.Itoa(port))
 	l, err := net.Listen("tcp", addr)
 	if err != nil {
-		return nil, strconv.Itoa(port), err
+		return nil, addr, err
+	}
+	return l, addr, nil
+}
+
+// listenAddress resolves -listen and -l into the address CreateListener
+// binds. Without -listen it is 127.0.0.1:<-l>: the plain side stays private
+// to this machine unless the operator asks otherwise. -listen takes any
+// host:port Go can bind: "192.168.1.5:8080", "[::1]:8080", or ":8080" /
+// "[::]:8080" for all interfaces (dual-stack where the OS allows it), or
+// "unix:<path>" for a Unix socket.
+func listenAddress(listen string, port int) (string, error) {
+	if listen == "" {
+		return net.JoinHostPort("127.0.0.1", strconv.Itoa(port)), nil
+	}
+	if port != 0 {
+		return "", fmt.Errorf("-listen and -l cannot be combined; put the port in -listen")
+	}
+	if path, ok := strings.CutPrefix(listen, unixPrefix); ok {
+		if err := validateUnixPath(path); err != nil {
+			return "", err
+		}
+		return listen, nil
+	}
+	_, p, err := net.SplitHostPort(listen)
+	if err != nil {
+		return "", fmt.Errorf("invalid -listen address %q: want host:port", listen)
+	}
+	if n, err := strconv.Atoi(p); err != nil || n < 0 || n > 65535 {
+		return "", fmt.Errorf("invalid -listen address %q: port must be 0-65535 (0 = ephemeral)", listen)
+	}
+	return listen, nil
+}
+
+// exposedWarning returns a warning when addr is reachable from other
+// machines, or "" for loopback. The downstream side is plaintext, so anyone
+// who can reach the port can read and inject traffic to the upstream.
+func exposedWarning(addr net.Addr) string {
+	tcp, ok := addr.(*net.TCPAddr)
+	if !ok || tcp.IP.IsLoopback() {
+		return ""
 	}
-	return l, strconv.Itoa(port), nil
+	return fmt.Sprintf("warning: listening on non-loopback address %s; client traffic to untls is plaintext, so anyone who can reach it can read and use the tunnel", addr)
 }
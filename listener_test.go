@@ -1,14 +1,10 @@
 package main
 
 import (
-	"io"
 	"net"
-	"os"
-	"runtime"
 	"strconv"
-	"syscall"
+	"strings"
 	"testing"
-	"time"
 )
 
 func TestCreateListener_Manual(t *testing.T) {
@@ -19,14 +15,14 @@ func TestCreateListener_Manual(t *testing.T) {
 	// after the GetFreePort()+rebind race was removed from main. Avoid probing a
 	// free port then rebinding — that TOCTOU and can disagree on address family
 	// (GetFreePort uses localhost; CreateListener binds 127.0.0.1).
-	ln, source, err := CreateListener(0)
+	ln, source, err := CreateListener("127.0.0.1:0")
 	if err != nil {
-		t.Fatalf("CreateListener(0): %v", err)
+		t.Fatalf("CreateListener(127.0.0.1:0): %v", err)
 	}
 	defer func() { _ = ln.Close() }()
 
-	if source != "0" {
-		t.Errorf("expected source %q, got %q", "0", source)
+	if source != "127.0.0.1:0" {
+		t.Errorf("expected source %q, got %q", "127.0.0.1:0", source)
 	}
 	tcp, ok := ln.Addr().(*net.TCPAddr)
 	if !ok || tcp.Port <= 0 {
@@ -53,7 +49,7 @@ func TestCreateListener_ManualFixedPort(t *testing.T) {
 		port = seed.Addr().(*net.TCPAddr).Port
 		_ = seed.Close()
 
-		ln, source, err = CreateListener(port)
+		ln, source, err = CreateListener(net.JoinHostPort("127.0.0.1", strconv.Itoa(port)))
 		if err == nil {
 			break
 		}
@@ -63,108 +59,83 @@ func TestCreateListener_ManualFixedPort(t *testing.T) {
 	}
 	defer func() { _ = ln.Close() }()
 
-	if source != strconv.Itoa(port) {
-		t.Errorf("expected source %s, got %s", strconv.Itoa(port), source)
+	if want := net.JoinHostPort("127.0.0.1", strconv.Itoa(port)); source != want {
+		t.Errorf("expected source %s, got %s", want, source)
 	}
 	if tcp, ok := ln.Addr().(*net.TCPAddr); !ok || tcp.Port != port {
 		t.Fatalf("listener addr=%v, want port %d", ln.Addr(), port)
 	}
 }
 
-func TestCreateListener_Systemd(t *testing.T) {
-	if runtime.GOOS == "windows" {
-		t.Skip("systemd listen-FD activation is not used on windows")
-	}
-
-	// Install a real listening socket on FD 3 and set LISTEN_PID so CreateListener
-	// takes the socket-activation path. The previous test only checked the source
-	// string while wrapping whatever happened to be on FD 3 (often a non-socket),
-	// which never proved Accept works and risked NewFile taking ownership of an
-	// unrelated descriptor until GC.
-	seed, err := net.Listen("tcp", "127.0.0.1:0")
-	if err != nil {
-		t.Fatalf("seed listen: %v", err)
-	}
-	wantAddr := seed.Addr().String()
-
-	seedFile, err := seed.(*net.TCPListener).File()
-	if err != nil {
-		_ = seed.Close()
-		t.Fatalf("TCPListener.File: %v", err)
-	}
-	// File() duplicates the fd; close the Go listener so only seedFile holds the socket.
-	_ = seed.Close()
-
-	// Preserve the caller's FD 3 when present so we can restore after the test.
-	origFD, origErr := syscall.Dup(sdListenFdsStart)
-
-	if err := syscall.Dup2(int(seedFile.Fd()), sdListenFdsStart); err != nil {
-		_ = seedFile.Close()
-		if origErr == nil {
-			_ = syscall.Close(origFD)
-		}
-		t.Fatalf("Dup2 onto FD %d: %v", sdListenFdsStart, err)
-	}
-	// seedFile's fd is distinct from FD 3 after Dup2; drop the extra ref.
-	_ = seedFile.Close()
-
-	t.Cleanup(func() {
-		// Best-effort: close whatever CreateListener / this test left on FD 3,
-		// then restore the original descriptor if we saved one.
-		_ = syscall.Close(sdListenFdsStart)
-		if origErr == nil {
-			_ = syscall.Dup2(origFD, sdListenFdsStart)
-			_ = syscall.Close(origFD)
-		}
-	})
-
-	t.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()))
-
-	ln, source, err := CreateListener(12345)
+func TestCreateListener_IPv6Loopback(t *testing.T) {
+	t.Setenv("LISTEN_PID", "")
+	ln, _, err := CreateListener("[::1]:0")
 	if err != nil {
-		t.Fatalf("CreateListener (systemd path): %v", err)
+		t.Skipf("no IPv6 loopback here: %v", err)
 	}
 	defer func() { _ = ln.Close() }()
 
-	if source != "systemd" {
-		t.Fatalf("expected source %q, got %q", "systemd", source)
+	tcp, ok := ln.Addr().(*net.TCPAddr)
+	if !ok || tcp.IP.To4() != nil || !tcp.IP.IsLoopback() {
+		t.Fatalf("listener addr=%v, want [::1]", ln.Addr())
 	}
-	if got := ln.Addr().String(); got != wantAddr {
-		t.Fatalf("listener addr=%q, want seed addr %q", got, wantAddr)
+	if w := exposedWarning(ln.Addr()); w != "" {
+		t.Fatalf("loopback listener warned: %s", w)
 	}
+}
 
-	// Accept a real client through the activated FD to prove the listener is live.
-	errc := make(chan error, 1)
-	go func() {
-		c, derr := net.DialTimeout("tcp", wantAddr, 2*time.Second)
-		if derr != nil {
-			errc <- derr
-			return
-		}
-		defer func() { _ = c.Close() }()
-		_, werr := c.Write([]byte("ping"))
-		errc <- werr
-	}()
-
-	if tl, ok := ln.(*net.TCPListener); ok {
-		_ = tl.SetDeadline(time.Now().Add(2 * time.Second))
+func TestListenAddress(t *testing.T) {
+	tests := []struct {
+		name    string
+		listen  string
+		port    int
+		want    string
+		wantErr string
+	}{
+		{name: "default loopback", want: "127.0.0.1:0"},
+		{name: "port only", port: 8080, want: "127.0.0.1:8080"},
+		{name: "ipv4", listen: "192.168.1.5:8080", want: "192.168.1.5:8080"},
+		{name: "ipv6 loopback", listen: "[::1]:8080", want: "[::1]:8080"},
+		{name: "all interfaces", listen: ":8080", want: ":8080"},
+		{name: "all interfaces ipv6", listen: "[::]:0", want: "[::]:0"},
+		{name: "hostname", listen: "localhost:8080", want: "localhost:8080"},
+		{name: "both flags", listen: ":8080", port: 8080, wantErr: "cannot be combined"},
+		{name: "no port", listen: "127.0.0.1", wantErr: "want host:port"},
+		{name: "unbracketed ipv6", listen: "::1:8080", wantErr: "want host:port"},
+		{name: "bad port", listen: ":http", wantErr: "port must be"},
+		{name: "port too large", listen: ":65536", wantErr: "port must be"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := listenAddress(tt.listen, tt.port)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("err=%v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil || got != tt.want {
+				t.Fatalf("listenAddress(%q, %d) = %q, %v; want %q", tt.listen, tt.port, got, err, tt.want)
+			}
+		})
 	}
-	client, err := ln.Accept()
-	if err != nil {
-		t.Fatalf("Accept on systemd listener: %v", err)
-	}
-	defer func() { _ = client.Close() }()
+}
 
-	buf := make([]byte, 4)
-	_ = client.SetDeadline(time.Now().Add(2 * time.Second))
-	if _, err := io.ReadFull(client, buf); err != nil {
-		t.Fatalf("Read client payload: %v", err)
-	}
-	if string(buf) != "ping" {
-		t.Fatalf("payload=%q, want %q", buf, "ping")
-	}
-	if err := <-errc; err != nil {
-		t.Fatalf("dial/write side: %v", err)
+func TestExposedWarning(t *testing.T) {
+	tests := []struct {
+		addr net.Addr
+		warn bool
+	}{
+		{addr: &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 80}},
+		{addr: &net.TCPAddr{IP: net.IPv6loopback, Port: 80}},
+		{addr: &net.TCPAddr{IP: net.IPv4(192, 168, 1, 5), Port: 80}, warn: true},
+		{addr: &net.TCPAddr{IP: net.IPv6unspecified, Port: 80}, warn: true},
+		{addr: &net.TCPAddr{IP: net.IPv4zero, Port: 80}, warn: true},
+	}
+	for _, tt := range tests {
+		if got := exposedWarning(tt.addr); (got != "") != tt.warn {
+			t.Errorf("exposedWarning(%v) = %q, want warning=%v", tt.addr, got, tt.warn)
+		}
 	}
 }
 
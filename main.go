@@ -2,7 +2,7 @@ package main
 
 import (
 	"context"
-	"crypto/tls"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
@@ -11,59 +11,184 @@ import (
 	"os"
 	"os/signal"
 	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 )
 
-var localPort int
-var remote string
+// cmdline is what the process was started with; see options.
+var cmdline options
 
 func init() {
-	flag.IntVar(&localPort, "l", 0, "Raw TCP port to listen")
-	flag.StringVar(&remote, "t", "", "Which TCP socket, that can be a TLS socket, to proxy")
+	registerFlags(flag.CommandLine, &cmdline)
+}
+
+// registerFlags defines the command-line options on fs, bound to o.
+func registerFlags(fs *flag.FlagSet, o *options) {
+	fs.StringVar(&o.configFile, "config", "", "JSON config file with tunnels and settings, instead of the other flags")
+	fs.Var(&o.localPorts, "l", "Raw TCP port to listen (repeatable, paired with -t in order)")
+	fs.Var(&o.listenAddrs, "listen", "Plain TCP listen address as host:port, e.g. [::1]:8080 or :8080 for all interfaces, or unix:<path> (default: 127.0.0.1:<-l>; repeatable, paired with -t in order)")
+	fs.StringVar(&o.unixMode, "unix-mode", "", "Permission bits for a unix: -listen socket, in octal (e.g. 0660)")
+	fs.StringVar(&o.unixOwner, "unix-owner", "", "Owner of a unix: -listen socket: user, user:group or :group")
+	fs.Var(&o.remotes, "t", "Which TCP socket, that can be a TLS socket, to proxy (repeatable: one tunnel each)")
+	fs.StringVar(&o.balance, "balance", "", "How a -t list spreads clients: failover (default), round-robin, random, least-conn or hash (sticky per client IP); weigh entries with host:port=N")
+	fs.StringVar(&o.health.Mode, "health-check", healthOff, "Probe upstreams in the background and skip the down ones: off, tcp (connect) or tls (full handshake)")
+	fs.DurationVar(&o.health.Interval, "health-interval", defaultHealthInterval, "Time between health checks of each upstream")
+	fs.DurationVar(&o.health.Timeout, "health-timeout", 0, "Limit for one health check (default: -dial-timeout)")
+	fs.StringVar(&o.health.Send, "health-send", "", "Bytes a tls health check sends after the handshake")
+	fs.StringVar(&o.health.Expect, "health-expect", "", "Bytes a tls health check needs the upstream's reply to start with")
+	fs.IntVar(&o.health.Rise, "health-rise", defaultHealthRise, "Passed checks in a row that mark a down upstream up")
+	fs.IntVar(&o.health.Fall, "health-fall", defaultHealthFall, "Failed checks in a row that mark an upstream down")
+	fs.IntVar(&o.breaker.Failures, "breaker-failures", 0, "Failed dials in a row that open an upstream's circuit, rejecting clients at once instead of dialing it (0 disables)")
+	fs.DurationVar(&o.breaker.Cooldown, "breaker-cooldown", defaultBreakerCooldown, "How long an open circuit rejects clients before one is let through as a probe")
+	fs.StringVar(&o.breaker.Message, "breaker-message", "", "Bytes sent to a client rejected by an open circuit before closing it (default: just close)")
+	fs.IntVar(&o.pool.Size, "pool-size", 0, "Idle upstream connections kept handshaked per upstream, handed to new clients at once (0 disables)")
+	fs.DurationVar(&o.pool.MaxIdle, "pool-max-idle", defaultPoolMaxIdle, "Replace a pooled connection once it has been idle this long")
+	fs.BoolVar(&o.stdio, "stdio", false, "Proxy stdin/stdout to the single -t instead of listening (ssh ProxyCommand)")
+	fs.BoolVar(&o.inetd, "inetd", false, "Require a client passed as stdin (detected anyway when stdin is a connected socket and there is no -l, -listen or -config) and serve it through the single -t, then exit")
+	fs.Var(&o.tunnelNames, "name", "Tunnel name for log lines, paired with -t in order (default: the -t address when there are several)")
+	fs.Var((*stringList)(&o.tls.CAFiles), "ca-file", "PEM CA bundle trusted for the upstream (repeatable)")
+	fs.Var((*stringList)(&o.tls.CADirs), "ca-dir", "Directory of PEM CA files (*.pem, *.crt, *.cer) trusted for the upstream (repeatable)")
+	fs.BoolVar(&o.tls.NoSystemCAs, "no-system-ca", false, "Trust only -ca-file/-ca-dir instead of adding them to the system CA pool")
+	fs.DurationVar(&o.dialTimeout, "dial-timeout", defaultDialTimeout, "Limit for the upstream TCP connect plus TLS handshake")
+	fs.BoolVar(&o.logTimestamps, "log-timestamps", true, "Prefix log lines with date and time (disable under journald)")
+	fs.DurationVar(&o.certExpiryWarn, "cert-expiry-warn", defaultCertExpiryWarn, "Log a warning per connection when the upstream certificate expires within this window (0 disables)")
+	fs.IntVar(&o.sessionCacheSize, "session-cache-size", 64, "Upstream TLS sessions kept for resumption (0 disables resumption)")
+	fs.StringVar(&o.sessionCacheFile, "session-cache-file", "", "Persist resumable upstream TLS sessions here across restarts (holds secrets; owner-only)")
+	fs.StringVar(&o.tls.ClientCert, "client-cert", "", "PEM client certificate chain presented to the upstream (reloaded on SIGHUP)")
+	fs.StringVar(&o.tls.ClientKey, "client-key", "", "PEM private key for -client-cert (default: read it from -client-cert)")
+	fs.StringVar(&o.tls.ClientPKCS12, "client-pkcs12", "", "PKCS#12 bundle with client certificate, chain and key (reloaded on SIGHUP)")
+	fs.StringVar(&o.tls.ClientKeyPassFile, "client-key-pass-file", "", "File holding the passphrase for an encrypted client key or PKCS#12 bundle")
+	fs.StringVar(&o.tls.ServerName, "sni", "", "SNI server name sent to the upstream (default: host part of -t)")
+	fs.StringVar(&o.tls.VerifyName, "verify-name", "", "Name the upstream certificate must match (default: the SNI name)")
+	fs.Var((*stringList)(&o.tls.Pins), "pin", "Upstream pin: spki-sha256:<hash>, cert-sha256:<hash> or sha256/<base64> (repeatable; any match passes)")
+	fs.StringVar(&o.tls.PinMode, "pin-mode", pinModeSupplement, "supplement: pins on top of CA verification; replace: pins instead of it (self-signed upstreams)")
+	fs.StringVar(&o.tls.TOFUFile, "tofu-file", "", "Trust-on-first-use pin store: remember the upstream key on first contact and refuse a different one later")
+	fs.StringVar(&o.tls.Revocation, "revocation", revocationOff, "Upstream revocation checking: off, soft (fail only on revoked) or hard (also fail without current OCSP/CRL data)")
+	fs.Var((*stringList)(&o.tls.CRLFiles), "crl", "PEM or DER CRL file for -revocation (repeatable; reloaded on SIGHUP)")
+	fs.Var((*stringList)(&o.tls.ALPN), "alpn", "ALPN protocol offered to the upstream, in preference order (repeatable)")
+	fs.BoolVar(&o.tls.RequireALPN, "require-alpn", false, "Fail the connection when the upstream selects none of -alpn")
+	fs.StringVar(&o.tls.MinVersion, "tls-min", "", "Lowest TLS version accepted from the upstream: 1.0, 1.1, 1.2 or 1.3 (default: Go's)")
+	fs.StringVar(&o.tls.MaxVersion, "tls-max", "", "Highest TLS version offered to the upstream: 1.0, 1.1, 1.2 or 1.3")
+	fs.Var((*commaList)(&o.tls.CipherSuites), "ciphers", "Comma-separated TLS 1.2 cipher suites allowed, by IANA name (e.g. TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256)")
+	fs.Var((*commaList)(&o.tls.Curves), "curves", "Comma-separated key exchange curves in preference order: X25519, P-256, P-384, P-521")
+	fs.StringVar(&o.tls.KeyLogFile, "keylog-file", "", "Append upstream TLS session keys here for Wireshark (default: $SSLKEYLOGFILE; debug only)")
 }
 
 func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "pins":
+			os.Exit(pinsCommand(os.Args[2:], os.Stdout, os.Stderr))
+		case "check":
+			os.Exit(checkCommand(os.Args[2:], os.Stdout, os.Stderr))
+		}
+	}
 	flag.Parse()
-	if err := validateRemote(remote); err != nil {
+	cfg, err := loadConfig(flag.CommandLine, &cmdline)
+	if err != nil {
 		log.Fatal(err)
 	}
-	if err := validateLocalPort(localPort); err != nil {
+	if err := cfg.apply(); err != nil {
 		log.Fatal(err)
 	}
-
-	// localPort 0 → bind 127.0.0.1:0 and let the kernel pick a free port.
-	// Avoid GetFreePort()+rebind: that races and can also disagree on address
-	// family (localhost vs 127.0.0.1).
-	ln, source, err := CreateListener(localPort)
-	if err != nil {
-		log.Fatalf("failed to listen socket %s: %s", source, err)
+	tunnels := cfg.tunnels
+	if cmdline.stdio {
+		t, err := stdioTunnel(cfg)
+		if err != nil {
+			log.Fatal(err)
+		}
+		serveStdio(newStdioConn(os.Stdin, os.Stdout), t)
+		saveSessionCache()
+		return
+	}
+	if c, source, err := passedConn(cfg); err != nil {
+		log.Fatal(err)
+	} else if c != nil {
+		t, err := cfg.singleTunnel(source + " per-connection mode")
+		if err != nil {
+			log.Fatal(err)
+		}
+		servePassedConn(c, source, cfg, t)
+		saveSessionCache()
+		return
+	}
+	if systemdActivated() {
+		socks, err := listenFDs()
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := assignSystemdSockets(tunnels, socks); err != nil {
+			log.Fatal(err)
+		}
+		socketActivated = true
 	}
-	defer func() { _ = ln.Close() }()
-	log.Printf("info: listening on %s", listenLabel(ln, source))
 
 	// systemd (and interactive Ctrl-C) send SIGTERM/SIGINT. Catch them so we
-	// can close the listener, unblock Accept, and exit 0 instead of being
+	// can close the listeners, unblock Accept, and exit 0 instead of being
 	// SIGKILL'd after TimeoutStopSec with Accept still hanging.
 	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
 	defer stop()
+	// Catch SIGHUP before any listener is up, so one sent as soon as the
+	// socket answers or READY=1 arrives reloads instead of killing us.
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+	set := newTunnelSet(ctx, stop, cfg)
+	for _, t := range tunnels {
+		if err := set.start(t); err != nil {
+			log.Fatal(err)
+		}
+	}
+	// Type=notify units wait for READY=1; it is sent once every listener is up.
+	notify, err := newNotifier()
+	if err != nil {
+		log.Printf("error/notify: %s", err)
+	}
+	defer func() { _ = notify.Close() }()
+	status := func() string { return statusLine(len(set.runningNames()), activeConns.Load()) }
+	ready := status()
+	notify.notify("READY=1", "STATUS="+ready)
+	go notify.run(ctx, ready, status)
+	go reloadOnSIGHUP(ctx, set, hup)
+
+	// STOPPING=1 goes out as soon as shutdown starts (a signal, or an accept
+	// error cancelling ctx), not once the accept loops have wound down. It
+	// is waited for so it precedes the deferred Close and log.Fatalf below.
+	stopping := make(chan struct{})
 	go func() {
+		defer close(stopping)
 		<-ctx.Done()
 		log.Printf("info: shutting down")
-		_ = ln.Close()
+		notify.notify("STOPPING=1")
 	}()
-
-	if err := acceptLoop(ctx, ln, remote); err != nil {
+	err = set.wait()
+	<-stopping
+	saveSessionCache()
+	if err != nil {
 		log.Fatalf("accept loop: %s", err)
 	}
 }
 
+// saveSessionCache logs the session cache statistics and persists it to
+// -session-cache-file, if any.
+func saveSessionCache() {
+	if upstreamSessions == nil {
+		return
+	}
+	log.Printf("info: tls session cache %s", upstreamSessions.stats())
+	if err := upstreamSessions.save(); err != nil {
+		log.Printf("error/session-cache: %s", err)
+	}
+}
+
 // acceptLoop accepts clients until the listener is closed (normally because
 // ctx was cancelled and the shutdown goroutine closed ln). Temporary accept
 // failures are logged, backed off, and retried (same idea as net/http.Server);
 // permanent Accept errors return so main can exit instead of spinning the CPU.
-func acceptLoop(ctx context.Context, ln net.Listener, remote string) error {
+func acceptLoop(ctx context.Context, ln net.Listener, t *tunnel) error {
 	var tempDelay time.Duration
 	for {
 		downstream, err := ln.Accept()
@@ -85,7 +210,7 @@ func acceptLoop(ctx context.Context, ln net.Listener, remote string) error {
 				if max := time.Second; tempDelay > max {
 					tempDelay = max
 				}
-				log.Printf("error/accept: %s; retrying in %v", err, tempDelay)
+				log.Printf("%s: %s; retrying in %v", t.tag("error/accept"), err, tempDelay)
 				timer := time.NewTimer(tempDelay)
 				select {
 				case <-ctx.Done():
@@ -98,23 +223,30 @@ func acceptLoop(ctx context.Context, ln net.Listener, remote string) error {
 			return fmt.Errorf("accept: %w", err)
 		}
 		tempDelay = 0
-		log.Printf("conn/%s: accepted", downstream.RemoteAddr())
+		// A reload may have swapped the tunnel's remote or TLS settings;
+		// they apply from this connection on.
+		cur := t.current()
+		log.Printf("%s: accepted", cur.connLabel(downstream.RemoteAddr()))
 		// Dial and proxy off the accept loop so a slow or hung upstream
 		// cannot stall Accept for other clients. Pass ctx so SIGTERM
 		// aborts in-flight dials instead of waiting out dialTimeout.
-		go serveConn(ctx, downstream, remote)
+		go serveConn(ctx, downstream, cur)
 	}
 }
 
 // listenLabel is the human-readable bind description for startup logs.
-// Under systemd socket activation the source is "systemd"; otherwise use the
+// Under systemd socket activation the source is "systemd" or
+// "systemd:<FileDescriptorName>"; otherwise use the
 // listener's actual local address so port 0 shows the OS-assigned port.
 func listenLabel(ln net.Listener, source string) string {
-	if source == "systemd" {
+	if strings.HasPrefix(source, "systemd") {
 		return source
 	}
 	if ln != nil {
 		if a := ln.Addr(); a != nil {
+			if a.Network() == "unix" {
+				return unixPrefix + a.String()
+			}
 			return a.String()
 		}
 	}
@@ -124,42 +256,76 @@ func listenLabel(ln net.Listener, source string) string {
 // serveConn dials the upstream TLS endpoint and bridges the client.
 // Safe to call from a goroutine per accepted connection. parentCtx is
 // typically the process shutdown context so dials abort on SIGTERM.
-func serveConn(parentCtx context.Context, downstream net.Conn, remote string) {
-	addr := downstream.RemoteAddr()
-	upstream, err := connectUpstream(parentCtx, downstream, remote)
+func serveConn(parentCtx context.Context, downstream net.Conn, t *tunnel) {
+	label := t.connLabel(downstream.RemoteAddr())
+	upstream, u, err := connectPicked(parentCtx, downstream, t)
 	if err != nil {
 		// connectUpstream already closed downstream.
-		log.Printf("conn/%s: %s", addr, err)
+		log.Printf("%s: %s", label, err)
 		return
 	}
-	handleConn(downstream, upstream)
+	activeConns.Add(1)
+	defer activeConns.Add(-1)
+	u.active.Add(1)
+	defer u.active.Add(-1)
+	handleConn(label, downstream, upstream)
 }
 
+// activeConns counts proxied sessions for the sd_notify STATUS= line.
+var activeConns atomic.Int64
+
 // dialTimeout bounds the whole upstream TCP+TLS handshake. Without a
 // deadline, a blackholed or stuck peer leaves a goroutine and the client
 // half-open forever (the accept loop is already off the hot path).
 // Overridable in tests. Also cancelled early if parentCtx is done
-// (process shutdown).
-var dialTimeout = 10 * time.Second
-
-// connectUpstream dials remote over TLS for a newly accepted client.
-// parentCtx is combined with dialTimeout so either the wall-clock
-// timeout or process shutdown ends the dial. On dial failure it closes
-// downstream so the accept loop can continue without leaking the client
-// socket or exiting the process.
-func connectUpstream(parentCtx context.Context, downstream net.Conn, remote string) (net.Conn, error) {
+// (process shutdown). A tunnel from the config carries its own
+// -dial-timeout instead (see tunnel.dialLimit).
+var dialTimeout = defaultDialTimeout
+
+const defaultDialTimeout = 10 * time.Second
+
+// connectUpstream dials the tunnel's upstreams over TLS for a newly accepted
+// client, in -balance order with failover (see dialUpstream). parentCtx is
+// combined with dialTimeout so either the wall-clock timeout or process
+// shutdown ends the dial. On dial failure it closes downstream so the accept
+// loop can continue without leaking the client socket or exiting the process.
+func connectUpstream(parentCtx context.Context, downstream net.Conn, t *tunnel) (net.Conn, error) {
+	upstream, _, err := connectPicked(parentCtx, downstream, t)
+	if err != nil {
+		return nil, err
+	}
+	return upstream, nil
+}
+
+// connectPicked is connectUpstream that also reports which upstream
+// answered, so serveConn can count the session for -balance least-conn.
+func connectPicked(parentCtx context.Context, downstream net.Conn, t *tunnel) (upstreamConn, *upstream, error) {
 	if parentCtx == nil {
 		parentCtx = context.Background()
 	}
-	ctx, cancel := context.WithTimeout(parentCtx, dialTimeout)
+	ctx, cancel := context.WithTimeout(parentCtx, t.dialLimit())
 	defer cancel()
 
-	upstream, err := (&tls.Dialer{Config: &tls.Config{}}).DialContext(ctx, "tcp", remote)
+	label := t.connLabel(downstream.RemoteAddr())
+	upstream, u, err := dialUpstream(ctx, downstream.RemoteAddr(), label, t)
 	if err != nil {
+		if errors.Is(err, errCircuitOpen) {
+			rejectClient(t.breaker, downstream)
+		}
 		_ = downstream.Close()
-		return nil, err
+		return nil, nil, err
 	}
-	return upstream, nil
+	if _, ok := upstream.(*pooledConn); ok {
+		log.Printf("%s: upstream %s (pooled)", label, u.addr)
+	} else if len(t.upstreams) > 1 {
+		log.Printf("%s: upstream %s", label, u.addr)
+	}
+	cs := upstream.ConnectionState()
+	if upstreamSessions != nil {
+		upstreamSessions.observe(cs)
+	}
+	logTLSDetails(label, cs, t.certExpiryWarn)
+	return upstream, u, nil
 }
 
 // validateRemote checks that -t is a non-empty host:port suitable for tls.Dial.
@@ -220,13 +386,15 @@ var bufferPool = sync.Pool{
  * It uses sync.Once to ensure that connection cleanup (closing both sockets) happens exactly once,
  * preventing double-close errors or resource leaks. When either direction finishes (EOF or error),
  * both connections are closed.
+ *
+ * label is the connection's log prefix (see tunnel.connLabel).
  */
-func handleConn(downstream, upstream net.Conn) {
+func handleConn(label string, downstream, upstream net.Conn) {
 	var once sync.Once
 	closeConnections := func() {
 		_ = downstream.Close()
 		_ = upstream.Close()
-		log.Printf("conn/%s: disconnected %v", downstream.RemoteAddr(), upstream.RemoteAddr())
+		log.Printf("%s: disconnected %v", label, upstream.RemoteAddr())
 	}
 
 	cp := func(dst net.Conn, src net.Conn) {
@@ -237,7 +405,7 @@ func handleConn(downstream, upstream net.Conn) {
 		_, err := io.CopyBuffer(dst, src, buf)
 		once.Do(func() {
 			if err != nil {
-				log.Printf("conn/%s: %v", downstream.RemoteAddr(), err)
+				log.Printf("%s: %v", label, err)
 			}
 			closeConnections()
 		})
@@ -20,7 +20,7 @@ func TestAcceptLoop_StopsOnCancel(t *testing.T) {
 	done := make(chan error, 1)
 	go func() {
 		// Upstream never used: we stop before accepting a client.
-		done <- acceptLoop(ctx, ln, "127.0.0.1:1")
+		done <- acceptLoop(ctx, ln, testTunnel("127.0.0.1:1"))
 	}()
 
 	// Let Accept block, then mirror the production shutdown sequence:
@@ -56,7 +56,7 @@ func TestAcceptLoop_PermanentAcceptError(t *testing.T) {
 	ctx := t.Context()
 	done := make(chan error, 1)
 	go func() {
-		done <- acceptLoop(ctx, ln, "127.0.0.1:1")
+		done <- acceptLoop(ctx, ln, testTunnel("127.0.0.1:1"))
 	}()
 
 	time.Sleep(50 * time.Millisecond)
@@ -92,7 +92,7 @@ func TestAcceptLoop_AcceptsThenStops(t *testing.T) {
 	defer cancel()
 	done := make(chan error, 1)
 	go func() {
-		done <- acceptLoop(ctx, ln, remote)
+		done <- acceptLoop(ctx, ln, testTunnel(remote))
 	}()
 
 	conn, err := net.Dial("tcp", ln.Addr().String())
@@ -130,7 +130,7 @@ func TestConnectUpstream_DialFailClosesDownstream(t *testing.T) {
 	addr := ln.Addr().String()
 	_ = ln.Close()
 
-	_, err = connectUpstream(t.Context(), server, addr)
+	_, err = connectUpstream(t.Context(), server, testTunnel(addr))
 	if err == nil {
 		t.Fatal("expected dial error for closed upstream port")
 	}
@@ -160,7 +160,7 @@ func TestConnectUpstream_DialTimeout(t *testing.T) {
 	defer func() { _ = client.Close() }()
 
 	start := time.Now()
-	_, err = connectUpstream(t.Context(), server, ln.Addr().String())
+	_, err = connectUpstream(t.Context(), server, testTunnel(ln.Addr().String()))
 	elapsed := time.Since(start)
 	if err == nil {
 		t.Fatal("expected timeout error for hung TLS handshake")
@@ -199,7 +199,7 @@ func TestConnectUpstream_ParentCancel(t *testing.T) {
 	time.AfterFunc(50*time.Millisecond, cancel)
 
 	start := time.Now()
-	_, err = connectUpstream(parent, server, ln.Addr().String())
+	_, err = connectUpstream(parent, server, testTunnel(ln.Addr().String()))
 	elapsed := time.Since(start)
 	if err == nil {
 		t.Fatal("expected error after parent cancel")
@@ -230,7 +230,7 @@ func TestServeConn_DialFailClosesDownstream(t *testing.T) {
 	// close the client side (same ownership rules as connectUpstream).
 	done := make(chan struct{})
 	go func() {
-		serveConn(t.Context(), server, addr)
+		serveConn(t.Context(), server, testTunnel(addr))
 		close(done)
 	}()
 
@@ -305,16 +305,16 @@ func TestListenLabel(t *testing.T) {
 		t.Fatalf("systemd: got %q", got)
 	}
 
-	// Port 0 must surface the OS-assigned port, not the "0" source string.
+	// Port 0 must surface the OS-assigned port, not the requested ":0" address.
 	t.Setenv("LISTEN_PID", "")
-	ln, source, err := CreateListener(0)
+	ln, source, err := CreateListener("127.0.0.1:0")
 	if err != nil {
-		t.Fatalf("CreateListener(0): %v", err)
+		t.Fatalf("CreateListener(127.0.0.1:0): %v", err)
 	}
 	defer func() { _ = ln.Close() }()
 
-	if source != "0" {
-		t.Fatalf("source = %q, want \"0\"", source)
+	if source != "127.0.0.1:0" {
+		t.Fatalf("source = %q, want \"127.0.0.1:0\"", source)
 	}
 	tcp, ok := ln.Addr().(*net.TCPAddr)
 	if !ok || tcp.Port == 0 {
@@ -324,7 +324,7 @@ func TestListenLabel(t *testing.T) {
 	if got != ln.Addr().String() {
 		t.Fatalf("listenLabel = %q, want %q", got, ln.Addr().String())
 	}
-	if got == "0" || got == source {
+	if got == source {
 		t.Fatalf("listenLabel must not report unbound source %q", got)
 	}
 }
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"strings"
+)
+
+// Pin modes for -pin-mode.
+const (
+	// pinModeSupplement requires a normal verified chain and additionally
+	// one pinned certificate or key somewhere in it.
+	pinModeSupplement = "supplement"
+	// pinModeReplace skips chain verification; the leaf alone must match a
+	// pin. This is the self-signed upstream case.
+	pinModeReplace = "replace"
+)
+
+// pinKind says which bytes a pin hashes.
+type pinKind string
+
+const (
+	pinSPKI pinKind = "spki-sha256" // SubjectPublicKeyInfo: survives re-issuing with the same key
+	pinCert pinKind = "cert-sha256" // whole DER certificate
+)
+
+type pin struct {
+	kind pinKind
+	hash [sha256.Size]byte
+}
+
+func (p pin) String() string {
+	return string(p.kind) + ":" + hex.EncodeToString(p.hash[:])
+}
+
+func (p pin) matches(c *x509.Certificate) bool {
+	return p.hash == certHash(p.kind, c)
+}
+
+func certHash(kind pinKind, c *x509.Certificate) [sha256.Size]byte {
+	if kind == pinSPKI {
+		return sha256.Sum256(c.RawSubjectPublicKeyInfo)
+	}
+	return sha256.Sum256(c.Raw)
+}
+
+// parsePin accepts "spki-sha256:<hash>", "cert-sha256:<hash>" and the HPKP
+// form "sha256/<base64>" (an SPKI pin). The hash may be hex, with or without
+// colons as printed by openssl, or standard base64.
+func parsePin(s string) (pin, error) {
+	var p pin
+	var value string
+	switch {
+	case strings.HasPrefix(s, string(pinSPKI)+":"):
+		p.kind, value = pinSPKI, strings.TrimPrefix(s, string(pinSPKI)+":")
+	case strings.HasPrefix(s, string(pinCert)+":"):
+		p.kind, value = pinCert, strings.TrimPrefix(s, string(pinCert)+":")
+	case strings.HasPrefix(s, "sha256/"):
+		p.kind, value = pinSPKI, strings.TrimPrefix(s, "sha256/")
+	default:
+		return p, fmt.Errorf("invalid -pin %q: want spki-sha256:<hash>, cert-sha256:<hash> or sha256/<base64>", s)
+	}
+	raw, err := hex.DecodeString(strings.ReplaceAll(value, ":", ""))
+	if err != nil || len(raw) != sha256.Size {
+		raw, err = base64.StdEncoding.DecodeString(value)
+	}
+	if err != nil || len(raw) != sha256.Size {
+		return p, fmt.Errorf("invalid -pin %q: hash must be 32 bytes of hex or base64", s)
+	}
+	copy(p.hash[:], raw)
+	return p, nil
+}
+
+// pinMismatchError is returned from the handshake when no pin matches. It
+// lists what the upstream actually presented so the operator can decide
+// whether to add it as a new pin.
+type pinMismatchError struct {
+	leaf *x509.Certificate
+}
+
+func (e *pinMismatchError) Error() string {
+	return fmt.Sprintf("pin mismatch: upstream presented %s %s (subject %q), which matches no -pin",
+		pin{kind: pinSPKI, hash: certHash(pinSPKI, e.leaf)},
+		pin{kind: pinCert, hash: certHash(pinCert, e.leaf)},
+		e.leaf.Subject.String())
+}
+
+// checkPins succeeds when any pin matches the leaf or, in supplement mode,
+// any certificate of a verified chain. In replace mode only the leaf counts:
+// the rest of an unverified chain is attacker-controlled.
+func checkPins(pins []pin, leaf *x509.Certificate, chains [][]*x509.Certificate) error {
+	for _, p := range pins {
+		if p.matches(leaf) {
+			return nil
+		}
+		for _, chain := range chains {
+			for _, c := range chain {
+				if p.matches(c) {
+					return nil
+				}
+			}
+		}
+	}
+	return &pinMismatchError{leaf: leaf}
+}
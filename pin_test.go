@@ -0,0 +1,175 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParsePin(t *testing.T) {
+	sum := sha256.Sum256([]byte("key"))
+	hexSum := hex.EncodeToString(sum[:])
+	var colonSum []string
+	for _, b := range sum {
+		colonSum = append(colonSum, strings.ToUpper(hex.EncodeToString([]byte{b})))
+	}
+	b64Sum := base64.StdEncoding.EncodeToString(sum[:])
+
+	tests := []struct {
+		name     string
+		in       string
+		wantKind pinKind
+		wantErr  bool
+	}{
+		{name: "spki hex", in: "spki-sha256:" + hexSum, wantKind: pinSPKI},
+		{name: "cert hex", in: "cert-sha256:" + hexSum, wantKind: pinCert},
+		{name: "openssl colons", in: "cert-sha256:" + strings.Join(colonSum, ":"), wantKind: pinCert},
+		{name: "spki base64", in: "spki-sha256:" + b64Sum, wantKind: pinSPKI},
+		{name: "hpkp form", in: "sha256/" + b64Sum, wantKind: pinSPKI},
+		{name: "no prefix", in: hexSum, wantErr: true},
+		{name: "unknown prefix", in: "sha1:" + hexSum, wantErr: true},
+		{name: "short hash", in: "spki-sha256:" + hexSum[:62], wantErr: true},
+		{name: "long hash", in: "spki-sha256:" + hexSum + "00", wantErr: true},
+		{name: "not hex or base64", in: "spki-sha256:zz", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, err := parsePin(tt.in)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parsePin(%q) err=%v wantErr=%v", tt.in, err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if p.kind != tt.wantKind || p.hash != sum {
+				t.Fatalf("parsePin(%q) = %s, want %s:%s", tt.in, p, tt.wantKind, hexSum)
+			}
+		})
+	}
+}
+
+// TestConnectUpstream_Pins covers both modes against a CA-issued upstream:
+// replace ignores the (untrusted) chain and looks at the leaf only, while
+// supplement needs a verified chain and accepts a pin anywhere in it.
+func TestConnectUpstream_Pins(t *testing.T) {
+	ca := mustCA(t, "pin-ca", nil)
+	leaf, key := ca.issue(t, serverLeafTemplate("pinned"))
+	ln := mustServeTLS(t, []*x509.Certificate{leaf, ca.cert}, key, nil)
+	defer func() { _ = ln.Close() }()
+	_, other := mustSelfSignedTLSListener(t)
+
+	spki := func(c *x509.Certificate) string { return pin{kind: pinSPKI, hash: certHash(pinSPKI, c)}.String() }
+	certPin := func(c *x509.Certificate) string { return pin{kind: pinCert, hash: certHash(pinCert, c)}.String() }
+
+	tests := []struct {
+		name         string
+		opts         tlsOptions
+		trustCA      bool
+		wantErr      bool
+		wantMismatch bool
+	}{
+		{name: "replace spki", opts: tlsOptions{PinMode: pinModeReplace, Pins: []string{spki(leaf)}}},
+		{name: "replace cert", opts: tlsOptions{PinMode: pinModeReplace, Pins: []string{certPin(leaf)}}},
+		{name: "replace rotation overlap", opts: tlsOptions{PinMode: pinModeReplace, Pins: []string{spki(other), spki(leaf)}}},
+		{name: "replace wrong pin", opts: tlsOptions{PinMode: pinModeReplace, Pins: []string{spki(other)}}, wantErr: true, wantMismatch: true},
+		{name: "replace ignores ca pin", opts: tlsOptions{PinMode: pinModeReplace, Pins: []string{spki(ca.cert)}}, wantErr: true, wantMismatch: true},
+		{name: "supplement needs chain", opts: tlsOptions{Pins: []string{spki(leaf)}}, wantErr: true},
+		{name: "supplement leaf", opts: tlsOptions{Pins: []string{spki(leaf)}}, trustCA: true},
+		{name: "supplement ca", opts: tlsOptions{Pins: []string{spki(ca.cert)}}, trustCA: true},
+		{name: "supplement wrong pin", opts: tlsOptions{Pins: []string{certPin(other)}}, trustCA: true, wantErr: true, wantMismatch: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := tt.opts
+			if tt.trustCA {
+				trustOnly(t, &opts, ca.cert)
+			}
+			cfg, err := opts.clientConfig("")
+			if err != nil {
+				t.Fatalf("clientConfig: %v", err)
+			}
+			withUpstreamTLS(t, cfg)
+
+			client, server := net.Pipe()
+			defer func() { _ = client.Close() }()
+			upstream, err := connectUpstream(t.Context(), server, testTunnel(ln.Addr().String()))
+			if err == nil {
+				_ = upstream.Close()
+			}
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("connectUpstream err=%v wantErr=%v", err, tt.wantErr)
+			}
+			var pe *pinMismatchError
+			if got := errors.As(err, &pe); got != tt.wantMismatch {
+				t.Fatalf("pin mismatch error=%v, want %v (err=%v)", got, tt.wantMismatch, err)
+			}
+			if tt.wantMismatch && !strings.Contains(err.Error(), spki(leaf)) {
+				t.Fatalf("mismatch error should name the presented key: %v", err)
+			}
+		})
+	}
+}
+
+// TestServeConn_LogsPinMismatch: the operator sees the mismatch, with the
+// presented fingerprint, on the client's conn/<addr>: line.
+func TestServeConn_LogsPinMismatch(t *testing.T) {
+	up := mustTestUpstream(t, nil)
+	other := mustTestUpstream(t, nil)
+	opts := tlsOptions{PinMode: pinModeReplace, Pins: []string{pin{kind: pinSPKI, hash: certHash(pinSPKI, other.cert)}.String()}}
+	cfg, err := opts.clientConfig("")
+	if err != nil {
+		t.Fatalf("clientConfig: %v", err)
+	}
+	withUpstreamTLS(t, cfg)
+
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+
+	client, server := net.Pipe()
+	defer func() { _ = client.Close() }()
+	done := make(chan struct{})
+	go func() {
+		serveConn(t.Context(), server, testTunnel(up.addr))
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("serveConn did not return after pin mismatch")
+	}
+	if got := buf.String(); !strings.Contains(got, "conn/pipe: pin mismatch: upstream presented spki-sha256:") {
+		t.Fatalf("log=%q, want a conn/pipe: pin mismatch line", got)
+	}
+}
+
+func TestTLSOptions_PinValidation(t *testing.T) {
+	good := "spki-sha256:" + strings.Repeat("ab", 32)
+	tests := []struct {
+		name    string
+		opts    tlsOptions
+		wantSub string
+	}{
+		{name: "bad mode", opts: tlsOptions{PinMode: "strict"}, wantSub: "-pin-mode"},
+		{name: "replace without pins", opts: tlsOptions{PinMode: pinModeReplace}, wantSub: "at least one -pin"},
+		{name: "replace with verify name", opts: tlsOptions{PinMode: pinModeReplace, Pins: []string{good}, VerifyName: "example.com"}, wantSub: "-verify-name"},
+		{name: "bad pin", opts: tlsOptions{Pins: []string{"md5:00"}}, wantSub: "invalid -pin"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := tt.opts.clientConfig("")
+			if err == nil || !strings.Contains(err.Error(), tt.wantSub) {
+				t.Fatalf("err=%v, want it to mention %q", err, tt.wantSub)
+			}
+		})
+	}
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"strings"
+)
+
+// commaList is a string flag holding a comma-separated list, repeatable
+// (-ciphers A,B -ciphers C).
+type commaList []string
+
+func (c *commaList) String() string {
+	if c == nil {
+		return ""
+	}
+	return strings.Join(*c, ",")
+}
+
+func (c *commaList) Set(v string) error {
+	for _, item := range strings.Split(v, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			*c = append(*c, item)
+		}
+	}
+	return nil
+}
+
+// tlsVersions maps the accepted -tls-min/-tls-max spellings.
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// parseTLSVersion accepts "1.2", "TLS1.2" and "tls12" style names. Empty
+// means "no limit" (0), which keeps crypto/tls's defaults.
+func parseTLSVersion(flagName, s string) (uint16, error) {
+	if s == "" {
+		return 0, nil
+	}
+	v := strings.ToLower(s)
+	v = strings.TrimPrefix(v, "tls")
+	v = strings.TrimPrefix(v, "v")
+	if len(v) == 2 && v[0] == '1' {
+		v = v[:1] + "." + v[1:]
+	}
+	if id, ok := tlsVersions[v]; ok {
+		return id, nil
+	}
+	return 0, fmt.Errorf("invalid %s %q: want 1.0, 1.1, 1.2 or 1.3", flagName, s)
+}
+
+// parseCipherSuites resolves IANA names (as printed by tls.CipherSuiteName)
+// case-insensitively. TLS 1.3 suites are rejected because crypto/tls does not
+// let them be configured, and silently ignoring them would mislead.
+func parseCipherSuites(names []string) ([]uint16, error) {
+	if len(names) == 0 {
+		return nil, nil
+	}
+	known := map[string]*tls.CipherSuite{}
+	for _, cs := range append(tls.CipherSuites(), tls.InsecureCipherSuites()...) {
+		known[strings.ToUpper(cs.Name)] = cs
+	}
+	ids := make([]uint16, 0, len(names))
+	for _, name := range names {
+		cs, ok := known[strings.ToUpper(name)]
+		if !ok {
+			return nil, fmt.Errorf("invalid -ciphers entry %q: unknown cipher suite", name)
+		}
+		if len(cs.SupportedVersions) == 1 && cs.SupportedVersions[0] == tls.VersionTLS13 {
+			return nil, fmt.Errorf("invalid -ciphers entry %q: TLS 1.3 suites are not configurable", name)
+		}
+		ids = append(ids, cs.ID)
+	}
+	return ids, nil
+}
+
+// curveNames maps the accepted -curves spellings. Names follow the usual
+// OpenSSL/RFC forms rather than Go's CurveP256 constants.
+var curveNames = map[string]tls.CurveID{
+	"x25519":     tls.X25519,
+	"p-256":      tls.CurveP256,
+	"p256":       tls.CurveP256,
+	"secp256r1":  tls.CurveP256,
+	"prime256v1": tls.CurveP256,
+	"p-384":      tls.CurveP384,
+	"p384":       tls.CurveP384,
+	"secp384r1":  tls.CurveP384,
+	"p-521":      tls.CurveP521,
+	"p521":       tls.CurveP521,
+	"secp521r1":  tls.CurveP521,
+}
+
+func parseCurves(names []string) ([]tls.CurveID, error) {
+	if len(names) == 0 {
+		return nil, nil
+	}
+	ids := make([]tls.CurveID, 0, len(names))
+	for _, name := range names {
+		id, ok := curveNames[strings.ToLower(name)]
+		if !ok {
+			return nil, fmt.Errorf("invalid -curves entry %q: want X25519, P-256, P-384 or P-521", name)
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+// applyPolicy sets the opt-in version, cipher and curve limits on cfg. With
+// no options set cfg is left alone: untls accepts whatever the upstream
+// supports unless told otherwise.
+func (o *tlsOptions) applyPolicy(cfg *tls.Config) error {
+	minV, err := parseTLSVersion("-tls-min", o.MinVersion)
+	if err != nil {
+		return err
+	}
+	maxV, err := parseTLSVersion("-tls-max", o.MaxVersion)
+	if err != nil {
+		return err
+	}
+	if minV != 0 && maxV != 0 && minV > maxV {
+		return fmt.Errorf("-tls-min %s is above -tls-max %s", o.MinVersion, o.MaxVersion)
+	}
+	suites, err := parseCipherSuites(o.CipherSuites)
+	if err != nil {
+		return err
+	}
+	curves, err := parseCurves(o.Curves)
+	if err != nil {
+		return err
+	}
+	cfg.MinVersion, cfg.MaxVersion = minV, maxV
+	cfg.CipherSuites = suites
+	cfg.CurvePreferences = curves
+	return nil
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestParseTLSVersion(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    uint16
+		wantErr bool
+	}{
+		{in: "", want: 0},
+		{in: "1.0", want: tls.VersionTLS10},
+		{in: "1.2", want: tls.VersionTLS12},
+		{in: "TLS1.3", want: tls.VersionTLS13},
+		{in: "tls12", want: tls.VersionTLS12},
+		{in: "TLSv1.1", want: tls.VersionTLS11},
+		{in: "1.4", wantErr: true},
+		{in: "SSL3", wantErr: true},
+		{in: "771", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := parseTLSVersion("-tls-min", tt.in)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Fatalf("parseTLSVersion(%q) = %#x, %v; want %#x wantErr=%v", tt.in, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestParseCipherSuites(t *testing.T) {
+	got, err := parseCipherSuites([]string{"tls_ecdhe_ecdsa_with_aes_128_gcm_sha256", "TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256"})
+	if err != nil {
+		t.Fatalf("parseCipherSuites: %v", err)
+	}
+	want := []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256, tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256}
+	if !slices.Equal(got, want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	for _, bad := range []string{"TLS_AES_128_GCM_SHA256", "0xc02b", "AES128-GCM-SHA256"} {
+		if _, err := parseCipherSuites([]string{bad}); err == nil {
+			t.Fatalf("parseCipherSuites(%q) should fail", bad)
+		}
+	}
+}
+
+func TestParseCurves(t *testing.T) {
+	got, err := parseCurves([]string{"X25519", "p-256", "secp384r1", "P521"})
+	if err != nil {
+		t.Fatalf("parseCurves: %v", err)
+	}
+	want := []tls.CurveID{tls.X25519, tls.CurveP256, tls.CurveP384, tls.CurveP521}
+	if !slices.Equal(got, want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	if _, err := parseCurves([]string{"brainpoolP256r1"}); err == nil {
+		t.Fatal("unknown curve should fail")
+	}
+}
+
+func TestCommaList(t *testing.T) {
+	var c commaList
+	_ = c.Set("a, b,,c")
+	_ = c.Set("d")
+	if want := []string{"a", "b", "c", "d"}; !slices.Equal(c, want) {
+		t.Fatalf("commaList=%v, want %v", c, want)
+	}
+}
+
+func TestTLSOptions_PolicyDefaultsArePermissive(t *testing.T) {
+	var opts tlsOptions
+	cfg, err := opts.clientConfig("")
+	if err != nil {
+		t.Fatalf("clientConfig: %v", err)
+	}
+	if cfg.MinVersion != 0 || cfg.MaxVersion != 0 || cfg.CipherSuites != nil || cfg.CurvePreferences != nil {
+		t.Fatalf("zero options must keep crypto/tls defaults, got min=%#x max=%#x suites=%v curves=%v",
+			cfg.MinVersion, cfg.MaxVersion, cfg.CipherSuites, cfg.CurvePreferences)
+	}
+}
+
+func TestTLSOptions_PolicyErrors(t *testing.T) {
+	tests := []struct {
+		opts    tlsOptions
+		wantSub string
+	}{
+		{opts: tlsOptions{MinVersion: "1.5"}, wantSub: "-tls-min"},
+		{opts: tlsOptions{MaxVersion: "ssl3"}, wantSub: "-tls-max"},
+		{opts: tlsOptions{MinVersion: "1.3", MaxVersion: "1.2"}, wantSub: "above -tls-max"},
+		{opts: tlsOptions{CipherSuites: []string{"RC4"}}, wantSub: "-ciphers"},
+		{opts: tlsOptions{Curves: []string{"P-224"}}, wantSub: "-curves"},
+	}
+	for _, tt := range tests {
+		if _, err := tt.opts.clientConfig(""); err == nil || !strings.Contains(err.Error(), tt.wantSub) {
+			t.Fatalf("%+v: err=%v, want %q", tt.opts, err, tt.wantSub)
+		}
+	}
+}
+
+// TestConnectUpstream_Policy checks the limits actually reach the handshake
+// against a TLS 1.2-only upstream with a single cipher suite.
+func TestConnectUpstream_Policy(t *testing.T) {
+	leaf, key := mustCert(t, serverLeafTemplate("policy"), nil, nil)
+	ln := mustServeTLS(t, []*x509.Certificate{leaf}, key, func(c *tls.Config) {
+		c.MaxVersion = tls.VersionTLS12
+		c.CipherSuites = []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384}
+		c.CurvePreferences = []tls.CurveID{tls.CurveP384}
+	})
+	defer func() { _ = ln.Close() }()
+
+	tests := []struct {
+		name        string
+		opts        tlsOptions
+		wantErr     bool
+		wantSuite   uint16
+		wantVersion uint16
+	}{
+		{name: "defaults", wantSuite: tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384, wantVersion: tls.VersionTLS12},
+		{name: "min above server max", opts: tlsOptions{MinVersion: "1.3"}, wantErr: true},
+		{name: "disjoint ciphers", opts: tlsOptions{CipherSuites: []string{"TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256"}}, wantErr: true},
+		{name: "matching cipher", opts: tlsOptions{MaxVersion: "1.2", CipherSuites: []string{"TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384"}},
+			wantSuite: tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384, wantVersion: tls.VersionTLS12},
+		{name: "disjoint curves", opts: tlsOptions{Curves: []string{"X25519"}}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := tt.opts
+			trustOnly(t, &opts, leaf)
+			cfg, err := opts.clientConfig("")
+			if err != nil {
+				t.Fatalf("clientConfig: %v", err)
+			}
+			withUpstreamTLS(t, cfg)
+
+			client, server := net.Pipe()
+			defer func() { _ = client.Close() }()
+			upstream, err := connectUpstream(t.Context(), server, testTunnel(ln.Addr().String()))
+			if tt.wantErr {
+				if err == nil {
+					_ = upstream.Close()
+					t.Fatal("expected handshake failure")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("connectUpstream: %v", err)
+			}
+			defer func() { _ = upstream.Close() }()
+			cs := upstream.(*tls.Conn).ConnectionState()
+			if cs.Version != tt.wantVersion || cs.CipherSuite != tt.wantSuite {
+				t.Fatalf("negotiated %s %s, want %s %s", tls.VersionName(cs.Version), tls.CipherSuiteName(cs.CipherSuite),
+					tls.VersionName(tt.wantVersion), tls.CipherSuiteName(tt.wantSuite))
+			}
+		})
+	}
+}
@@ -0,0 +1,326 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"slices"
+	"sync"
+	"time"
+)
+
+const (
+	defaultPoolMaxIdle = 30 * time.Second
+	maxPoolSize        = 100
+)
+
+// poolConfig is the -pool-* flags: Size idle upstream connections, already
+// through the TCP and TLS handshakes, are kept per upstream so a new client
+// skips both. A connection idle for MaxIdle is replaced, before the
+// upstream's own idle timeout gets to it. Size 0 disables the pool.
+type poolConfig struct {
+	Size    int
+	MaxIdle time.Duration
+}
+
+// poolRetryMax caps the wait between failed refill dials, and
+// poolMinLife is how long an idle connection must last for its refill not
+// to count as a failure: an upstream that drops idle connections at once
+// would otherwise be redialled in a loop. Overridable in tests.
+var (
+	poolRetryMax = 30 * time.Second
+	poolMinLife  = time.Second
+)
+
+func (p poolConfig) enabled() bool { return p.Size > 0 }
+
+func (p poolConfig) validate() error {
+	if p.Size < 0 || p.Size > maxPoolSize {
+		return fmt.Errorf("invalid -pool-size %d: want 0-%d (0 disables)", p.Size, maxPoolSize)
+	}
+	if p.enabled() && p.MaxIdle <= 0 {
+		return fmt.Errorf("invalid -pool-max-idle %v: must be > 0", p.MaxIdle)
+	}
+	return nil
+}
+
+// String is p for reload logs.
+func (p poolConfig) String() string {
+	if !p.enabled() {
+		return "off"
+	}
+	return fmt.Sprintf("%d per upstream, max idle %v", p.Size, p.MaxIdle)
+}
+
+// pooledPrefixMax bounds what a pooled connection buffers from a server
+// that speaks first.
+const pooledPrefixMax = 16 << 10
+
+// pooledConn is an idle upstream connection. While it waits, watch keeps a
+// Read outstanding so a connection the upstream closes leaves the pool at
+// once; what arrives instead (the greeting of a server that speaks first)
+// is kept for the client.
+type pooledConn struct {
+	*tls.Conn
+	since  time.Time
+	read   chan struct{} // closed when watch returns
+	prefix []byte
+	err    error
+
+	// cfg is the TLS config c was dialed with; take skips it once a reload
+	// has swapped in another.
+	cfg *tls.Config
+	// warnings are the dial's, logged once a client takes the connection.
+	warnings []string
+}
+
+func (c *pooledConn) Read(p []byte) (int, error) {
+	if len(c.prefix) > 0 {
+		n := copy(p, c.prefix)
+		c.prefix = c.prefix[n:]
+		return n, nil
+	}
+	return c.Conn.Read(p)
+}
+
+func (c *pooledConn) watch(pool *connPool) {
+	defer close(c.read)
+	buf := make([]byte, 1024)
+	for len(c.prefix) < pooledPrefixMax {
+		var n int
+		n, c.err = c.Conn.Read(buf)
+		c.prefix = append(c.prefix, buf[:n]...)
+		if c.err != nil {
+			if !isTimeout(c.err) {
+				pool.drop(c)
+			}
+			return
+		}
+	}
+}
+
+func isTimeout(err error) bool {
+	var ne net.Error
+	return errors.As(err, &ne) && ne.Timeout()
+}
+
+// connPool is an upstream's idle connections.
+type connPool struct {
+	cfg  poolConfig
+	mu   sync.Mutex
+	idle []*pooledConn
+	// early is set when the upstream closed an idle connection younger
+	// than poolMinLife.
+	early bool
+	wake  chan struct{} // asks fill for a refill
+}
+
+func newConnPool(cfg poolConfig) *connPool {
+	return &connPool{cfg: cfg, wake: make(chan struct{}, 1)}
+}
+
+func (p *connPool) nudge() {
+	select {
+	case p.wake <- struct{}{}:
+	default:
+	}
+}
+
+// take hands out the newest usable idle connection dialed with cfg, or nil
+// when there is none, and asks for a replacement.
+func (p *connPool) take(now time.Time, cfg *tls.Config) *pooledConn {
+	if p == nil {
+		return nil
+	}
+	defer p.nudge()
+	for {
+		p.mu.Lock()
+		if len(p.idle) == 0 {
+			p.mu.Unlock()
+			return nil
+		}
+		c := p.idle[len(p.idle)-1]
+		p.idle = p.idle[:len(p.idle)-1]
+		p.mu.Unlock()
+		if now.Sub(c.since) >= p.cfg.MaxIdle || c.cfg != cfg {
+			_ = c.Close()
+			continue
+		}
+		// End the watch Read; a timeout leaves a tls.Conn usable.
+		_ = c.SetReadDeadline(time.Unix(1, 0))
+		<-c.read
+		_ = c.SetReadDeadline(time.Time{})
+		if c.err != nil && !isTimeout(c.err) {
+			_ = c.Close()
+			continue
+		}
+		return c
+	}
+}
+
+// drop removes c if it is still idle.
+func (p *connPool) drop(c *pooledConn) {
+	p.mu.Lock()
+	i := slices.Index(p.idle, c)
+	if i >= 0 {
+		p.idle = slices.Delete(p.idle, i, i+1)
+		p.early = p.early || time.Since(c.since) < poolMinLife
+	}
+	p.mu.Unlock()
+	if i >= 0 {
+		_ = c.Close()
+		p.nudge()
+	}
+}
+
+// expire closes the connections idle for MaxIdle at now and reports when
+// the next one will be.
+func (p *connPool) expire(now time.Time) (next time.Duration) {
+	p.mu.Lock()
+	var stale []*pooledConn
+	p.idle = slices.DeleteFunc(p.idle, func(c *pooledConn) bool {
+		if now.Sub(c.since) >= p.cfg.MaxIdle {
+			stale = append(stale, c)
+			return true
+		}
+		return false
+	})
+	next = p.cfg.MaxIdle
+	for _, c := range p.idle {
+		next = min(next, p.cfg.MaxIdle-now.Sub(c.since))
+	}
+	p.mu.Unlock()
+	for _, c := range stale {
+		_ = c.Close()
+	}
+	return next
+}
+
+func (p *connPool) len() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.idle)
+}
+
+func (p *connPool) put(c *tls.Conn, cfg *tls.Config, warnings []string) {
+	pc := &pooledConn{Conn: c, cfg: cfg, warnings: warnings, since: time.Now(), read: make(chan struct{})}
+	p.mu.Lock()
+	p.idle = append(p.idle, pc)
+	p.mu.Unlock()
+	go pc.watch(p)
+}
+
+func (p *connPool) closeIdle() {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	idle := p.idle
+	p.idle = nil
+	p.mu.Unlock()
+	for _, c := range idle {
+		_ = c.Close()
+	}
+}
+
+// fill keeps u's pool topped up until ctx is done, then closes what is
+// idle. It does not dial an upstream the health checks or the breaker have
+// given up on, nor keep idle connections to one, and backs off while dials
+// fail, logging only the first failure of a run. Its dials count toward the
+// breaker like a client's; handing out what it dialed does not.
+func (p *connPool) fill(ctx context.Context, label string, t *tunnel, u *upstream) {
+	defer p.closeIdle()
+	var retry time.Duration
+	var retryAt time.Time
+	for {
+		now := time.Now()
+		wait := p.expire(now)
+		p.mu.Lock()
+		early := p.early
+		p.early = false
+		p.mu.Unlock()
+		if early {
+			if retry == 0 {
+				log.Printf("warning: %supstream %s closes idle connections within %v; retrying", label, u.addr, poolMinLife)
+			}
+			retry = min(max(2*retry, time.Second), poolRetryMax)
+			retryAt = now.Add(retry)
+		}
+		usable := !u.down.Load() && !(t.breaker.enabled() && u.circuit.isOpen(now))
+		switch {
+		case p.len() >= p.cfg.Size:
+		case !usable:
+			// A dial that was in flight when the upstream went down may
+			// have refilled the pool behind closeIdle.
+			p.closeIdle()
+			wait = min(wait, time.Second)
+		case now.Before(retryAt):
+			wait = min(wait, retryAt.Sub(now))
+		default:
+			dialCtx, cancel := context.WithTimeout(ctx, t.dialLimit())
+			cfg := u.tls.Load()
+			c, warnings, err := u.dial(dialCtx, cfg)
+			cancel()
+			if t.breaker.enabled() {
+				u.circuit.done(t.breaker, t.logArea("breaker"), u.addr, time.Now(), false, err, ctx.Err() != nil)
+			}
+			if ctx.Err() != nil {
+				if err == nil {
+					_ = c.Close()
+				}
+				return
+			}
+			if err == nil {
+				p.put(c, cfg, warnings)
+				// Only a success well after the last retry ends the back
+				// off: one right at it may be dropped again within
+				// poolMinLife.
+				if !now.Before(retryAt.Add(poolMinLife)) {
+					retry = 0
+				}
+				continue
+			}
+			if retry == 0 {
+				log.Printf("warning: %supstream %s: %s; retrying", label, u.addr, err)
+			}
+			retry = min(max(2*retry, time.Second), poolRetryMax)
+			retryAt = time.Now().Add(retry)
+			continue
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-p.wake:
+		case <-timer.C:
+		}
+		timer.Stop()
+	}
+}
+
+// startPools fills each of t's upstream pools until ctx is done or the
+// returned stop is called; stop waits for the fillers and closes the idle
+// connections.
+func (t *tunnel) startPools(ctx context.Context) (stop func()) {
+	ctx, cancel := context.WithCancel(ctx)
+	var wg sync.WaitGroup
+	label := t.logArea("pool")
+	for _, u := range t.upstreams {
+		if u.pool == nil {
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			u.pool.fill(ctx, label, t, u)
+		}()
+	}
+	return func() {
+		cancel()
+		wg.Wait()
+	}
+}
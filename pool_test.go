@@ -0,0 +1,385 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestPoolConfig_Validate(t *testing.T) {
+	for _, tt := range []struct {
+		p    poolConfig
+		want string
+	}{
+		{p: poolConfig{}},
+		{p: poolConfig{Size: 4, MaxIdle: time.Second}},
+		{p: poolConfig{Size: -1}, want: "invalid -pool-size -1"},
+		{p: poolConfig{Size: maxPoolSize + 1, MaxIdle: time.Second}, want: "invalid -pool-size"},
+		{p: poolConfig{Size: 1}, want: "invalid -pool-max-idle 0s"},
+	} {
+		err := tt.p.validate()
+		if tt.want == "" && err != nil || tt.want != "" && (err == nil || !strings.Contains(err.Error(), tt.want)) {
+			t.Errorf("%+v: err=%v, want %q", tt.p, err, tt.want)
+		}
+	}
+}
+
+func pooledTunnel(t *testing.T, up *testUpstream, pool poolConfig) (*tunnel, *upstream) {
+	t.Helper()
+	tun := mustSetupTunnel(t, &tunnel{remote: up.addr, pool: pool}, up.cert)
+	stop := tun.startPools(t.Context())
+	t.Cleanup(stop)
+	return tun, tun.upstreams[0]
+}
+
+// greetThrough connects a client through tun and checks the upstream's
+// greeting and an echo come through.
+func greetThrough(t *testing.T, tun *tunnel) net.Conn {
+	t.Helper()
+	client, server := net.Pipe()
+	t.Cleanup(func() { _ = client.Close() })
+	up, err := connectUpstream(t.Context(), server, tun)
+	if err != nil {
+		t.Fatalf("connectUpstream: %v", err)
+	}
+	t.Cleanup(func() { _ = up.Close() })
+	_ = up.SetDeadline(time.Now().Add(5 * time.Second))
+	r := bufio.NewReader(up)
+	if line, err := r.ReadString('\n'); err != nil || line != "hi\n" {
+		t.Fatalf("greeting = %q, %v", line, err)
+	}
+	if _, err := up.Write([]byte("ping\n")); err != nil {
+		t.Fatal(err)
+	}
+	if line, err := r.ReadString('\n'); err != nil || line != "ping\n" {
+		t.Fatalf("echo = %q, %v", line, err)
+	}
+	return up
+}
+
+// TestPool_HandsOutWarmConnections: clients get a connection handshaked
+// ahead of time, with the greeting the upstream sent while it sat idle,
+// and the pool refills behind them.
+func TestPool_HandsOutWarmConnections(t *testing.T) {
+	logs := captureLog(t)
+	up := mustTestUpstream(t, says("hi"))
+	tun, u := pooledTunnel(t, up, poolConfig{Size: 2, MaxIdle: time.Minute})
+	waitUntil(t, "the pool is full", func() bool { return u.pool.len() == 2 })
+	// Let the greetings arrive on the idle connections.
+	time.Sleep(50 * time.Millisecond)
+
+	for range 3 {
+		if c, ok := greetThrough(t, tun).(*pooledConn); !ok {
+			t.Fatalf("got a %T, want a pooled connection", c)
+		}
+		waitUntil(t, "the pool refilled", func() bool { return u.pool.len() == 2 })
+	}
+	if n := up.accepted.Load(); n != 5 {
+		t.Fatalf("upstream accepted %d connections, want 5 (2 + 3 refills)", n)
+	}
+	if !strings.Contains(logs(), "conn/pipe: upstream "+up.addr+" (pooled)") {
+		t.Fatalf("no pooled line:\n%s", logs())
+	}
+}
+
+// TestPool_DropsClosed: connections the upstream closes while idle leave
+// the pool and are replaced, so clients never get a dead one.
+func TestPool_DropsClosed(t *testing.T) {
+	captureLog(t)
+	old := poolMinLife
+	poolMinLife = 0
+	t.Cleanup(func() { poolMinLife = old })
+	up := mustTestUpstream(t, says("hi"))
+	tun, u := pooledTunnel(t, up, poolConfig{Size: 2, MaxIdle: time.Minute})
+	waitUntil(t, "the pool is full", func() bool { return u.pool.len() == 2 })
+
+	up.hangUp()
+	waitUntil(t, "the pool is refilled", func() bool { return up.accepted.Load() == 4 && u.pool.len() == 2 })
+	greetThrough(t, tun)
+}
+
+// TestPool_MaxIdle: connections are replaced once they have been idle for
+// MaxIdle.
+func TestPool_MaxIdle(t *testing.T) {
+	up := mustTestUpstream(t, says("hi"))
+	_, u := pooledTunnel(t, up, poolConfig{Size: 1, MaxIdle: 30 * time.Millisecond})
+	waitUntil(t, "two replacements", func() bool { return up.accepted.Load() >= 3 })
+	if n := u.pool.len(); n > 1 {
+		t.Fatalf("pool holds %d connections, want at most 1", n)
+	}
+}
+
+// TestPool_BacksOffEarlyCloses: an upstream that drops idle connections at
+// once is not redialled in a loop.
+func TestPool_BacksOffEarlyCloses(t *testing.T) {
+	logs := captureLog(t)
+	ln, cert := mustSelfSignedTLSListener(t)
+	defer func() { _ = ln.Close() }()
+	var accepted atomic.Int64
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			accepted.Add(1)
+			// Finish the handshake, then hang up.
+			_ = c.(*tls.Conn).Handshake()
+			_ = c.Close()
+		}
+	}()
+	tun := mustSetupTunnel(t, &tunnel{remote: ln.Addr().String(), pool: poolConfig{Size: 1, MaxIdle: time.Minute}}, cert)
+	stop := tun.startPools(t.Context())
+	defer stop()
+	time.Sleep(500 * time.Millisecond)
+	if n := accepted.Load(); n > 3 {
+		t.Fatalf("upstream dialled %d times in 500ms", n)
+	}
+	if !strings.Contains(logs(), "closes idle connections within 1s; retrying") {
+		t.Fatalf("no back-off line:\n%s", logs())
+	}
+}
+
+// TestPool_NotUsedForFailingUpstream: an upstream the health checks have
+// down, or whose last dial failed, gets a fresh dial instead of an idle
+// connection handshaked before that.
+func TestPool_NotUsedForFailingUpstream(t *testing.T) {
+	captureLog(t)
+	up := mustTestUpstream(t, says("hi"))
+	tun, u := pooledTunnel(t, up, poolConfig{Size: 1, MaxIdle: time.Minute})
+	for _, mark := range []func(){
+		func() { u.down.Store(true) },
+		func() { u.failedAt.Store(time.Now().UnixNano()) },
+	} {
+		waitUntil(t, "the pool is full", func() bool { return u.pool.len() == 1 })
+		mark()
+		if c, ok := greetThrough(t, tun).(*pooledConn); ok {
+			t.Fatalf("got a %T, want a fresh dial", c)
+		}
+		u.down.Store(false)
+		u.pool.nudge()
+	}
+}
+
+// TestPool_BreakerOpen: a client of an upstream whose circuit is open is
+// rejected rather than handed an idle connection, and the failed dial that
+// opens the circuit closes the idle ones.
+func TestPool_BreakerOpen(t *testing.T) {
+	captureLog(t)
+	up := mustTestUpstream(t, says("hi"))
+	start := func() (*tunnel, *upstream) {
+		tun := mustSetupTunnel(t, &tunnel{
+			remote:  up.addr,
+			pool:    poolConfig{Size: 2, MaxIdle: time.Minute},
+			breaker: breakerConfig{Failures: 1, Cooldown: time.Hour},
+		}, up.cert)
+		t.Cleanup(tun.startPools(t.Context()))
+		u := tun.upstreams[0]
+		waitUntil(t, "the pool is full", func() bool { return u.pool.len() == 2 })
+		return tun, u
+	}
+
+	tun, u := start()
+	u.circuit.done(tun.breaker, "", u.addr, time.Now(), false, errors.New("refused"), false)
+	client, server := net.Pipe()
+	defer func() { _ = client.Close() }()
+	if c, err := connectUpstream(t.Context(), server, tun); !errors.Is(err, errCircuitOpen) {
+		t.Fatalf("connectUpstream = %T, %v; want the circuit open", c, err)
+	}
+
+	tun, u = start()
+	// Keep the pool out of it so the dial runs, and fail it on the deadline.
+	u.failedAt.Store(time.Now().UnixNano())
+	ctx, cancel := context.WithDeadline(t.Context(), time.Now())
+	defer cancel()
+	if _, _, err := dialUpstream(ctx, &net.TCPAddr{}, "conn/test", tun); err == nil {
+		t.Fatal("dial past the deadline succeeded")
+	}
+	if n := u.pool.len(); n != 0 {
+		t.Fatalf("pool holds %d connections after the circuit opened", n)
+	}
+}
+
+// TestPool_HandOutsKeepBreakerCount: handing out an idle connection is not
+// a dial, so failed dials in between still add up to an open circuit.
+func TestPool_HandOutsKeepBreakerCount(t *testing.T) {
+	captureLog(t)
+	up := mustTestUpstream(t, says("hi"))
+	tun := mustSetupTunnel(t, &tunnel{
+		remote:  up.addr,
+		pool:    poolConfig{Size: 2, MaxIdle: time.Minute},
+		breaker: breakerConfig{Failures: 3, Cooldown: time.Hour},
+	}, up.cert)
+	u := tun.upstreams[0]
+	// No filler, whose successful dials would rightly clear the count: the
+	// pool holds what the test puts in.
+	for range 2 {
+		cfg := u.tls.Load()
+		c, warnings, err := u.dial(t.Context(), cfg)
+		if err != nil {
+			t.Fatalf("dial: %v", err)
+		}
+		u.pool.put(c, cfg, warnings)
+	}
+	for i := range 3 {
+		if i > 0 {
+			u.failedAt.Store(0)
+			if c, ok := greetThrough(t, tun).(*pooledConn); !ok {
+				t.Fatalf("got a %T, want a pooled connection", c)
+			}
+		}
+		// Keep the pool out of it so the dial runs, and fail it on the deadline.
+		u.failedAt.Store(time.Now().UnixNano())
+		ctx, cancel := context.WithDeadline(t.Context(), time.Now())
+		_, _, err := dialUpstream(ctx, &net.TCPAddr{}, "conn/test", tun)
+		cancel()
+		if err == nil {
+			t.Fatal("dial past the deadline succeeded")
+		}
+	}
+	if !u.circuit.isOpen(time.Now()) {
+		t.Fatal("circuit still closed after 3 failed dials between pooled hand-outs")
+	}
+}
+
+// TestPool_HealthDownDropsIdle: idle connections to an upstream the health
+// checks take down are closed.
+func TestPool_HealthDownDropsIdle(t *testing.T) {
+	captureLog(t)
+	up := mustTestUpstream(t, says("hi"))
+	tun := mustSetupTunnel(t, &tunnel{
+		remote: up.addr,
+		pool:   poolConfig{Size: 2, MaxIdle: time.Minute},
+		health: healthCheck{Mode: healthTLS, Interval: 50 * time.Millisecond, Expect: "ok", Rise: 1, Fall: 1},
+	}, up.cert)
+	t.Cleanup(tun.startPools(t.Context()))
+	u := tun.upstreams[0]
+	waitUntil(t, "the pool is full", func() bool { return u.pool.len() == 2 })
+
+	t.Cleanup(tun.startHealthChecks(t.Context()))
+	waitUntil(t, "the upstream is down", u.down.Load)
+	waitUntil(t, "the pool is empty", func() bool { return u.pool.len() == 0 })
+}
+
+// TestTunnelSet_Pool: a tunnel from a config file serves clients from its
+// pool, and a reload replaces the pool.
+func TestTunnelSet_Pool(t *testing.T) {
+	logs := captureLog(t)
+	up := mustTestUpstream(t, says("up"))
+	body := func(size int) string {
+		return fmt.Sprintf(`{"tunnels": [
+  {"name": "a", "listen": "127.0.0.1:0", "remote": %q, "pool": {"size": %d},
+   "tls": {"ca-file": [%q], "no-system-ca": true}}
+]}`, up.addr, size, up.caFile)
+	}
+	set := startTunnelSet(t, mustReloadConfig(t, body(1)))
+	set.mu.Lock()
+	rt := set.running["a"]
+	set.mu.Unlock()
+	old := rt.t.upstreams[0].pool
+	waitUntil(t, "the pool is full", func() bool { return old.len() == 1 })
+	if _, _, got := greet(t, set, "a"); got != "up" {
+		t.Fatalf("reached %s", got)
+	}
+	if !strings.Contains(logs(), ": upstream "+up.addr+" (pooled)") {
+		t.Fatalf("client was not served from the pool:\n%s", logs())
+	}
+
+	set.reload(mustReloadConfig(t, body(2)))
+	if !strings.Contains(logs(), "info: reload: tunnel a: pool 1 per upstream, max idle 30s -> 2 per upstream, max idle 30s") {
+		t.Fatalf("no pool change line:\n%s", logs())
+	}
+	waitUntil(t, "the old pool is closed", func() bool { return old.len() == 0 })
+	waitUntil(t, "the new pool is full", func() bool { return rt.t.current().upstreams[0].pool.len() == 2 })
+}
+
+// TestTunnelSet_PoolUnchanged: a reload that leaves the upstreams and the
+// pool, health and breaker settings alone keeps the pool, swaps the TLS
+// config for new dials and replaces the idle connections with ones dialed
+// under it.
+func TestTunnelSet_PoolUnchanged(t *testing.T) {
+	up := mustTestUpstream(t, says("up"))
+	body := fmt.Sprintf(`{"tunnels": [
+  {"name": "a", "listen": "127.0.0.1:0", "remote": %q, "pool": {"size": 1},
+   "tls": {"ca-file": [%q], "no-system-ca": true}}
+]}`, up.addr, up.caFile)
+	set := startTunnelSet(t, mustReloadConfig(t, body))
+	set.mu.Lock()
+	rt := set.running["a"]
+	set.mu.Unlock()
+	old := rt.t.upstreams[0].pool
+	waitUntil(t, "the pool is full", func() bool { return old.len() == 1 })
+
+	next := mustReloadConfig(t, body)
+	fresh := next.tunnels[0].upstreams[0].tls.Load()
+	set.reload(next)
+	u := rt.t.current().upstreams[0]
+	if u.pool != old {
+		t.Fatal("reload replaced the pool")
+	}
+	if u.tls.Load() != fresh {
+		t.Error("reload kept the old TLS config for new dials")
+	}
+	waitUntil(t, "the pool is refilled", func() bool { return up.accepted.Load() == 2 && old.len() == 1 })
+	if _, _, got := greet(t, set, "a"); got != "up" {
+		t.Fatalf("reached %s", got)
+	}
+}
+
+// TestTunnelSet_PoolTLSReload: once a reload changes the TLS settings, a
+// connection pooled under the old ones is never handed to a client.
+func TestTunnelSet_PoolTLSReload(t *testing.T) {
+	logs := captureLog(t)
+	up := mustTestUpstream(t, says("up"))
+	body := func(caFile string) string {
+		return fmt.Sprintf(`{"tunnels": [
+  {"name": "a", "listen": "127.0.0.1:0", "remote": %q, "pool": {"size": 1},
+   "tls": {"ca-file": [%q], "no-system-ca": true}}
+]}`, up.addr, caFile)
+	}
+	set := startTunnelSet(t, mustReloadConfig(t, body(up.caFile)))
+	set.mu.Lock()
+	rt := set.running["a"]
+	set.mu.Unlock()
+	pool := rt.t.upstreams[0].pool
+	waitUntil(t, "the pool is full", func() bool { return pool.len() == 1 })
+	pool.mu.Lock()
+	stale := pool.idle[0]
+	pool.mu.Unlock()
+
+	set.reload(mustReloadConfig(t, body(writeTrustFile(t, up.cert))))
+	if !strings.Contains(logs(), "info: reload: tunnel a: tls changed: ca-file") {
+		t.Fatalf("no tls change line:\n%s", logs())
+	}
+	u := rt.t.current().upstreams[0]
+	waitUntil(t, "the pool is refilled", func() bool { return up.accepted.Load() == 2 && pool.len() == 1 })
+	pool.mu.Lock()
+	fresh := pool.idle[0]
+	pool.mu.Unlock()
+	if fresh == stale || fresh.cfg != u.tls.Load() {
+		t.Fatal("the pool still holds the connection dialed before the reload")
+	}
+	if _, _, got := greet(t, set, "a"); got != "up" {
+		t.Fatalf("reached %s", got)
+	}
+
+	// A connection dialed under the old config that lands in a pool after
+	// the reload is skipped as well.
+	c, _, err := u.dial(t.Context(), stale.cfg)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	late := newConnPool(poolConfig{Size: 1, MaxIdle: time.Minute})
+	late.put(c, stale.cfg, nil)
+	if got := late.take(time.Now(), u.tls.Load()); got != nil {
+		_ = got.Close()
+		t.Fatal("take handed out a connection dialed with the old config")
+	}
+}
@@ -0,0 +1,367 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// tunnelSet runs the accept loops of the configured tunnels and applies a
+// reloaded configuration to them without touching live connections.
+type tunnelSet struct {
+	ctx  context.Context
+	stop context.CancelFunc // stops the whole process
+
+	mu      sync.Mutex
+	running map[string]*runningTunnel
+	cfg     *config
+	err     error // first permanent accept error
+	wg      sync.WaitGroup
+}
+
+// runningTunnel is a bound tunnel. t is what its accept loop was started
+// with; reloads that keep the listen address swap t.live instead.
+type runningTunnel struct {
+	t      *tunnel
+	ln     net.Listener
+	ctx    context.Context
+	cancel context.CancelFunc
+	done   chan struct{}
+	// stopWorkers stops the background work (see startWorkers) of the
+	// definition in use; guarded by the set's mu.
+	stopWorkers func()
+}
+
+func newTunnelSet(ctx context.Context, stop context.CancelFunc, cfg *config) *tunnelSet {
+	return &tunnelSet{ctx: ctx, stop: stop, running: map[string]*runningTunnel{}, cfg: cfg}
+}
+
+// start binds t and runs its accept loop until the set's context is done or
+// the tunnel is stopped. A permanent accept error stops every tunnel: exiting
+// lets the supervisor restart the process instead of running half of them.
+func (s *tunnelSet) start(t *tunnel) error {
+	var ln net.Listener
+	var source string
+	if t.socket != nil {
+		ln, source = t.socket.ln, t.socket.source()
+	} else {
+		// Port 0 → let the kernel pick a free port on the chosen address.
+		// Avoid GetFreePort()+rebind: that races and can also disagree on
+		// address family (localhost vs 127.0.0.1).
+		var err error
+		ln, source, err = CreateListener(t.listen)
+		if err != nil {
+			return t.wrap(fmt.Errorf("failed to listen socket %s: %w", source, err))
+		}
+	}
+	if t.name == "" {
+		log.Printf("info: listening on %s", listenLabel(ln, source))
+	} else {
+		log.Printf("info: tunnel %s: listening on %s, upstream %s", t.name, listenLabel(ln, source), t.remote)
+	}
+	if w := exposedWarning(ln.Addr()); w != "" {
+		log.Print(w)
+	}
+
+	ctx, cancel := context.WithCancel(s.ctx)
+	rt := &runningTunnel{t: t, ln: ln, ctx: ctx, cancel: cancel, done: make(chan struct{})}
+	rt.stopWorkers = t.startWorkers(ctx)
+	s.mu.Lock()
+	s.running[t.name] = rt
+	s.mu.Unlock()
+	go func() {
+		<-ctx.Done()
+		_ = ln.Close()
+	}()
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		defer close(rt.done)
+		defer func() {
+			s.mu.Lock()
+			stop := rt.stopWorkers
+			s.mu.Unlock()
+			stop()
+		}()
+		if err := acceptLoop(ctx, ln, t); err != nil {
+			s.mu.Lock()
+			if s.err == nil {
+				s.err = t.wrap(err)
+			}
+			s.mu.Unlock()
+			s.stop()
+		}
+	}()
+	return nil
+}
+
+// wait blocks until every accept loop has returned and reports the first
+// permanent accept error.
+func (s *tunnelSet) wait() error {
+	s.wg.Wait()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.err
+}
+
+// stopTunnel closes rt's listener and waits for its accept loop. Its
+// connections keep running: handleConn does not depend on the listener.
+func (s *tunnelSet) stopTunnel(rt *runningTunnel) {
+	rt.cancel()
+	<-rt.done
+	s.mu.Lock()
+	if s.running[rt.t.name] == rt {
+		delete(s.running, rt.t.name)
+	}
+	s.mu.Unlock()
+}
+
+// reload moves the running tunnels to next, whose tunnels must already be
+// set up. Tunnels are matched by name: missing ones stop, then new ones
+// start, a changed listen address rebinds, and anything else (remote, TLS,
+// or just re-read certificate files) is swapped in for new connections
+// while the listener keeps accepting. Every change is logged.
+func (s *tunnelSet) reload(next *config) {
+	s.mu.Lock()
+	prev := s.cfg
+	running := make(map[string]*runningTunnel, len(s.running))
+	for name, rt := range s.running {
+		running[name] = rt
+	}
+	s.mu.Unlock()
+
+	for _, msg := range restartOnlyChanges(prev, next) {
+		log.Printf("warning: reload: %s changed; restart untls to apply it", msg)
+	}
+	unixPerms, _ = parseUnixPerms(next.unixMode, next.unixOwner)
+	setLogTimestamps(next.logTimestamps)
+
+	// Stop the removed tunnels first, so a renamed tunnel can bind the
+	// address its old name held.
+	changes := 0
+	wanted := map[string]bool{}
+	for _, t := range next.tunnels {
+		wanted[t.name] = true
+	}
+	for name, rt := range running {
+		if !wanted[name] {
+			s.stopTunnel(rt)
+			log.Printf("info: reload: tunnel %s removed (was %s -> %s)", displayName(rt.t), rt.t.listen, rt.t.current().remote)
+			changes++
+		}
+	}
+	for _, t := range next.tunnels {
+		rt, ok := running[t.name]
+		switch {
+		case !ok:
+			if socketActivated {
+				log.Printf("error/reload: %s", t.wrap(errors.New("cannot add a tunnel under socket activation; add a socket to the unit and restart")))
+				continue
+			}
+			if err := s.start(t); err != nil {
+				log.Printf("error/reload: %s", err)
+				continue
+			}
+			log.Printf("info: reload: tunnel %s added: %s -> %s", displayName(t), t.listen, t.remote)
+			changes++
+		case rt.t.listen != t.listen && rt.t.socket == nil:
+			// Bind the new address first so a failure keeps the old one.
+			old := rt
+			t.inheritState(old.t.current())
+			s.mu.Lock()
+			delete(s.running, t.name)
+			s.mu.Unlock()
+			if err := s.start(t); err != nil {
+				s.mu.Lock()
+				s.running[t.name] = old
+				s.mu.Unlock()
+				log.Printf("error/reload: %s; keeping %s", err, old.t.listen)
+				continue
+			}
+			s.stopTunnel(old)
+			log.Printf("info: reload: tunnel %s moved: %s -> %s", displayName(t), old.t.listen, t.listen)
+			changes++
+		default:
+			if rt.t.listen != t.listen {
+				log.Printf("warning: reload: tunnel %s: listen is set by the systemd socket unit; ignoring the change", displayName(t))
+			}
+			cur := rt.t.current()
+			if sameWorkers(cur, t) {
+				// Keep the upstreams, and with them the pools and the
+				// health and breaker state. The idle connections were
+				// handshaked under the old TLS material (pins, CAs, client
+				// certificate, CRLs) and are replaced with new dials.
+				for i, u := range cur.upstreams {
+					u.tls.Store(t.upstreams[i].tls.Load())
+					if u.pool != nil {
+						u.pool.closeIdle()
+						u.pool.nudge()
+					}
+				}
+				t.upstreams = cur.upstreams
+			} else {
+				t.inheritState(cur)
+				s.mu.Lock()
+				stopWorkers := rt.stopWorkers
+				rt.stopWorkers = t.startWorkers(rt.ctx)
+				s.mu.Unlock()
+				stopWorkers()
+			}
+			rt.t.live.Store(t)
+			for _, d := range tunnelDiff(cur, t) {
+				log.Printf("info: reload: tunnel %s: %s", displayName(t), d)
+				changes++
+			}
+		}
+	}
+	s.mu.Lock()
+	s.cfg = next
+	s.mu.Unlock()
+	if changes == 0 {
+		log.Printf("info: reload: no configuration changes; TLS material re-read")
+	}
+}
+
+func displayName(t *tunnel) string {
+	if t.name == "" {
+		return "(unnamed)"
+	}
+	return t.name
+}
+
+// sameWorkers reports whether b can keep a's upstreams and background
+// workers: the same upstream list and the same health, pool, breaker and
+// dial timeout settings.
+func sameWorkers(a, b *tunnel) bool {
+	if a.health != b.health || a.pool != b.pool || a.breaker != b.breaker || a.dialLimit() != b.dialLimit() || len(a.upstreams) != len(b.upstreams) {
+		return false
+	}
+	for i, u := range a.upstreams {
+		if u.addr != b.upstreams[i].addr || u.weight != b.upstreams[i].weight {
+			return false
+		}
+	}
+	return true
+}
+
+// tunnelDiff describes what differs between two definitions of a tunnel.
+func tunnelDiff(a, b *tunnel) []string {
+	var out []string
+	if a.remote != b.remote {
+		out = append(out, fmt.Sprintf("remote %s -> %s", a.remote, b.remote))
+	}
+	if a.balance != b.balance {
+		out = append(out, fmt.Sprintf("balance %s -> %s", balanceName(a.balance), balanceName(b.balance)))
+	}
+	if a.health != b.health && (a.health.enabled() || b.health.enabled()) {
+		out = append(out, fmt.Sprintf("health %s -> %s", a.health, b.health))
+	}
+	if a.breaker != b.breaker {
+		out = append(out, fmt.Sprintf("breaker %s -> %s", a.breaker, b.breaker))
+	}
+	if a.pool != b.pool {
+		out = append(out, fmt.Sprintf("pool %s -> %s", a.pool, b.pool))
+	}
+	if a.dialLimit() != b.dialLimit() {
+		out = append(out, fmt.Sprintf("dial-timeout %v -> %v", a.dialLimit(), b.dialLimit()))
+	}
+	if a.certExpiryWarn != b.certExpiryWarn {
+		out = append(out, fmt.Sprintf("cert-expiry-warn %v -> %v", a.certExpiryWarn, b.certExpiryWarn))
+	}
+	if keys := tlsDiff(a.opts, b.opts); len(keys) > 0 {
+		out = append(out, "tls changed: "+strings.Join(keys, ", "))
+	}
+	return out
+}
+
+// tlsDiff lists the option names (flag names) whose values differ.
+func tlsDiff(a, b tlsOptions) []string {
+	am, bm := tlsOptionMap(a), tlsOptionMap(b)
+	var keys []string
+	for k := range am {
+		if _, ok := bm[k]; !ok {
+			keys = append(keys, k)
+		}
+	}
+	for k, v := range bm {
+		if w, ok := am[k]; !ok || string(v) != string(w) {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func tlsOptionMap(o tlsOptions) map[string]json.RawMessage {
+	data, _ := json.Marshal(o)
+	m := map[string]json.RawMessage{}
+	_ = json.Unmarshal(data, &m)
+	return m
+}
+
+// restartOnlyChanges names the process-wide settings that differ between two
+// configs but are only read at startup.
+func restartOnlyChanges(a, b *config) []string {
+	var out []string
+	if a.sessionCacheSize != b.sessionCacheSize || a.sessionCacheFile != b.sessionCacheFile {
+		out = append(out, "session-cache-size/session-cache-file")
+	}
+	return out
+}
+
+// reloadOnSIGHUP re-reads the configuration (the -config file, or the TLS
+// files named by the flags) on every signal from hup until ctx is done and
+// applies it with tunnelSet.reloadFrom. A configuration that does not load
+// or set up is rejected as a whole and the running tunnels are left alone.
+func reloadOnSIGHUP(ctx context.Context, set *tunnelSet, hup <-chan os.Signal) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+			if err := set.reloadFrom(flag.CommandLine, &cmdline); err != nil {
+				log.Printf("error/reload: %s; keeping the running configuration", err)
+				continue
+			}
+			log.Printf("info: reloaded configuration")
+		}
+	}
+}
+
+// reloadFrom is one SIGHUP: it loads the configuration fs parsed into o,
+// re-reading every file it names, and applies it with reload.
+func (s *tunnelSet) reloadFrom(fs *flag.FlagSet, o *options) error {
+	next, err := loadConfig(fs, o)
+	if err == nil {
+		err = next.check()
+	}
+	if err == nil {
+		err = next.setupTunnels()
+	}
+	if err != nil {
+		return err
+	}
+	s.reload(next)
+	return nil
+}
+
+// runningNames lists the running tunnels, for tests and logs.
+func (s *tunnelSet) runningNames() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	names := make([]string, 0, len(s.running))
+	for name := range s.running {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return names
+}
@@ -0,0 +1,307 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// mustReloadConfig loads and sets up a config file body, as SIGHUP does.
+func mustReloadConfig(t *testing.T, body string) *config {
+	t.Helper()
+	c, err := loadConfigFile(writeConfig(t, body))
+	if err != nil {
+		t.Fatalf("loadConfigFile: %v", err)
+	}
+	if err := c.check(); err != nil {
+		t.Fatalf("check: %v", err)
+	}
+	if err := c.setupTunnels(); err != nil {
+		t.Fatalf("setupTunnels: %v", err)
+	}
+	return c
+}
+
+func tunnelJSON(name, listen string, up *testUpstream) string {
+	return fmt.Sprintf(`{"name": %q, "listen": %q, "remote": %q, "tls": {"ca-file": [%q], "no-system-ca": true}}`,
+		name, listen, up.addr, up.caFile)
+}
+
+func configJSON(tunnels ...string) string {
+	return `{"tunnels": [` + strings.Join(tunnels, ",\n") + `]}`
+}
+
+// greet dials a running tunnel and returns the connection and the name of
+// the upstream it reached.
+func greet(t *testing.T, set *tunnelSet, name string) (net.Conn, *bufio.Reader, string) {
+	t.Helper()
+	c := dialTunnel(t, set, name)
+	r := bufio.NewReader(c)
+	line, err := r.ReadString('\n')
+	if err != nil {
+		t.Fatalf("tunnel %s: read greeting: %v", name, err)
+	}
+	return c, r, strings.TrimSuffix(line, "\n")
+}
+
+// dialTunnel connects to a running tunnel's listener.
+func dialTunnel(t *testing.T, set *tunnelSet, name string) net.Conn {
+	t.Helper()
+	set.mu.Lock()
+	rt := set.running[name]
+	set.mu.Unlock()
+	if rt == nil {
+		t.Fatalf("tunnel %s is not running", name)
+	}
+	addr := rt.ln.Addr()
+	c, err := net.DialTimeout(addr.Network(), addr.String(), 2*time.Second)
+	if err != nil {
+		t.Fatalf("dial %s: %v", name, err)
+	}
+	t.Cleanup(func() { _ = c.Close() })
+	_ = c.SetDeadline(time.Now().Add(5 * time.Second))
+	return c
+}
+
+// sighup reloads set from the config file at path the way a SIGHUP does.
+func sighup(t *testing.T, set *tunnelSet, path string) error {
+	t.Helper()
+	var o options
+	fs := flag.NewFlagSet("untls", flag.ContinueOnError)
+	registerFlags(fs, &o)
+	if err := fs.Parse([]string{"-config", path}); err != nil {
+		t.Fatal(err)
+	}
+	return set.reloadFrom(fs, &o)
+}
+
+func echo(t *testing.T, c net.Conn, r *bufio.Reader, msg string) {
+	t.Helper()
+	if _, err := c.Write([]byte(msg + "\n")); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	line, err := r.ReadString('\n')
+	if err != nil || line != msg+"\n" {
+		t.Fatalf("echo = %q, %v; want %q", line, err, msg)
+	}
+}
+
+func startTunnelSet(t *testing.T, cfg *config) *tunnelSet {
+	t.Helper()
+	keepGlobals(t)
+	ctx, stop := context.WithCancel(t.Context())
+	set := newTunnelSet(ctx, stop, cfg)
+	for _, tun := range cfg.tunnels {
+		if err := set.start(tun); err != nil {
+			t.Fatalf("start: %v", err)
+		}
+	}
+	t.Cleanup(func() {
+		stop()
+		if err := set.wait(); err != nil {
+			t.Errorf("wait: %v", err)
+		}
+	})
+	return set
+}
+
+func captureLog(t *testing.T) func() string {
+	t.Helper()
+	var buf bytes.Buffer
+	var mu sync.Mutex
+	log.SetOutput(&lockedWriter{w: &buf, mu: &mu})
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+	return func() string {
+		mu.Lock()
+		defer mu.Unlock()
+		return buf.String()
+	}
+}
+
+// TestTunnelSet_Reload: a reload adds, removes and retargets tunnels by
+// name, logs each change, and leaves established sessions alone.
+func TestTunnelSet_Reload(t *testing.T) {
+	t.Setenv("LISTEN_PID", "")
+	logs := captureLog(t)
+	up1, up2 := mustTestUpstream(t, says("up1")), mustTestUpstream(t, says("up2"))
+
+	set := startTunnelSet(t, mustReloadConfig(t, configJSON(
+		tunnelJSON("a", "127.0.0.1:0", up1),
+		tunnelJSON("b", "127.0.0.1:0", up1),
+	)))
+	liveA, liveAR, got := greet(t, set, "a")
+	if got != "up1" {
+		t.Fatalf("a reached %s", got)
+	}
+	liveB, liveBR, _ := greet(t, set, "b")
+
+	set.reload(mustReloadConfig(t, configJSON(
+		tunnelJSON("a", "127.0.0.1:0", up2),
+		tunnelJSON("c", "127.0.0.1:0", up2),
+	)))
+
+	if names := set.runningNames(); !slices.Equal(names, []string{"a", "c"}) {
+		t.Fatalf("running = %v, want [a c]", names)
+	}
+	// Sessions from before the reload still reach their old upstream, even
+	// on the removed tunnel.
+	echo(t, liveA, liveAR, "still up1")
+	echo(t, liveB, liveBR, "still b")
+	if _, _, got := greet(t, set, "a"); got != "up2" {
+		t.Fatalf("new connection on a reached %s, want up2", got)
+	}
+	if _, _, got := greet(t, set, "c"); got != "up2" {
+		t.Fatalf("c reached %s", got)
+	}
+
+	out := logs()
+	for _, want := range []string{
+		"info: reload: tunnel a: remote " + up1.addr + " -> " + up2.addr,
+		"info: reload: tunnel a: tls changed: ca-file",
+		"info: reload: tunnel c added: 127.0.0.1:0 -> " + up2.addr,
+		"info: reload: tunnel b removed (was 127.0.0.1:0 -> " + up1.addr + ")",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("log lacks %q:\n%s", want, out)
+		}
+	}
+}
+
+// TestTunnelSet_ReloadMove: a new listen address is bound before the old
+// one is closed, and a bind failure keeps the old listener.
+func TestTunnelSet_ReloadMove(t *testing.T) {
+	t.Setenv("LISTEN_PID", "")
+	logs := captureLog(t)
+	up := mustTestUpstream(t, says("up"))
+	dir := shortSocketDir(t)
+
+	set := startTunnelSet(t, mustReloadConfig(t, configJSON(tunnelJSON("a", "127.0.0.1:0", up))))
+	live, liveR, _ := greet(t, set, "a")
+
+	blocked := filepath.Join(dir, "file")
+	if err := os.WriteFile(blocked, nil, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	set.reload(mustReloadConfig(t, configJSON(tunnelJSON("a", "unix:"+blocked, up))))
+	if !strings.Contains(logs(), "error/reload: ") || !strings.Contains(logs(), "keeping 127.0.0.1:0") {
+		t.Fatalf("failed move not reported:\n%s", logs())
+	}
+	if _, _, got := greet(t, set, "a"); got != "up" {
+		t.Fatalf("old listener gone after a failed move")
+	}
+
+	sock := filepath.Join(dir, "a.sock")
+	set.reload(mustReloadConfig(t, configJSON(tunnelJSON("a", "unix:"+sock, up))))
+	if !strings.Contains(logs(), "info: reload: tunnel a moved: 127.0.0.1:0 -> unix:"+sock) {
+		t.Fatalf("move not logged:\n%s", logs())
+	}
+	if _, _, got := greet(t, set, "a"); got != "up" {
+		t.Fatalf("a reached %s over the new socket", got)
+	}
+	echo(t, live, liveR, "survived the move")
+}
+
+// TestTunnelSet_ReloadRename: renaming a tunnel keeps its address served;
+// the old name lets go of it before the new one binds.
+func TestTunnelSet_ReloadRename(t *testing.T) {
+	t.Setenv("LISTEN_PID", "")
+	logs := captureLog(t)
+	up := mustTestUpstream(t, says("up"))
+	addr := closedAddr(t)
+
+	set := startTunnelSet(t, mustReloadConfig(t, configJSON(tunnelJSON("a", addr, up))))
+	live, liveR, _ := greet(t, set, "a")
+	set.reload(mustReloadConfig(t, configJSON(tunnelJSON("b", addr, up))))
+
+	if names := set.runningNames(); !slices.Equal(names, []string{"b"}) {
+		t.Fatalf("running = %v, want [b]\n%s", names, logs())
+	}
+	if _, _, got := greet(t, set, "b"); got != "up" {
+		t.Fatalf("b reached %s", got)
+	}
+	echo(t, live, liveR, "survived the rename")
+	if strings.Contains(logs(), "error/reload") {
+		t.Fatalf("rename failed:\n%s", logs())
+	}
+}
+
+// TestTunnelSet_ReloadUnchanged re-reads TLS material even when nothing in
+// the configuration changed, and says so.
+func TestTunnelSet_ReloadUnchanged(t *testing.T) {
+	logs := captureLog(t)
+	up := mustTestUpstream(t, says("up"))
+	body := configJSON(tunnelJSON("a", "127.0.0.1:0", up))
+	set := startTunnelSet(t, mustReloadConfig(t, body))
+
+	set.mu.Lock()
+	rt := set.running["a"]
+	set.mu.Unlock()
+	before := rt.t.current()
+	next := mustReloadConfig(t, body)
+	next.sessionCacheSize = 8
+	set.reload(next)
+
+	if rt.t.current() == before || rt.t.current() != next.tunnels[0] {
+		t.Fatal("reload did not swap in the freshly set up tunnel")
+	}
+	out := logs()
+	if !strings.Contains(out, "info: reload: no configuration changes; TLS material re-read") {
+		t.Errorf("log lacks the no-change line:\n%s", out)
+	}
+	if !strings.Contains(out, "warning: reload: session-cache-size/session-cache-file changed; restart untls to apply it") {
+		t.Errorf("log lacks the restart warning:\n%s", out)
+	}
+}
+
+// TestTunnelSet_ReloadDialSettings: a changed dial-timeout or
+// cert-expiry-warn reaches the tunnel's new definition, and the one live
+// connections were dialled with keeps its own.
+func TestTunnelSet_ReloadDialSettings(t *testing.T) {
+	logs := captureLog(t)
+	up := mustTestUpstream(t, says("up"))
+	tun := tunnelJSON("a", "127.0.0.1:0", up)
+	set := startTunnelSet(t, mustReloadConfig(t, configJSON(tun)))
+
+	set.mu.Lock()
+	rt := set.running["a"]
+	set.mu.Unlock()
+	before := rt.t.current()
+	set.reload(mustReloadConfig(t, `{"dial-timeout": "1m", "cert-expiry-warn": "0s", "tunnels": [`+tun+`]}`))
+
+	if got := rt.t.current(); got.dialLimit() != time.Minute || got.certExpiryWarn != 0 {
+		t.Fatalf("reloaded tunnel: dial-timeout %v, cert-expiry-warn %v", got.dialLimit(), got.certExpiryWarn)
+	}
+	if before.dialLimit() != defaultDialTimeout || before.certExpiryWarn != defaultCertExpiryWarn {
+		t.Fatalf("previous definition changed: dial-timeout %v, cert-expiry-warn %v", before.dialLimit(), before.certExpiryWarn)
+	}
+	for _, want := range []string{"info: reload: tunnel a: dial-timeout 10s -> 1m0s", "info: reload: tunnel a: cert-expiry-warn 336h0m0s -> 0s"} {
+		if !strings.Contains(logs(), want) {
+			t.Errorf("log lacks %q:\n%s", want, logs())
+		}
+	}
+	if strings.Contains(logs(), "restart untls") {
+		t.Errorf("dial settings reported as restart-only:\n%s", logs())
+	}
+}
+
+func TestTLSDiff(t *testing.T) {
+	a := tlsOptions{CAFiles: []string{"a.pem"}, ServerName: "x", ALPN: []string{"h2"}}
+	b := tlsOptions{CAFiles: []string{"b.pem"}, ALPN: []string{"h2"}, MinVersion: "1.2"}
+	if got, want := tlsDiff(a, b), []string{"ca-file", "sni", "tls-min"}; !slices.Equal(got, want) {
+		t.Fatalf("tlsDiff = %v, want %v", got, want)
+	}
+	if got := tlsDiff(a, a); len(got) != 0 {
+		t.Fatalf("tlsDiff(a, a) = %v", got)
+	}
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/crypto/ocsp"
+)
+
+// Revocation modes for -revocation.
+const (
+	revocationOff = "off"
+	// revocationSoft fails only on a definitive "revoked"; missing, stale or
+	// unparsable revocation data is logged and the connection proceeds.
+	revocationSoft = "soft"
+	// revocationHard additionally requires a current "good" answer for the
+	// leaf from a stapled OCSP response or a configured CRL.
+	revocationHard = "hard"
+)
+
+// revokedError is a definitive revocation, fatal in both modes.
+type revokedError struct {
+	cert   *x509.Certificate
+	source string
+	at     time.Time
+}
+
+func (e *revokedError) Error() string {
+	return fmt.Sprintf("revocation: upstream certificate %q (serial %s) was revoked at %s per %s",
+		e.cert.Subject.String(), e.cert.SerialNumber, e.at.UTC().Format(time.RFC3339), e.source)
+}
+
+// revocationWarning is what soft mode lets through. check returns it so
+// the dial path can log it under the connection's label; upstream.dial
+// takes it out of the handshake's way.
+type revocationWarning struct {
+	msg string
+}
+
+func (w *revocationWarning) Error() string {
+	return fmt.Sprintf("revocation: %s; continuing (-revocation %s)", w.msg, revocationSoft)
+}
+
+// revocationChecker checks a verified chain against the stapled OCSP
+// response and the configured CRLs. A SIGHUP reload sets up a new checker
+// from the refreshed CRL files.
+type revocationChecker struct {
+	mode  string
+	files []string
+	crls  atomic.Pointer[[]*x509.RevocationList]
+}
+
+func newRevocationChecker(mode string, files []string) (*revocationChecker, error) {
+	r := &revocationChecker{mode: mode, files: files}
+	if err := r.reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// reload reads the CRL files. On error the previous CRLs, if any, stay in
+// use.
+func (r *revocationChecker) reload() error {
+	var crls []*x509.RevocationList
+	for _, file := range r.files {
+		loaded, err := loadCRLFile(file)
+		if err != nil {
+			return err
+		}
+		crls = append(crls, loaded...)
+	}
+	r.crls.Store(&crls)
+	return nil
+}
+
+// loadCRLFile accepts PEM ("X509 CRL" blocks, possibly several) or DER.
+func loadCRLFile(file string) ([]*x509.RevocationList, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("read CRL: %w", err)
+	}
+	var ders [][]byte
+	for block, rest := pem.Decode(data); block != nil; block, rest = pem.Decode(rest) {
+		if block.Type == "X509 CRL" {
+			ders = append(ders, block.Bytes)
+		}
+	}
+	if len(ders) == 0 {
+		ders = [][]byte{data}
+	}
+	crls := make([]*x509.RevocationList, 0, len(ders))
+	for i, der := range ders {
+		crl, err := x509.ParseRevocationList(der)
+		if err != nil {
+			return nil, fmt.Errorf("CRL file %s: CRL #%d: %w", file, i+1, err)
+		}
+		crls = append(crls, crl)
+	}
+	return crls, nil
+}
+
+// check inspects the first of the verified chains (leaf first) for
+// revocation. With no chain there is nothing to check it against, which
+// hard mode must not take as a pass. In soft mode what it could not
+// confirm comes back as a *revocationWarning.
+func (r *revocationChecker) check(cs tls.ConnectionState, chains [][]*x509.Certificate) error {
+	if len(chains) == 0 {
+		if r.mode == revocationHard {
+			return errors.New("revocation: no verified chain to check the upstream certificate against")
+		}
+		return &revocationWarning{msg: "no verified chain to check"}
+	}
+	now := time.Now()
+	chain := chains[0]
+	leaf := chain[0]
+	var problems []string
+	leafKnown := false
+
+	if len(cs.OCSPResponse) > 0 && len(chain) > 1 {
+		resp, err := ocsp.ParseResponseForCert(cs.OCSPResponse, leaf, chain[1])
+		switch {
+		case err != nil:
+			problems = append(problems, fmt.Sprintf("stapled OCSP response: %s", err))
+		case resp.Status == ocsp.Revoked:
+			return &revokedError{cert: leaf, source: "stapled OCSP", at: resp.RevokedAt}
+		case resp.Status != ocsp.Good:
+			problems = append(problems, "stapled OCSP response: status unknown")
+		case !resp.NextUpdate.IsZero() && now.After(resp.NextUpdate):
+			problems = append(problems, fmt.Sprintf("stapled OCSP response expired at %s", resp.NextUpdate.UTC().Format(time.RFC3339)))
+		default:
+			leafKnown = true
+		}
+	}
+
+	for i := 0; i+1 < len(chain); i++ {
+		cert, issuer := chain[i], chain[i+1]
+		for _, crl := range *r.crls.Load() {
+			if !bytes.Equal(crl.RawIssuer, issuer.RawSubject) || crl.CheckSignatureFrom(issuer) != nil {
+				continue
+			}
+			if !crl.NextUpdate.IsZero() && now.After(crl.NextUpdate) {
+				problems = append(problems, fmt.Sprintf("CRL from %q expired at %s", issuer.Subject.String(), crl.NextUpdate.UTC().Format(time.RFC3339)))
+				continue
+			}
+			for _, entry := range crl.RevokedCertificateEntries {
+				if entry.SerialNumber.Cmp(cert.SerialNumber) == 0 {
+					return &revokedError{cert: cert, source: "CRL", at: entry.RevocationTime}
+				}
+			}
+			if i == 0 {
+				leafKnown = true
+			}
+		}
+	}
+
+	if leafKnown {
+		return nil
+	}
+	if r.mode == revocationHard {
+		if len(problems) == 0 {
+			problems = append(problems, "no stapled OCSP response and no -crl for its issuer")
+		}
+		return fmt.Errorf("revocation: cannot confirm upstream certificate %q is not revoked: %s",
+			leaf.Subject.String(), strings.Join(problems, "; "))
+	}
+	if len(problems) > 0 {
+		return &revocationWarning{msg: fmt.Sprintf("%q: %s", leaf.Subject.String(), strings.Join(problems, "; "))}
+	}
+	return nil
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ocsp"
+)
+
+// TestConnectUpstream_Revocation runs a local CA with a stand-in OCSP
+// responder (a staple signed by the CA) and CRLs through both modes.
+func TestConnectUpstream_Revocation(t *testing.T) {
+	ca := mustCA(t, "revocation-ca", nil)
+	leaf, key := ca.issue(t, serverLeafTemplate("revocation-leaf"))
+	otherCA := mustCA(t, "other-ca", nil)
+
+	good := mustOCSP(t, ca, leaf, ocsp.Good, time.Now().Add(time.Hour))
+	revoked := mustOCSP(t, ca, leaf, ocsp.Revoked, time.Now().Add(time.Hour))
+	staleGood := mustOCSP(t, ca, leaf, ocsp.Good, time.Now().Add(-time.Minute))
+	dir := t.TempDir()
+	cleanCRL := mustCRLFile(t, dir, "clean.pem", ca, nil, time.Now().Add(time.Hour), true)
+	listingCRL := mustCRLFile(t, dir, "listing.der", ca, leaf.SerialNumber, time.Now().Add(time.Hour), false)
+	staleCRL := mustCRLFile(t, dir, "stale.pem", ca, nil, time.Now().Add(-time.Minute), true)
+	foreignCRL := mustCRLFile(t, dir, "foreign.pem", otherCA, leaf.SerialNumber, time.Now().Add(time.Hour), true)
+
+	tests := []struct {
+		name        string
+		mode        string
+		staple      []byte
+		crls        []string
+		wantErr     string
+		wantRevoked bool
+		// wantWarn is in the soft-mode warning logged for the connection.
+		wantWarn string
+	}{
+		{name: "off ignores revoked staple", mode: revocationOff, staple: revoked},
+		{name: "soft without data", mode: revocationSoft},
+		{name: "hard without data", mode: revocationHard, wantErr: "no stapled OCSP response"},
+		{name: "hard good staple", mode: revocationHard, staple: good},
+		{name: "soft revoked staple", mode: revocationSoft, staple: revoked, wantRevoked: true},
+		{name: "hard revoked staple", mode: revocationHard, staple: revoked, wantRevoked: true},
+		{name: "soft stale staple", mode: revocationSoft, staple: staleGood, wantWarn: "OCSP response expired"},
+		{name: "hard stale staple", mode: revocationHard, staple: staleGood, wantErr: "OCSP response expired"},
+		{name: "hard garbage staple", mode: revocationHard, staple: []byte("junk"), wantErr: "stapled OCSP response"},
+		{name: "hard clean crl", mode: revocationHard, crls: []string{cleanCRL}},
+		{name: "soft listing crl", mode: revocationSoft, crls: []string{listingCRL}, wantRevoked: true},
+		{name: "hard listing crl beats good staple", mode: revocationHard, staple: good, crls: []string{listingCRL}, wantRevoked: true},
+		{name: "soft stale crl", mode: revocationSoft, crls: []string{staleCRL}, wantWarn: "CRL from"},
+		{name: "hard stale crl", mode: revocationHard, crls: []string{staleCRL}, wantErr: "CRL from"},
+		{name: "crl from another ca is ignored", mode: revocationHard, crls: []string{foreignCRL}, wantErr: "no stapled OCSP response"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			logs := captureLog(t)
+			ln := mustServeTLS(t, []*x509.Certificate{leaf, ca.cert}, key, func(c *tls.Config) {
+				c.Certificates[0].OCSPStaple = tt.staple
+			})
+			defer func() { _ = ln.Close() }()
+
+			opts := tlsOptions{Revocation: tt.mode, CRLFiles: tt.crls}
+			trustOnly(t, &opts, ca.cert)
+			cfg, err := opts.clientConfig("")
+			if err != nil {
+				t.Fatalf("clientConfig: %v", err)
+			}
+			withUpstreamTLS(t, cfg)
+
+			client, server := net.Pipe()
+			defer func() { _ = client.Close() }()
+			upstream, err := connectUpstream(t.Context(), server, testTunnel(ln.Addr().String()))
+			if err == nil {
+				_ = upstream.Close()
+			}
+			var re *revokedError
+			if got := errors.As(err, &re); got != tt.wantRevoked {
+				t.Fatalf("revoked=%v, want %v (err=%v)", got, tt.wantRevoked, err)
+			}
+			switch {
+			case tt.wantRevoked:
+			case tt.wantErr == "" && err != nil:
+				t.Fatalf("connectUpstream: %v", err)
+			case tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)):
+				t.Fatalf("err=%v, want %q", err, tt.wantErr)
+			}
+			warned := strings.Contains(logs(), "conn/pipe: warning: revocation: ")
+			if warned != (tt.wantWarn != "") || !strings.Contains(logs(), tt.wantWarn) {
+				t.Fatalf("want a conn/pipe warning about %q, log:\n%s", tt.wantWarn, logs())
+			}
+		})
+	}
+}
+
+// TestTunnelSet_ReloadCRL: a CRL refreshed on disk takes effect on reload.
+func TestTunnelSet_ReloadCRL(t *testing.T) {
+	logs := captureLog(t)
+	ca := mustCA(t, "revocation-ca", nil)
+	leaf, key := ca.issue(t, serverLeafTemplate("revocation-leaf"))
+	ln := mustServeTLS(t, []*x509.Certificate{leaf, ca.cert}, key, nil)
+	defer func() { _ = ln.Close() }()
+	dir := t.TempDir()
+	crl := mustCRLFile(t, dir, "ca.crl", ca, nil, time.Now().Add(time.Hour), true)
+
+	body := configJSON(fmt.Sprintf(`{"name": "a", "listen": "127.0.0.1:0", "remote": %q, "tls": {"ca-file": [%q], "no-system-ca": true, "revocation": "hard", "crl": [%q]}}`,
+		ln.Addr().String(), writeTrustFile(t, ca.cert), crl))
+	set := startTunnelSet(t, mustReloadConfig(t, body))
+	path := writeConfig(t, body)
+
+	c := dialTunnel(t, set, "a")
+	echo(t, c, bufio.NewReader(c), "clean CRL")
+
+	mustCRLFile(t, dir, "ca.crl", ca, leaf.SerialNumber, time.Now().Add(time.Hour), true)
+	if err := sighup(t, set, path); err != nil {
+		t.Fatalf("reload: %v", err)
+	}
+	c = dialTunnel(t, set, "a")
+	if _, err := c.Read(make([]byte, 1)); err == nil {
+		t.Fatal("revoked upstream was proxied after reload")
+	}
+	if !strings.Contains(logs(), "was revoked") {
+		t.Fatalf("revocation after reload not logged:\n%s", logs())
+	}
+}
+
+func TestTLSOptions_RevocationValidation(t *testing.T) {
+	dir := t.TempDir()
+	junk := filepath.Join(dir, "junk.crl")
+	if err := os.WriteFile(junk, []byte("not a crl"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	pinned := "spki-sha256:" + strings.Repeat("ab", 32)
+	tests := []struct {
+		opts    tlsOptions
+		wantSub string
+	}{
+		{opts: tlsOptions{Revocation: "strict"}, wantSub: "invalid -revocation"},
+		{opts: tlsOptions{CRLFiles: []string{junk}}, wantSub: "-crl needs -revocation"},
+		{opts: tlsOptions{Revocation: revocationSoft, PinMode: pinModeReplace, Pins: []string{pinned}}, wantSub: "verified chain"},
+		{opts: tlsOptions{Revocation: revocationHard, TOFUFile: filepath.Join(dir, "p.json")}, wantSub: "verified chain"},
+		{opts: tlsOptions{Revocation: revocationHard, CRLFiles: []string{junk}}, wantSub: "junk.crl"},
+		{opts: tlsOptions{Revocation: revocationHard, CRLFiles: []string{filepath.Join(dir, "missing.crl")}}, wantSub: "read CRL"},
+	}
+	for _, tt := range tests {
+		if _, err := tt.opts.clientConfig(""); err == nil || !strings.Contains(err.Error(), tt.wantSub) {
+			t.Fatalf("%+v: err=%v, want %q", tt.opts, err, tt.wantSub)
+		}
+	}
+}
+
+// TestRevocationChecker_NoChain: with no verified chain to check, hard mode
+// fails closed and soft mode only warns.
+func TestRevocationChecker_NoChain(t *testing.T) {
+	captureLog(t)
+	leaf, _ := mustCert(t, serverLeafTemplate("up"), nil, nil)
+	cs := tls.ConnectionState{PeerCertificates: []*x509.Certificate{leaf}}
+	hard := &peerVerifier{revocation: &revocationChecker{mode: revocationHard}}
+	if err := hard.verifyConnection(cs); err == nil || !strings.Contains(err.Error(), "no verified chain") {
+		t.Fatalf("hard: err=%v, want a no verified chain error", err)
+	}
+	soft := &peerVerifier{revocation: &revocationChecker{mode: revocationSoft}}
+	var w *revocationWarning
+	if err := soft.verifyConnection(cs); !errors.As(err, &w) {
+		t.Fatalf("soft: err=%v, want a revocationWarning", err)
+	}
+}
+
+// mustOCSP is the OCSP responder stand-in: a response for leaf signed
+// directly by its issuing CA, as a server would staple it.
+func mustOCSP(t *testing.T, ca *testCA, leaf *x509.Certificate, status int, nextUpdate time.Time) []byte {
+	t.Helper()
+	tmpl := ocsp.Response{
+		Status:       status,
+		SerialNumber: leaf.SerialNumber,
+		ThisUpdate:   time.Now().Add(-time.Hour),
+		NextUpdate:   nextUpdate,
+	}
+	if status == ocsp.Revoked {
+		tmpl.RevokedAt = time.Now().Add(-30 * time.Minute)
+		tmpl.RevocationReason = ocsp.KeyCompromise
+	}
+	der, err := ocsp.CreateResponse(ca.cert, ca.cert, tmpl, ca.key)
+	if err != nil {
+		t.Fatalf("create OCSP response: %v", err)
+	}
+	return der
+}
+
+// mustCRLFile writes a CRL from ca, listing serial when non-nil, as PEM or
+// DER, and returns its path.
+func mustCRLFile(t *testing.T, dir, name string, ca *testCA, serial *big.Int, nextUpdate time.Time, asPEM bool) string {
+	t.Helper()
+	tmpl := &x509.RevocationList{
+		Number:     big.NewInt(time.Now().UnixNano()),
+		ThisUpdate: time.Now().Add(-time.Hour),
+		NextUpdate: nextUpdate,
+	}
+	if serial != nil {
+		tmpl.RevokedCertificateEntries = []x509.RevocationListEntry{{SerialNumber: serial, RevocationTime: time.Now().Add(-30 * time.Minute)}}
+	}
+	der, err := x509.CreateRevocationList(rand.Reader, tmpl, ca.cert, ca.key)
+	if err != nil {
+		t.Fatalf("create CRL: %v", err)
+	}
+	if asPEM {
+		der = pem.EncodeToMemory(&pem.Block{Type: "X509 CRL", Bytes: der})
+	}
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, der, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
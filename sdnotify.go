@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// notifier sends sd_notify(3) messages to systemd for Type=notify units. A
+// nil *notifier (no NOTIFY_SOCKET) drops them, so callers need no checks.
+type notifier struct {
+	conn *net.UnixConn
+	// watchdog is how often systemd expects WATCHDOG=1 (half WATCHDOG_USEC);
+	// 0 when the unit has no WatchdogSec=.
+	watchdog time.Duration
+}
+
+// statusInterval bounds how often STATUS= is refreshed while connection
+// counts change. Overridable in tests.
+var statusInterval = 2 * time.Second
+
+// newNotifier connects to NOTIFY_SOCKET and reads the watchdog settings. The
+// variables are cleared so processes we start do not talk to systemd on our
+// behalf. It returns nil, nil outside systemd.
+func newNotifier() (*notifier, error) {
+	addr := os.Getenv("NOTIFY_SOCKET")
+	usec := os.Getenv("WATCHDOG_USEC")
+	pid := os.Getenv("WATCHDOG_PID")
+	for _, v := range []string{"NOTIFY_SOCKET", "WATCHDOG_USEC", "WATCHDOG_PID"} {
+		_ = os.Unsetenv(v)
+	}
+	if addr == "" {
+		return nil, nil
+	}
+	// "@name" is an abstract socket; net maps the leading @ to a NUL byte.
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: addr, Net: "unixgram"})
+	if err != nil {
+		return nil, fmt.Errorf("NOTIFY_SOCKET %s: %w", addr, err)
+	}
+	n := &notifier{conn: conn}
+	if usec != "" && (pid == "" || pid == strconv.Itoa(os.Getpid())) {
+		us, err := strconv.ParseInt(usec, 10, 64)
+		if err != nil || us <= 0 {
+			_ = conn.Close()
+			return nil, fmt.Errorf("invalid WATCHDOG_USEC %q", usec)
+		}
+		// Ping at half the timeout, as sd_watchdog_enabled(3) recommends.
+		n.watchdog = time.Duration(us) * time.Microsecond / 2
+	}
+	return n, nil
+}
+
+// notify sends one message made of the given VAR=value lines.
+func (n *notifier) notify(state ...string) {
+	if n == nil {
+		return
+	}
+	if _, err := n.conn.Write([]byte(strings.Join(state, "\n"))); err != nil {
+		log.Printf("error/notify: %s: %s", strings.Join(state, " "), err)
+	}
+}
+
+// run pings the watchdog and keeps STATUS= current until ctx is done.
+// status is polled every statusInterval and sent only when it differs from
+// last, the STATUS= already sent (with READY=1).
+func (n *notifier) run(ctx context.Context, last string, status func() string) {
+	if n == nil {
+		return
+	}
+	var watchdog <-chan time.Time
+	if n.watchdog > 0 {
+		t := time.NewTicker(n.watchdog)
+		defer t.Stop()
+		watchdog = t.C
+	}
+	refresh := time.NewTicker(statusInterval)
+	defer refresh.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-watchdog:
+			n.notify("WATCHDOG=1")
+		case <-refresh.C:
+			if s := status(); s != last {
+				n.notify("STATUS=" + s)
+				last = s
+			}
+		}
+	}
+}
+
+func (n *notifier) Close() error {
+	if n == nil {
+		return nil
+	}
+	return n.conn.Close()
+}
+
+// statusLine is the STATUS= text systemctl status shows.
+func statusLine(tunnels int, conns int64) string {
+	return fmt.Sprintf("%d tunnel(s), %d active connection(s)", tunnels, conns)
+}
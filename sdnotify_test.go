@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fakeNotifySocket stands in for systemd: a datagram socket NOTIFY_SOCKET
+// points at. Messages arrive on the returned channel.
+func fakeNotifySocket(t *testing.T) <-chan string {
+	t.Helper()
+	path := filepath.Join(shortSocketDir(t), "notify")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		t.Fatalf("listen unixgram: %v", err)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+	t.Setenv("NOTIFY_SOCKET", path)
+	msgs := make(chan string, 64)
+	go func() {
+		buf := make([]byte, 4096)
+		for {
+			n, err := conn.Read(buf)
+			if err != nil {
+				return
+			}
+			msgs <- string(buf[:n])
+		}
+	}()
+	return msgs
+}
+
+func nextNotify(t *testing.T, msgs <-chan string) string {
+	t.Helper()
+	select {
+	case m := <-msgs:
+		return m
+	case <-time.After(2 * time.Second):
+		t.Fatal("no sd_notify message")
+		return ""
+	}
+}
+
+func TestNotifier(t *testing.T) {
+	msgs := fakeNotifySocket(t)
+	t.Setenv("WATCHDOG_USEC", "40000")
+	t.Setenv("WATCHDOG_PID", strconv.Itoa(os.Getpid()))
+	old := statusInterval
+	statusInterval = 5 * time.Millisecond
+	t.Cleanup(func() { statusInterval = old })
+
+	n, err := newNotifier()
+	if err != nil || n == nil {
+		t.Fatalf("newNotifier: %v, %v", n, err)
+	}
+	defer func() { _ = n.Close() }()
+	for _, v := range []string{"NOTIFY_SOCKET", "WATCHDOG_USEC", "WATCHDOG_PID"} {
+		if _, ok := os.LookupEnv(v); ok {
+			t.Errorf("%s still set", v)
+		}
+	}
+	if n.watchdog != 20*time.Millisecond {
+		t.Fatalf("watchdog interval = %v, want half of WATCHDOG_USEC", n.watchdog)
+	}
+
+	ready := statusLine(1, 0)
+	n.notify("READY=1", "STATUS="+ready)
+	if got := nextNotify(t, msgs); got != "READY=1\nSTATUS=1 tunnel(s), 0 active connection(s)" {
+		t.Fatalf("ready message = %q", got)
+	}
+
+	var conns atomic.Int64
+	ctx, cancel := context.WithCancel(t.Context())
+	done := make(chan struct{})
+	go func() {
+		n.run(ctx, ready, func() string { return statusLine(1, conns.Load()) })
+		close(done)
+	}()
+	// Two watchdog pings span several status polls; the unchanged status
+	// sent with READY=1 must not be repeated in between.
+	for range 2 {
+		if m := nextNotify(t, msgs); m != "WATCHDOG=1" {
+			t.Fatalf("unexpected message %q before the status changed", m)
+		}
+	}
+	conns.Store(3)
+	var sawWatchdog, sawStatus bool
+	for deadline := time.Now().Add(2 * time.Second); !(sawWatchdog && sawStatus) && time.Now().Before(deadline); {
+		switch m := nextNotify(t, msgs); {
+		case m == "WATCHDOG=1":
+			sawWatchdog = true
+		case m == "STATUS=1 tunnel(s), 3 active connection(s)":
+			sawStatus = true
+		}
+	}
+	if !sawWatchdog || !sawStatus {
+		t.Fatalf("watchdog=%v status=%v", sawWatchdog, sawStatus)
+	}
+	cancel()
+	<-done
+
+	n.notify("STOPPING=1")
+	for m := nextNotify(t, msgs); m != "STOPPING=1"; m = nextNotify(t, msgs) {
+		if m != "WATCHDOG=1" {
+			t.Fatalf("unexpected message %q before STOPPING=1", m)
+		}
+	}
+}
+
+func TestNotifier_Disabled(t *testing.T) {
+	t.Setenv("NOTIFY_SOCKET", "")
+	n, err := newNotifier()
+	if n != nil || err != nil {
+		t.Fatalf("newNotifier without NOTIFY_SOCKET = %v, %v", n, err)
+	}
+	// A nil notifier is a no-op.
+	n.notify("READY=1")
+	n.run(t.Context(), "", func() string { return "" })
+	if err := n.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestNotifier_WatchdogForOtherPID(t *testing.T) {
+	fakeNotifySocket(t)
+	t.Setenv("WATCHDOG_USEC", "1000000")
+	t.Setenv("WATCHDOG_PID", "1")
+	n, err := newNotifier()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = n.Close() }()
+	if n.watchdog != 0 {
+		t.Fatalf("watchdog enabled for another PID: %v", n.watchdog)
+	}
+}
+
+func TestNotifier_BadWatchdog(t *testing.T) {
+	fakeNotifySocket(t)
+	t.Setenv("WATCHDOG_USEC", "soon")
+	if _, err := newNotifier(); err == nil || !strings.Contains(err.Error(), "WATCHDOG_USEC") {
+		t.Fatalf("err=%v", err)
+	}
+}
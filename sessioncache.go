@@ -0,0 +1,215 @@
+package main
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// upstreamSessions is the session store behind every upstream dial, or nil
+// when resumption is disabled. main sets it up from the flags; each tunnel
+// upstream dials through its own scoped view of it.
+var upstreamSessions *sessionCache
+
+// sessionTicketMaxAge bounds how long persisted tickets are kept. TLS 1.3
+// caps ticket lifetime at 7 days (RFC 8446 §4.6.1); older ones are useless.
+const sessionTicketMaxAge = 7 * 24 * time.Hour
+
+// sessionCache is a tls.ClientSessionCache that counts lookups and can
+// persist its sessions to a file so resumption survives restarts.
+type sessionCache struct {
+	lru      tls.ClientSessionCache
+	capacity int
+
+	hits, misses, resumed atomic.Uint64
+
+	// path is the persistence file, or "" for memory only. saved mirrors the
+	// LRU in serialized form because ClientSessionCache cannot be iterated.
+	path  string
+	mu    sync.Mutex
+	saved map[string]savedSession
+}
+
+// savedSession is one persisted session (see tls.ClientSessionState.ResumptionState).
+type savedSession struct {
+	Ticket []byte    `json:"ticket"`
+	State  []byte    `json:"state"`
+	Stored time.Time `json:"stored"`
+}
+
+func newSessionCache(capacity int, path string) (*sessionCache, error) {
+	c := &sessionCache{
+		lru:      tls.NewLRUClientSessionCache(capacity),
+		capacity: capacity,
+		path:     path,
+		saved:    map[string]savedSession{},
+	}
+	if path == "" {
+		return c, nil
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return c, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("read session cache: %w", err)
+	}
+	var saved map[string]savedSession
+	if err := json.Unmarshal(data, &saved); err != nil {
+		return nil, fmt.Errorf("parse session cache %s: %w", path, err)
+	}
+	// Restore lazily in Get: parsing needs nothing from the config, but a
+	// stale or undecodable entry should just be a miss, not a startup error.
+	for key, s := range saved {
+		if time.Since(s.Stored) < sessionTicketMaxAge {
+			c.saved[key] = s
+		}
+	}
+	return c, nil
+}
+
+func (c *sessionCache) Get(key string) (*tls.ClientSessionState, bool) {
+	if cs, ok := c.lru.Get(key); ok {
+		c.hits.Add(1)
+		return cs, true
+	}
+	if cs := c.restore(key); cs != nil {
+		c.lru.Put(key, cs)
+		c.hits.Add(1)
+		return cs, true
+	}
+	c.misses.Add(1)
+	return nil, false
+}
+
+func (c *sessionCache) Put(key string, cs *tls.ClientSessionState) {
+	c.lru.Put(key, cs)
+	if c.path == "" {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if cs == nil {
+		delete(c.saved, key)
+		return
+	}
+	ticket, state, err := cs.ResumptionState()
+	if err != nil || state == nil {
+		return
+	}
+	b, err := state.Bytes()
+	if err != nil {
+		return
+	}
+	c.saved[key] = savedSession{Ticket: ticket, State: b, Stored: time.Now().UTC()}
+}
+
+// restore rebuilds a persisted session that is not in the LRU yet.
+func (c *sessionCache) restore(key string) *tls.ClientSessionState {
+	c.mu.Lock()
+	s, ok := c.saved[key]
+	c.mu.Unlock()
+	if !ok || time.Since(s.Stored) >= sessionTicketMaxAge {
+		return nil
+	}
+	state, err := tls.ParseSessionState(s.State)
+	if err != nil {
+		return nil
+	}
+	cs, err := tls.NewResumptionState(s.Ticket, state)
+	if err != nil {
+		return nil
+	}
+	return cs
+}
+
+// scoped is the view of c a tunnel's dials to addr use. crypto/tls keys
+// sessions by ServerName alone, so without the scope tunnels with different
+// TLS settings (another client certificate) would resume each other's
+// sessions, and upstreams on one host but different ports would overwrite
+// each other's tickets.
+func (c *sessionCache) scoped(tunnel, addr string) tls.ClientSessionCache {
+	// Names and addresses hold no spaces, so the prefix is unambiguous.
+	return scopedSessions{cache: c, prefix: tunnel + " " + addr + " "}
+}
+
+type scopedSessions struct {
+	cache  *sessionCache
+	prefix string
+}
+
+func (s scopedSessions) Get(key string) (*tls.ClientSessionState, bool) {
+	return s.cache.Get(s.prefix + key)
+}
+
+func (s scopedSessions) Put(key string, cs *tls.ClientSessionState) {
+	s.cache.Put(s.prefix+key, cs)
+}
+
+// observe records whether a completed handshake resumed a session.
+func (c *sessionCache) observe(cs tls.ConnectionState) {
+	if cs.DidResume {
+		c.resumed.Add(1)
+	}
+}
+
+// stats is the "cache hits=.. misses=.. resumed=.." log suffix. A hit means
+// a ticket was offered; resumed counts the ones the upstream accepted.
+func (c *sessionCache) stats() string {
+	return fmt.Sprintf("hits=%d misses=%d resumed=%d", c.hits.Load(), c.misses.Load(), c.resumed.Load())
+}
+
+// save writes the persisted sessions (newest capacity entries) atomically.
+// The file holds resumption secrets, so it is owner-only.
+func (c *sessionCache) save() error {
+	if c.path == "" {
+		return nil
+	}
+	c.mu.Lock()
+	keys := make([]string, 0, len(c.saved))
+	for k := range c.saved {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool { return c.saved[keys[i]].Stored.After(c.saved[keys[j]].Stored) })
+	out := map[string]savedSession{}
+	for i, k := range keys {
+		if i >= c.capacity {
+			break
+		}
+		out[k] = c.saved[k]
+	}
+	c.mu.Unlock()
+
+	data, err := json.Marshal(out)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(c.path), ".sessions-*")
+	if err != nil {
+		return fmt.Errorf("write session cache: %w", err)
+	}
+	defer func() { _ = os.Remove(tmp.Name()) }()
+	if err := tmp.Chmod(0o600); err != nil {
+		_ = tmp.Close()
+		return fmt.Errorf("write session cache: %w", err)
+	}
+	if _, err := tmp.Write(data); err != nil {
+		_ = tmp.Close()
+		return fmt.Errorf("write session cache: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("write session cache: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), c.path); err != nil {
+		return fmt.Errorf("write session cache: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"io"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestConnectUpstream_SessionResumption: the second dial to the same
+// upstream resumes the first one's session, and the per-connection log line
+// says so with the cache counters.
+func TestConnectUpstream_SessionResumption(t *testing.T) {
+	leaf, key := mustCert(t, serverLeafTemplate("resume"), nil, nil)
+	ln := mustServeTLS(t, []*x509.Certificate{leaf}, key, nil)
+	defer func() { _ = ln.Close() }()
+
+	cache, err := newSessionCache(8, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	withSessionCache(t, cache)
+	var opts tlsOptions
+	trustOnly(t, &opts, leaf)
+	cfg, err := opts.clientConfig("")
+	if err != nil {
+		t.Fatalf("clientConfig: %v", err)
+	}
+	withUpstreamTLS(t, opts.configFor(cfg, "", ln.Addr().String()))
+
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+
+	if resumed := dialEchoResumed(t, ln.Addr().String()); resumed {
+		t.Fatal("first dial cannot resume")
+	}
+	if resumed := dialEchoResumed(t, ln.Addr().String()); !resumed {
+		t.Fatal("second dial did not resume")
+	}
+	if got, want := cache.stats(), "hits=1 misses=1 resumed=1"; got != want {
+		t.Fatalf("stats=%q, want %q", got, want)
+	}
+	logs := buf.String()
+	if !strings.Contains(logs, "resumed=false") || !strings.Contains(logs, "session-cache(hits=0 misses=1 resumed=0)") ||
+		!strings.Contains(logs, "resumed=true") || !strings.Contains(logs, "session-cache(hits=1 misses=1 resumed=1)") {
+		t.Fatalf("log=%q, want full handshake then resumed lines", logs)
+	}
+}
+
+// TestSessionCache_Persistence: sessions saved by one cache (one process)
+// let a fresh cache loaded from the same file resume.
+func TestSessionCache_Persistence(t *testing.T) {
+	leaf, key := mustCert(t, serverLeafTemplate("resume"), nil, nil)
+	ln := mustServeTLS(t, []*x509.Certificate{leaf}, key, nil)
+	defer func() { _ = ln.Close() }()
+	path := filepath.Join(t.TempDir(), "sessions.json")
+
+	dialWith := func(cache *sessionCache) bool {
+		withSessionCache(t, cache)
+		var opts tlsOptions
+		trustOnly(t, &opts, leaf)
+		cfg, err := opts.clientConfig("")
+		if err != nil {
+			t.Fatalf("clientConfig: %v", err)
+		}
+		withUpstreamTLS(t, opts.configFor(cfg, "", ln.Addr().String()))
+		return dialEchoResumed(t, ln.Addr().String())
+	}
+
+	first, err := newSessionCache(8, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dialWith(first) {
+		t.Fatal("first dial cannot resume")
+	}
+	if err := first.save(); err != nil {
+		t.Fatalf("save: %v", err)
+	}
+	if runtime.GOOS != "windows" {
+		fi, err := os.Stat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if perm := fi.Mode().Perm(); perm != 0o600 {
+			t.Fatalf("session cache mode %o, want 600", perm)
+		}
+	}
+
+	restarted, err := newSessionCache(8, path)
+	if err != nil {
+		t.Fatalf("reload: %v", err)
+	}
+	if !dialWith(restarted) {
+		t.Fatal("dial after restart did not resume from the persisted session")
+	}
+}
+
+// TestSessionCache_Scoped: sessions are kept apart per tunnel and per dial
+// address, though crypto/tls only keys them by server name.
+func TestSessionCache_Scoped(t *testing.T) {
+	c, err := newSessionCache(8, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.scoped("a", "up:443").Put("up", &tls.ClientSessionState{})
+	if _, ok := c.scoped("a", "up:443").Get("up"); !ok {
+		t.Fatal("session not found in its own scope")
+	}
+	if _, ok := c.scoped("b", "up:443").Get("up"); ok {
+		t.Fatal("another tunnel resumed the session")
+	}
+	if _, ok := c.scoped("a", "up:8443").Get("up"); ok {
+		t.Fatal("another port of the same host resumed the session")
+	}
+}
+
+func TestSessionCache_LoadFile(t *testing.T) {
+	dir := t.TempDir()
+	corrupt := filepath.Join(dir, "corrupt.json")
+	if err := os.WriteFile(corrupt, []byte("{"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := newSessionCache(8, corrupt); err == nil || !strings.Contains(err.Error(), corrupt) {
+		t.Fatalf("err=%v, want parse error naming the file", err)
+	}
+
+	c, err := newSessionCache(8, filepath.Join(dir, "missing.json"))
+	if err != nil || len(c.saved) != 0 {
+		t.Fatalf("missing file: cache=%v err=%v, want empty cache", c, err)
+	}
+
+	stale := filepath.Join(dir, "stale.json")
+	data, _ := json.Marshal(map[string]savedSession{
+		"old":     {Ticket: []byte("t"), State: []byte("s"), Stored: time.Now().Add(-sessionTicketMaxAge - time.Hour)},
+		"garbage": {Ticket: []byte("t"), State: []byte("s"), Stored: time.Now()},
+	})
+	if err := os.WriteFile(stale, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	c, err = newSessionCache(8, stale)
+	if err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	if _, ok := c.saved["old"]; ok {
+		t.Fatal("expired session was loaded")
+	}
+	// An undecodable entry is a miss, not a crash.
+	if _, ok := c.Get("garbage"); ok {
+		t.Fatal("garbage session state should not be returned")
+	}
+}
+
+func withSessionCache(t *testing.T, c *sessionCache) {
+	t.Helper()
+	old := upstreamSessions
+	upstreamSessions = c
+	t.Cleanup(func() { upstreamSessions = old })
+}
+
+// dialEchoResumed dials through connectUpstream, round-trips one byte so a
+// TLS 1.3 ticket has been read, and reports whether the session resumed.
+func dialEchoResumed(t *testing.T, addr string) bool {
+	t.Helper()
+	client, server := net.Pipe()
+	defer func() { _ = client.Close() }()
+	upstream, err := connectUpstream(t.Context(), server, testTunnel(addr))
+	if err != nil {
+		t.Fatalf("connectUpstream: %v", err)
+	}
+	defer func() { _ = upstream.Close() }()
+	_ = upstream.SetDeadline(time.Now().Add(2 * time.Second))
+	if _, err := upstream.Write([]byte("x")); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if _, err := io.ReadFull(upstream, make([]byte, 1)); err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	return upstream.(*tls.Conn).ConnectionState().DidResume
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// stdioConn is stdin and stdout as the downstream net.Conn, so the usual
+// serveConn/handleConn path bridges them. Deadlines are not supported.
+type stdioConn struct {
+	in     io.ReadCloser
+	out    io.WriteCloser
+	once   sync.Once
+	closed chan struct{}
+}
+
+func newStdioConn(in io.ReadCloser, out io.WriteCloser) *stdioConn {
+	return &stdioConn{in: in, out: out, closed: make(chan struct{})}
+}
+
+func (c *stdioConn) Read(p []byte) (int, error)  { return c.in.Read(p) }
+func (c *stdioConn) Write(p []byte) (int, error) { return c.out.Write(p) }
+
+// Close closes stdout, which is the EOF ssh waits for, and stdin.
+func (c *stdioConn) Close() error {
+	var err error
+	c.once.Do(func() {
+		err = errors.Join(c.out.Close(), c.in.Close())
+		close(c.closed)
+	})
+	return err
+}
+
+func (c *stdioConn) LocalAddr() net.Addr              { return stdioAddr{} }
+func (c *stdioConn) RemoteAddr() net.Addr             { return stdioAddr{} }
+func (c *stdioConn) SetDeadline(time.Time) error      { return nil }
+func (c *stdioConn) SetReadDeadline(time.Time) error  { return nil }
+func (c *stdioConn) SetWriteDeadline(time.Time) error { return nil }
+
+type stdioAddr struct{}
+
+func (stdioAddr) Network() string { return "stdio" }
+func (stdioAddr) String() string  { return "stdio" }
+
+// stdioTunnel picks the tunnel -stdio serves from cfg: there is no
+// listener, so listen flags are a mistake and only one tunnel makes sense.
+// A -config file is refused too: every tunnel in it has a listen address,
+// and -stdio would silently leave it unbound.
+func stdioTunnel(cfg *config) (*tunnel, error) {
+	if cfg.listenFlags {
+		return nil, errors.New("-stdio does not listen; drop -l/-listen")
+	}
+	t, err := cfg.singleTunnel("-stdio")
+	if err != nil {
+		return nil, err
+	}
+	if cfg.file != "" {
+		return nil, fmt.Errorf("-stdio does not listen, but %s gives tunnel %s listen %s; use -t instead of -config", cfg.file, displayName(t), t.listen)
+	}
+	return t, nil
+}
+
+// serveStdio bridges c with t's upstream and returns once the session is
+// over: when serveConn returns, or as soon as c is closed, since a Read
+// blocked on stdin does not end when stdin is closed.
+func serveStdio(c *stdioConn, t *tunnel) {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		serveConn(ctx, c, t)
+	}()
+	select {
+	case <-done:
+		return
+	case <-ctx.Done():
+		_ = c.Close()
+	case <-c.closed:
+	}
+	// handleConn is closing the upstream and logging the disconnect; let it,
+	// but do not wait on a stdin Read that may never return.
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+	}
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// blockedStdin never returns from Read, even after Close, like a terminal
+// or pipe stdin nobody writes to.
+type blockedStdin struct{ unblock chan struct{} }
+
+func (b blockedStdin) Read([]byte) (int, error) { <-b.unblock; return 0, io.EOF }
+func (b blockedStdin) Close() error             { return nil }
+
+// TestServeStdio_Echo: bytes from stdin reach the upstream and its answers
+// come out on stdout; EOF on stdin ends the session and closes stdout.
+func TestServeStdio_Echo(t *testing.T) {
+	up := mustTestUpstream(t, nil)
+	tun := mustSetupTunnel(t, &tunnel{remote: up.addr}, up.cert)
+
+	inR, inW := io.Pipe()
+	outR, outW := io.Pipe()
+	done := make(chan struct{})
+	go func() {
+		serveStdio(newStdioConn(inR, outW), tun)
+		close(done)
+	}()
+
+	if _, err := inW.Write([]byte("SSH-2.0-test\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	line, err := bufio.NewReader(outR).ReadString('\n')
+	if err != nil || line != "SSH-2.0-test\r\n" {
+		t.Fatalf("stdout = %q, %v", line, err)
+	}
+	_ = inW.Close()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("serveStdio did not return on stdin EOF")
+	}
+	if _, err := outR.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("stdout not closed: %v", err)
+	}
+}
+
+// TestServeStdio_UpstreamCloses: when the upstream hangs up, stdout is closed
+// and serveStdio returns even though a stdin Read is still blocked.
+func TestServeStdio_UpstreamCloses(t *testing.T) {
+	up, cert := mustSelfSignedTLSListener(t)
+	defer func() { _ = up.Close() }()
+	go func() {
+		c, err := up.Accept()
+		if err != nil {
+			return
+		}
+		_, _ = c.Write([]byte("bye\n"))
+		_ = c.Close()
+	}()
+	tun := mustSetupTunnel(t, &tunnel{remote: up.Addr().String()}, cert)
+
+	stdin := blockedStdin{unblock: make(chan struct{})}
+	defer close(stdin.unblock)
+	outR, outW := io.Pipe()
+	done := make(chan struct{})
+	go func() {
+		serveStdio(newStdioConn(stdin, outW), tun)
+		close(done)
+	}()
+	got, err := io.ReadAll(outR)
+	if err != nil || string(got) != "bye\n" {
+		t.Fatalf("stdout = %q, %v", got, err)
+	}
+	select {
+	case <-done:
+	case <-time.After(3 * time.Second):
+		t.Fatal("serveStdio did not return after the upstream closed")
+	}
+}
+
+func TestServeStdio_DialFailure(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tun := testTunnel(ln.Addr().String())
+	_ = ln.Close()
+
+	stdin := blockedStdin{unblock: make(chan struct{})}
+	defer close(stdin.unblock)
+	outR, outW := io.Pipe()
+	done := make(chan struct{})
+	go func() {
+		serveStdio(newStdioConn(stdin, outW), tun)
+		close(done)
+	}()
+	if _, err := io.ReadAll(outR); err != nil {
+		t.Fatalf("stdout: %v", err)
+	}
+	select {
+	case <-done:
+	case <-time.After(3 * time.Second):
+		t.Fatal("serveStdio did not return after a failed dial")
+	}
+}
+
+func TestStdioTunnel(t *testing.T) {
+	one := &config{tunnels: []*tunnel{{remote: "a:443"}}}
+	if tun, err := stdioTunnel(one); err != nil || tun != one.tunnels[0] {
+		t.Fatalf("stdioTunnel = %v, %v", tun, err)
+	}
+	two := &config{tunnels: []*tunnel{{remote: "a:443"}, {remote: "b:443"}}}
+	if _, err := stdioTunnel(two); err == nil || !strings.Contains(err.Error(), "-stdio serves a single -t, got 2") {
+		t.Fatalf("several tunnels: err=%v", err)
+	}
+	if _, err := stdioTunnel(&config{tunnels: one.tunnels, listenFlags: true}); err == nil || !strings.Contains(err.Error(), "does not listen") {
+		t.Fatalf("-l with -stdio: err=%v", err)
+	}
+}
+
+// TestStdioTunnel_Config: -stdio refuses a -config file, whose tunnels all
+// have a listen address it would not bind.
+func TestStdioTunnel_Config(t *testing.T) {
+	tests := []struct {
+		name    string
+		tunnels []*tunnel
+		want    string
+	}{
+		{
+			name: "several tunnels",
+			tunnels: []*tunnel{
+				{name: "a", listen: "127.0.0.1:8080", remote: "a:443"},
+				{name: "b", listen: "127.0.0.1:8081", remote: "b:443"},
+			},
+			want: "-stdio needs a config with exactly one tunnel; untls.json has 2",
+		},
+		{
+			name:    "listen present",
+			tunnels: []*tunnel{{name: "a", listen: "127.0.0.1:8080", remote: "a:443"}},
+			want:    "-stdio does not listen, but untls.json gives tunnel a listen 127.0.0.1:8080; use -t instead of -config",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			logs := captureLog(t)
+			tun, err := stdioTunnel(&config{tunnels: tt.tunnels, file: "untls.json"})
+			if err == nil || err.Error() != tt.want {
+				t.Fatalf("stdioTunnel = %v, %v; want error %q", tun, err, tt.want)
+			}
+			if out := logs(); out != "" {
+				t.Fatalf("unexpected log output:\n%s", out)
+			}
+		})
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// sdListenFdsStart is SD_LISTEN_FDS_START: systemd passes its sockets on
+// consecutive descriptors from here.
+const sdListenFdsStart = 3
+
+// listenFdsStart is sdListenFdsStart; tests move it off FD 3, which the Go
+// runtime may already be using.
+var listenFdsStart = sdListenFdsStart
+
+// socketActivated is set once main adopted the sockets systemd passed. Reloads
+// then cannot bind new listeners: the unit owns the listen addresses.
+var socketActivated bool
+
+// systemdSocket is one listening socket passed by systemd, named after its
+// FileDescriptorName= (the socket unit name by default).
+type systemdSocket struct {
+	fd   int
+	name string
+	ln   net.Listener
+}
+
+// systemdActivated reports whether systemd passed us listening sockets.
+func systemdActivated() bool {
+	return os.Getenv("LISTEN_PID") == strconv.Itoa(os.Getpid())
+}
+
+// listenFDs adopts the sockets described by LISTEN_FDS and LISTEN_FDNAMES,
+// as sd_listen_fds_with_names does. Every descriptor must be a listening
+// stream socket. The LISTEN_* variables are cleared either way so processes
+// we start do not mistake our sockets for theirs.
+func listenFDs() ([]systemdSocket, error) {
+	defer func() {
+		_ = os.Unsetenv("LISTEN_PID")
+		_ = os.Unsetenv("LISTEN_FDS")
+		_ = os.Unsetenv("LISTEN_FDNAMES")
+	}()
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || n < 1 {
+		return nil, fmt.Errorf("socket activation: invalid LISTEN_FDS %q", os.Getenv("LISTEN_FDS"))
+	}
+	names := make([]string, n)
+	if v, ok := os.LookupEnv("LISTEN_FDNAMES"); ok {
+		parts := strings.Split(v, ":")
+		if len(parts) != n {
+			return nil, fmt.Errorf("socket activation: LISTEN_FDNAMES has %d names for %d sockets", len(parts), n)
+		}
+		copy(names, parts)
+	}
+
+	socks := make([]systemdSocket, 0, n)
+	closeAll := func() {
+		for _, s := range socks {
+			_ = s.ln.Close()
+		}
+	}
+	for i := range n {
+		fd := listenFdsStart + i
+		if err := checkListenFD(fd); err != nil {
+			closeAll()
+			return nil, fmt.Errorf("socket activation: fd %d (%s): %w", fd, names[i], err)
+		}
+		f := os.NewFile(uintptr(fd), "systemd:"+names[i])
+		ln, err := net.FileListener(f)
+		// FileListener works on a duplicate; the original descriptor is ours
+		// to close.
+		_ = f.Close()
+		if err != nil {
+			closeAll()
+			return nil, fmt.Errorf("socket activation: fd %d (%s): %w", fd, names[i], err)
+		}
+		socks = append(socks, systemdSocket{fd: fd, name: names[i], ln: ln})
+	}
+	return socks, nil
+}
+
+// assignSystemdSockets hands the passed sockets to the tunnels. A lone tunnel
+// takes a lone socket whatever its name; otherwise each tunnel takes the
+// socket whose FileDescriptorName= is the tunnel name. Sockets no tunnel
+// claims are closed with a warning.
+func assignSystemdSockets(tunnels []*tunnel, socks []systemdSocket) error {
+	if len(tunnels) == 1 && len(socks) == 1 {
+		tunnels[0].socket = &socks[0]
+		return nil
+	}
+	byName := map[string][]*systemdSocket{}
+	for i := range socks {
+		byName[socks[i].name] = append(byName[socks[i].name], &socks[i])
+	}
+	for _, t := range tunnels {
+		matches := byName[t.name]
+		switch {
+		case t.name == "" || len(matches) == 0:
+			return t.wrap(fmt.Errorf("systemd passed %d sockets and none is named %q; set FileDescriptorName= to the tunnel name", len(socks), t.name))
+		case len(matches) > 1:
+			return t.wrap(fmt.Errorf("systemd passed %d sockets named %q; give each a distinct FileDescriptorName=", len(matches), t.name))
+		}
+		t.socket = matches[0]
+		delete(byName, t.name)
+	}
+	for _, rest := range byName {
+		for _, s := range rest {
+			log.Printf("warning: systemd socket fd %d (%s) matches no tunnel; closing it", s.fd, s.name)
+			_ = s.ln.Close()
+		}
+	}
+	return nil
+}
+
+// source is the listener description for startup logs.
+func (s *systemdSocket) source() string {
+	if s.name == "" {
+		return "systemd"
+	}
+	return "systemd:" + s.name
+}
@@ -0,0 +1,20 @@
+//go:build !unix
+
+package main
+
+import (
+	"errors"
+	"net"
+)
+
+var errNoSocketActivation = errors.New("socket activation is only supported on Unix")
+
+func checkListenFD(int) error { return errNoSocketActivation }
+
+func socketKind(int) (stream, listening bool, err error) {
+	return false, false, errNoSocketActivation
+}
+
+func connectedStream(int) bool { return false }
+
+func sameSocket(net.Conn, int) bool { return false }
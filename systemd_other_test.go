@@ -0,0 +1,18 @@
+//go:build !unix
+
+package main
+
+import (
+	"os"
+	"testing"
+)
+
+func passSockets(t *testing.T, _ string, _ ...*os.File) {
+	t.Helper()
+	t.Skip("systemd socket activation is Unix-only")
+}
+
+func withStdinFD(t *testing.T, _ *os.File) {
+	t.Helper()
+	t.Skip("per-connection mode is Unix-only")
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"io"
+	"net"
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func listeningFile(t *testing.T) (*os.File, string) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer func() { _ = ln.Close() }()
+	f, err := ln.(*net.TCPListener).File()
+	if err != nil {
+		t.Fatalf("TCPListener.File: %v", err)
+	}
+	return f, ln.Addr().String()
+}
+
+// TestListenFDs: named sockets are adopted in order, accept clients, and the
+// LISTEN_* variables are gone afterwards.
+func TestListenFDs(t *testing.T) {
+	webFile, webAddr := listeningFile(t)
+	dbFile, dbAddr := listeningFile(t)
+	passSockets(t, "web:db", webFile, dbFile)
+
+	socks, err := listenFDs()
+	if err != nil {
+		t.Fatalf("listenFDs: %v", err)
+	}
+	defer func() {
+		for _, s := range socks {
+			_ = s.ln.Close()
+		}
+	}()
+	for _, v := range []string{"LISTEN_PID", "LISTEN_FDS", "LISTEN_FDNAMES"} {
+		if _, ok := os.LookupEnv(v); ok {
+			t.Errorf("%s still set", v)
+		}
+	}
+	if len(socks) != 2 || socks[0].name != "web" || socks[1].name != "db" {
+		t.Fatalf("sockets = %+v", socks)
+	}
+	for i, want := range []string{webAddr, dbAddr} {
+		if got := socks[i].ln.Addr().String(); got != want {
+			t.Fatalf("socket %s addr=%s, want %s", socks[i].name, got, want)
+		}
+	}
+	if got := socks[0].source(); got != "systemd:web" {
+		t.Fatalf("source = %q", got)
+	}
+
+	// Accept a real client through the adopted descriptor.
+	errc := make(chan error, 1)
+	go func() {
+		c, err := net.DialTimeout("tcp", dbAddr, 2*time.Second)
+		if err != nil {
+			errc <- err
+			return
+		}
+		defer func() { _ = c.Close() }()
+		_, err = c.Write([]byte("ping"))
+		errc <- err
+	}()
+	_ = socks[1].ln.(*net.TCPListener).SetDeadline(time.Now().Add(2 * time.Second))
+	client, err := socks[1].ln.Accept()
+	if err != nil {
+		t.Fatalf("Accept on systemd listener: %v", err)
+	}
+	defer func() { _ = client.Close() }()
+	buf := make([]byte, 4)
+	_ = client.SetDeadline(time.Now().Add(2 * time.Second))
+	if _, err := io.ReadFull(client, buf); err != nil || string(buf) != "ping" {
+		t.Fatalf("payload=%q, %v", buf, err)
+	}
+	if err := <-errc; err != nil {
+		t.Fatalf("dial/write side: %v", err)
+	}
+}
+
+func TestListenFDs_Errors(t *testing.T) {
+	t.Run("bad count", func(t *testing.T) {
+		t.Setenv("LISTEN_FDS", "zero")
+		if _, err := listenFDs(); err == nil || !strings.Contains(err.Error(), "invalid LISTEN_FDS") {
+			t.Fatalf("err=%v", err)
+		}
+		if _, ok := os.LookupEnv("LISTEN_FDS"); ok {
+			t.Fatal("LISTEN_FDS not cleared after an error")
+		}
+	})
+	t.Run("names mismatch", func(t *testing.T) {
+		t.Setenv("LISTEN_FDS", "2")
+		t.Setenv("LISTEN_FDNAMES", "web")
+		if _, err := listenFDs(); err == nil || !strings.Contains(err.Error(), "1 names for 2 sockets") {
+			t.Fatalf("err=%v", err)
+		}
+	})
+	t.Run("datagram socket", func(t *testing.T) {
+		pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		f, err := pc.(*net.UDPConn).File()
+		_ = pc.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		passSockets(t, "dns", f)
+		if _, err := listenFDs(); err == nil || !strings.Contains(err.Error(), "not a stream socket") {
+			t.Fatalf("err=%v", err)
+		}
+	})
+	t.Run("not listening", func(t *testing.T) {
+		fd, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_STREAM, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		passSockets(t, "x", os.NewFile(uintptr(fd), "socket"))
+		if _, err := listenFDs(); err == nil || !strings.Contains(err.Error(), "not listening") {
+			t.Fatalf("err=%v", err)
+		}
+	})
+}
+
+func TestAssignSystemdSockets(t *testing.T) {
+	sock := func(name string) systemdSocket {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { _ = ln.Close() })
+		return systemdSocket{fd: 3, name: name, ln: ln}
+	}
+
+	t.Run("lone tunnel takes lone socket", func(t *testing.T) {
+		tun := &tunnel{}
+		if err := assignSystemdSockets([]*tunnel{tun}, []systemdSocket{sock("untls.socket")}); err != nil {
+			t.Fatal(err)
+		}
+		if tun.socket == nil || tun.socket.name != "untls.socket" {
+			t.Fatalf("socket = %+v", tun.socket)
+		}
+	})
+	t.Run("by name", func(t *testing.T) {
+		web, db := &tunnel{name: "web"}, &tunnel{name: "db"}
+		socks := []systemdSocket{sock("db"), sock("web"), sock("spare")}
+		if err := assignSystemdSockets([]*tunnel{web, db}, socks); err != nil {
+			t.Fatal(err)
+		}
+		if web.socket != &socks[1] || db.socket != &socks[0] {
+			t.Fatalf("web=%+v db=%+v", web.socket, db.socket)
+		}
+		// The unclaimed socket is closed.
+		if _, err := socks[2].ln.Accept(); err == nil {
+			t.Fatal("spare socket still open")
+		}
+	})
+	t.Run("missing name", func(t *testing.T) {
+		err := assignSystemdSockets([]*tunnel{{name: "web"}, {name: "db"}}, []systemdSocket{sock("web"), sock("other")})
+		if err == nil || !strings.Contains(err.Error(), `none is named "db"`) {
+			t.Fatalf("err=%v", err)
+		}
+	})
+	t.Run("duplicate name", func(t *testing.T) {
+		err := assignSystemdSockets([]*tunnel{{name: "web"}, {name: "db"}}, []systemdSocket{sock("web"), sock("web"), sock("db")})
+		if err == nil || !strings.Contains(err.Error(), `2 sockets named "web"`) {
+			t.Fatalf("err=%v", err)
+		}
+	})
+}
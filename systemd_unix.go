@@ -0,0 +1,80 @@
+//go:build unix
+
+package main
+
+import (
+	"errors"
+	"net"
+	"syscall"
+)
+
+// checkListenFD makes sure fd is a listening stream socket before it is
+// wrapped: a unit with ListenDatagram= or a stray descriptor would otherwise
+// fail later in Accept. It also stops fd from leaking into child processes.
+func checkListenFD(fd int) error {
+	stream, listening, err := socketKind(fd)
+	if err != nil {
+		return err
+	}
+	if !stream {
+		return errors.New("not a stream socket (ListenStream= is required)")
+	}
+	if !listening {
+		return errors.New("socket is not listening")
+	}
+	syscall.CloseOnExec(fd)
+	return nil
+}
+
+// socketKind reports whether fd is a stream socket and whether it is
+// listening (as opposed to an accepted connection). It fails for anything
+// that is not a socket.
+func socketKind(fd int) (stream, listening bool, err error) {
+	typ, err := syscall.GetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_TYPE)
+	if err != nil {
+		return false, false, err
+	}
+	acc, err := syscall.GetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_ACCEPTCONN)
+	if err != nil {
+		return false, false, err
+	}
+	return typ == syscall.SOCK_STREAM, acc != 0, nil
+}
+
+// connectedStream reports whether fd is a connected stream socket, the way
+// inetd passes the client on stdin.
+func connectedStream(fd int) bool {
+	typ, err := syscall.GetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_TYPE)
+	if err != nil || typ != syscall.SOCK_STREAM {
+		return false
+	}
+	_, err = syscall.Getpeername(fd)
+	return err == nil
+}
+
+// sameSocket reports whether fd is the very socket c wraps, as when inetd
+// passes the client as both stdin and stderr.
+func sameSocket(c net.Conn, fd int) bool {
+	sc, ok := c.(syscall.Conn)
+	if !ok {
+		return false
+	}
+	raw, err := sc.SyscallConn()
+	if err != nil {
+		return false
+	}
+	var want, got syscall.Stat_t
+	if syscall.Fstat(fd, &want) != nil {
+		return false
+	}
+	var statErr error
+	if err := raw.Control(func(cfd uintptr) { statErr = syscall.Fstat(int(cfd), &got) }); err != nil || statErr != nil {
+		return false
+	}
+	if want.Ino == 0 {
+		// No inode to tell sockets apart: any stream socket may be c.
+		stream, _, err := socketKind(fd)
+		return err == nil && stream
+	}
+	return got.Dev == want.Dev && got.Ino == want.Ino
+}
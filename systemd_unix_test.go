@@ -0,0 +1,72 @@
+//go:build unix
+
+package main
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"syscall"
+	"testing"
+)
+
+// passSockets installs the given sockets on consecutive descriptors the way
+// systemd would and points listenFdsStart at them. FD 3 itself is often the
+// Go runtime's epoll descriptor, so the test uses a free range instead.
+func passSockets(t *testing.T, names string, files ...*os.File) {
+	t.Helper()
+	const start = 200
+	for i, f := range files {
+		if err := syscall.Dup2(int(f.Fd()), start+i); err != nil {
+			t.Fatalf("Dup2 onto FD %d: %v", start+i, err)
+		}
+		_ = f.Close()
+	}
+	old := listenFdsStart
+	listenFdsStart = start
+	t.Cleanup(func() {
+		listenFdsStart = old
+		for i := range files {
+			_ = syscall.Close(start + i)
+		}
+	})
+	t.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()))
+	t.Setenv("LISTEN_FDS", strconv.Itoa(len(files)))
+	t.Setenv("LISTEN_FDNAMES", names)
+}
+
+// withStdinFD points passedConn's stdin at a duplicate of f.
+func withStdinFD(t *testing.T, f *os.File) {
+	t.Helper()
+	fd, err := syscall.Dup(int(f.Fd()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = f.Close()
+	old := stdinFD
+	stdinFD = fd
+	t.Cleanup(func() {
+		stdinFD = old
+		_ = syscall.Close(fd)
+	})
+}
+
+// TestSameSocket: only the descriptor of the client's own socket counts as
+// the client, not another socket on stderr.
+func TestSameSocket(t *testing.T) {
+	f, _ := acceptedFile(t)
+	defer func() { _ = f.Close() }()
+	c, err := net.FileConn(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = c.Close() }()
+	if !sameSocket(c, int(f.Fd())) {
+		t.Fatal("the client's own descriptor is not the same socket")
+	}
+	other, _ := acceptedFile(t)
+	defer func() { _ = other.Close() }()
+	if sameSocket(c, int(other.Fd())) {
+		t.Fatal("another socket is the same as the client")
+	}
+}
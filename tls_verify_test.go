@@ -7,8 +7,12 @@ import (
 	"crypto/tls"
 	"crypto/x509"
 	"crypto/x509/pkix"
+	"io"
 	"math/big"
 	"net"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -19,7 +23,7 @@ import (
 // socket — same ownership rule as dial refused / dial timeout. Existing tests
 // only cover connection-refused and hung-handshake peers.
 func TestConnectUpstream_UntrustedTLSClosesDownstream(t *testing.T) {
-	ln := mustSelfSignedTLSListener(t)
+	ln, _ := mustSelfSignedTLSListener(t)
 	defer func() { _ = ln.Close() }()
 
 	// Accept TLS clients so the handshake can run (and fail verify on our side).
@@ -39,7 +43,7 @@ func TestConnectUpstream_UntrustedTLSClosesDownstream(t *testing.T) {
 	defer func() { _ = client.Close() }()
 
 	start := time.Now()
-	_, err := connectUpstream(t.Context(), server, ln.Addr().String())
+	_, err := connectUpstream(t.Context(), server, testTunnel(ln.Addr().String()))
 	elapsed := time.Since(start)
 	if err == nil {
 		t.Fatal("expected TLS certificate verification error for self-signed peer")
@@ -53,7 +57,10 @@ func TestConnectUpstream_UntrustedTLSClosesDownstream(t *testing.T) {
 	}
 }
 
-func mustSelfSignedTLSListener(t *testing.T) net.Listener {
+// mustSelfSignedTLSListener starts a TLS listener on 127.0.0.1 with a fresh
+// self-signed certificate and returns that certificate so tests can trust it
+// explicitly.
+func mustSelfSignedTLSListener(t *testing.T) (net.Listener, *x509.Certificate) {
 	t.Helper()
 
 	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
@@ -73,6 +80,10 @@ func mustSelfSignedTLSListener(t *testing.T) net.Listener {
 	if err != nil {
 		t.Fatalf("create cert: %v", err)
 	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("parse cert: %v", err)
+	}
 	cert := tls.Certificate{
 		Certificate: [][]byte{der},
 		PrivateKey:  key,
@@ -84,5 +95,204 @@ func mustSelfSignedTLSListener(t *testing.T) net.Listener {
 	if err != nil {
 		t.Fatalf("tls.Listen: %v", err)
 	}
+	return ln, leaf
+}
+
+// testUpstream is a TLS upstream for the dialing tests. After the handshake
+// it sends each client greet's line, when greet is set, then echoes until
+// the client goes away. It counts the connections it accepted and can hang
+// up on all of them.
+type testUpstream struct {
+	addr   string
+	cert   *x509.Certificate
+	caFile string // PEM file trusting cert, for config file tests
+	// accepted counts the TCP connections, including failed handshakes.
+	accepted atomic.Int64
+	mu       sync.Mutex
+	conns    []net.Conn
+}
+
+// mustTestUpstream starts a testUpstream on 127.0.0.1, closed when the test
+// ends. Its self-signed certificate covers 127.0.0.1 or, when dnsNames are
+// given, only those names.
+func mustTestUpstream(t *testing.T, greet func(*tls.Conn) string, dnsNames ...string) *testUpstream {
+	t.Helper()
+	var ln net.Listener
+	var cert *x509.Certificate
+	if len(dnsNames) == 0 {
+		ln, cert = mustSelfSignedTLSListener(t)
+	} else {
+		var key *ecdsa.PrivateKey
+		cert, key = mustCert(t, &x509.Certificate{
+			Subject:     pkix.Name{CommonName: dnsNames[0]},
+			ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+			DNSNames:    dnsNames,
+		}, nil, nil)
+		var err error
+		ln, err = tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+			Certificates: []tls.Certificate{{Certificate: [][]byte{cert.Raw}, PrivateKey: key}},
+		})
+		if err != nil {
+			t.Fatalf("tls.Listen: %v", err)
+		}
+	}
+	t.Cleanup(func() { _ = ln.Close() })
+	up := &testUpstream{addr: ln.Addr().String(), cert: cert, caFile: writeTrustFile(t, cert)}
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			up.accepted.Add(1)
+			up.mu.Lock()
+			up.conns = append(up.conns, c)
+			up.mu.Unlock()
+			go func() {
+				defer func() { _ = c.Close() }()
+				tc := c.(*tls.Conn)
+				if err := tc.Handshake(); err != nil {
+					return
+				}
+				if greet != nil {
+					if _, err := tc.Write([]byte(greet(tc) + "\n")); err != nil {
+						return
+					}
+				}
+				_, _ = io.Copy(tc, tc)
+			}()
+		}
+	}()
+	return up
+}
+
+// says is a testUpstream greeting that is always line.
+func says(line string) func(*tls.Conn) string {
+	return func(*tls.Conn) string { return line }
+}
+
+func (u *testUpstream) hangUp() {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	for _, c := range u.conns {
+		_ = c.Close()
+	}
+	u.conns = nil
+}
+
+// mustSetupTunnel trusts certs in tun's TLS options and sets tun up for
+// dialing.
+func mustSetupTunnel(t *testing.T, tun *tunnel, certs ...*x509.Certificate) *tunnel {
+	t.Helper()
+	for _, c := range certs {
+		trustOnly(t, &tun.opts, c)
+	}
+	if err := tun.setup(); err != nil {
+		t.Fatalf("setup: %v", err)
+	}
+	return tun
+}
+
+func writeTrustFile(t *testing.T, cert *x509.Certificate) string {
+	t.Helper()
+	file := filepath.Join(t.TempDir(), "server.pem")
+	writeCertPEM(t, file, cert)
+	return file
+}
+
+// testCA is a throwaway certificate authority for tests that need real
+// chains (client certificates, intermediates, revocation).
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+// mustCA creates a root CA when parent is nil, otherwise an intermediate
+// signed by parent.
+func mustCA(t *testing.T, cn string, parent *testCA) *testCA {
+	t.Helper()
+	tmpl := &x509.Certificate{
+		Subject:               pkix.Name{CommonName: cn},
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	if parent == nil {
+		cert, key := mustCert(t, tmpl, nil, nil)
+		return &testCA{cert: cert, key: key}
+	}
+	cert, key := mustCert(t, tmpl, parent.cert, parent.key)
+	return &testCA{cert: cert, key: key}
+}
+
+// issue signs tmpl (typically a leaf) with ca.
+func (ca *testCA) issue(t *testing.T, tmpl *x509.Certificate) (*x509.Certificate, *ecdsa.PrivateKey) {
+	t.Helper()
+	return mustCert(t, tmpl, ca.cert, ca.key)
+}
+
+// mustCert fills in serial and validity when unset and signs tmpl with
+// parentKey, or self-signs when parent is nil.
+func mustCert(t *testing.T, tmpl, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+	if tmpl.SerialNumber == nil {
+		serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 62))
+		if err != nil {
+			t.Fatalf("serial: %v", err)
+		}
+		tmpl.SerialNumber = serial
+	}
+	if tmpl.NotBefore.IsZero() {
+		tmpl.NotBefore = time.Now().Add(-time.Hour)
+	}
+	if tmpl.NotAfter.IsZero() {
+		tmpl.NotAfter = time.Now().Add(time.Hour)
+	}
+	if parent == nil {
+		parent, parentKey = tmpl, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatalf("create cert %q: %v", tmpl.Subject.CommonName, err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("parse cert: %v", err)
+	}
+	return cert, key
+}
+
+// mustServeTLS listens on 127.0.0.1 presenting chain (leaf first) and echoes
+// bytes for every client. tweak, when non-nil, adjusts the server config.
+func mustServeTLS(t *testing.T, chain []*x509.Certificate, key *ecdsa.PrivateKey, tweak func(*tls.Config)) net.Listener {
+	t.Helper()
+	cert := tls.Certificate{PrivateKey: key, Leaf: chain[0]}
+	for _, c := range chain {
+		cert.Certificate = append(cert.Certificate, c.Raw)
+	}
+	cfg := &tls.Config{Certificates: []tls.Certificate{cert}}
+	if tweak != nil {
+		tweak(cfg)
+	}
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", cfg)
+	if err != nil {
+		t.Fatalf("tls.Listen: %v", err)
+	}
+	go serveTLSEcho(ln)
 	return ln
 }
+
+// serverLeafTemplate is a leaf valid for 127.0.0.1 and, optionally, names.
+func serverLeafTemplate(cn string, names ...string) *x509.Certificate {
+	return &x509.Certificate{
+		Subject:     pkix.Name{CommonName: cn},
+		KeyUsage:    x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		IPAddresses: []net.IP{net.IPv4(127, 0, 0, 1)},
+		DNSNames:    names,
+	}
+}
@@ -0,0 +1,421 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// stringList is a repeatable string flag (-ca-file a.pem -ca-file b.pem).
+type stringList []string
+
+func (s *stringList) String() string {
+	if s == nil {
+		return ""
+	}
+	return strings.Join(*s, ",")
+}
+
+func (s *stringList) Set(v string) error {
+	*s = append(*s, v)
+	return nil
+}
+
+// tlsOptions are the operator-facing knobs for the upstream TLS dial. The zero
+// value keeps the historical behavior: verify against the system CA pool and
+// nothing else. The JSON names are the flag names, for -config files.
+type tlsOptions struct {
+	// CAFiles are PEM bundles trusted for upstream verification.
+	CAFiles []string `json:"ca-file,omitempty"`
+	// CADirs are directories whose *.pem / *.crt / *.cer files are loaded
+	// like CAFiles. Other files are ignored so a README or hash symlink
+	// farm does not break startup.
+	CADirs []string `json:"ca-dir,omitempty"`
+	// NoSystemCAs replaces the system pool with CAFiles/CADirs instead of
+	// appending to it.
+	NoSystemCAs bool `json:"no-system-ca,omitempty"`
+
+	// ClientCert is a PEM certificate chain (leaf first) presented to
+	// upstreams that ask for one. ClientKey may be empty when the key is in
+	// the same file.
+	ClientCert string `json:"client-cert,omitempty"`
+	ClientKey  string `json:"client-key,omitempty"`
+	// ClientPKCS12 is a .p12/.pfx bundle used instead of ClientCert/ClientKey.
+	ClientPKCS12 string `json:"client-pkcs12,omitempty"`
+	// ClientKeyPassFile holds the passphrase for an encrypted key or bundle.
+	ClientKeyPassFile string `json:"client-key-pass-file,omitempty"`
+
+	// ServerName is the SNI sent to the upstream. Empty means the host part
+	// of -t (no SNI when that is an IP literal).
+	ServerName string `json:"sni,omitempty"`
+	// VerifyName is the name the upstream certificate must be valid for.
+	// Empty means the SNI name, which is crypto/tls's default.
+	VerifyName string `json:"verify-name,omitempty"`
+
+	// Pins are upstream certificate or key hashes (see parsePin). Any one
+	// match is enough, so old and new pins can overlap during rotation.
+	Pins []string `json:"pin,omitempty"`
+	// PinMode is pinModeSupplement (default) or pinModeReplace.
+	PinMode string `json:"pin-mode,omitempty"`
+	// TOFUFile enables trust-on-first-use: the chain is not verified, the
+	// first key seen for the -t address is stored here and later
+	// connections must present the same key.
+	TOFUFile string `json:"tofu-file,omitempty"`
+
+	// ALPN protocols offered to the upstream, in preference order, for
+	// fronts that route on ALPN rather than SNI.
+	ALPN []string `json:"alpn,omitempty"`
+	// RequireALPN fails the connection when the upstream selects none of
+	// ALPN instead of carrying on without a protocol.
+	RequireALPN bool `json:"require-alpn,omitempty"`
+
+	// MinVersion and MaxVersion ("1.2", "1.3", ...), CipherSuites (IANA
+	// names, TLS 1.2 and below) and Curves are opt-in limits; empty keeps
+	// crypto/tls's defaults. See applyPolicy.
+	MinVersion   string   `json:"tls-min,omitempty"`
+	MaxVersion   string   `json:"tls-max,omitempty"`
+	CipherSuites []string `json:"ciphers,omitempty"`
+	Curves       []string `json:"curves,omitempty"`
+
+	// Revocation is revocationOff (default), revocationSoft or
+	// revocationHard. CRLFiles are PEM or DER CRLs consulted alongside the
+	// stapled OCSP response; they are re-read on reload.
+	Revocation string   `json:"revocation,omitempty"`
+	CRLFiles   []string `json:"crl,omitempty"`
+
+	// KeyLogFile, when set, receives the session keys of every upstream
+	// handshake for decrypting captures (see openKeyLog).
+	KeyLogFile string `json:"keylog-file,omitempty"`
+
+	// clientCerts is set by clientConfig so reload can rotate the
+	// certificate without rebuilding the tls.Config.
+	clientCerts *clientCertStore
+	// revocation is set by clientConfig for the same reason.
+	revocation *revocationChecker
+	// verifier is set by clientConfig so configFor can rekey TOFU pins.
+	verifier *peerVerifier
+}
+
+// clientConfig builds the tls.Config for upstream dials to remote. Every
+// error names the offending flag or file so a bad bundle fails startup
+// instead of the first client's handshake. It reads files but creates none:
+// the key log is opened by tunnel.setup.
+func (o *tlsOptions) clientConfig(remote string) (*tls.Config, error) {
+	if err := o.validate(); err != nil {
+		return nil, err
+	}
+	roots, err := o.rootCAs()
+	if err != nil {
+		return nil, err
+	}
+	cfg := &tls.Config{RootCAs: roots, ServerName: o.ServerName, NextProtos: o.ALPN}
+	if err := o.applyPolicy(cfg); err != nil {
+		return nil, err
+	}
+
+	v := &peerVerifier{
+		roots:      roots,
+		verifyName: o.VerifyName,
+		skipChain:  o.PinMode == pinModeReplace || o.TOFUFile != "",
+	}
+	if o.RequireALPN {
+		v.requireALPN = o.ALPN
+	}
+	if o.Revocation == revocationSoft || o.Revocation == revocationHard {
+		r, err := newRevocationChecker(o.Revocation, o.CRLFiles)
+		if err != nil {
+			return nil, err
+		}
+		o.revocation = r
+		v.revocation = r
+	}
+	if o.TOFUFile != "" {
+		v.tofu = openTOFUStore(o.TOFUFile)
+		v.tofuKey = remote
+	}
+	for _, s := range o.Pins {
+		p, err := parsePin(s)
+		if err != nil {
+			return nil, err
+		}
+		v.pins = append(v.pins, p)
+	}
+	if v.skipChain || v.verifyName != "" {
+		// crypto/tls can only verify the chain against ServerName; the
+		// verifier takes over (or skips it, for replace-mode pins).
+		cfg.InsecureSkipVerify = true
+	}
+	if v.skipChain || v.verifyName != "" || len(v.pins) > 0 || v.tofu != nil || len(v.requireALPN) > 0 || v.revocation != nil {
+		cfg.VerifyConnection = v.verifyConnection
+		o.verifier = v
+	}
+
+	certs, err := newClientCertStore(o)
+	if err != nil {
+		return nil, err
+	}
+	o.clientCerts = certs
+	if certs != nil {
+		cfg.GetClientCertificate = certs.getClientCertificate
+	}
+	return cfg, nil
+}
+
+// configFor adapts cfg, built by clientConfig for another remote of the same
+// tunnel, to dial remote for the tunnel named name. Sessions are cached per
+// tunnel and remote (see sessionCache.scoped), and TOFU pins are stored per
+// host:port, so the verifier is copied with remote as its key.
+func (o *tlsOptions) configFor(cfg *tls.Config, name, remote string) *tls.Config {
+	c := cfg.Clone()
+	if upstreamSessions != nil {
+		c.ClientSessionCache = upstreamSessions.scoped(name, remote)
+	}
+	if o.verifier != nil && o.verifier.tofu != nil {
+		v := *o.verifier
+		v.tofuKey = remote
+		c.VerifyConnection = v.verifyConnection
+	}
+	return c
+}
+
+// validate checks the options that are plain strings before any file is
+// read, so a typo fails startup with the flag name in the message.
+func (o *tlsOptions) validate() error {
+	if o.ServerName != "" {
+		if err := validateServerName("-sni", o.ServerName, false); err != nil {
+			return err
+		}
+	}
+	if o.VerifyName != "" {
+		if err := validateServerName("-verify-name", o.VerifyName, true); err != nil {
+			return err
+		}
+	}
+	switch o.PinMode {
+	case "", pinModeSupplement:
+	case pinModeReplace:
+		if len(o.Pins) == 0 {
+			return fmt.Errorf("-pin-mode %s needs at least one -pin", pinModeReplace)
+		}
+		if o.VerifyName != "" {
+			return fmt.Errorf("-verify-name has no effect with -pin-mode %s (the chain is not verified)", pinModeReplace)
+		}
+	default:
+		return fmt.Errorf("invalid -pin-mode %q: want %s or %s", o.PinMode, pinModeSupplement, pinModeReplace)
+	}
+	if o.TOFUFile != "" && (len(o.Pins) > 0 || o.VerifyName != "") {
+		return fmt.Errorf("-tofu-file cannot be combined with -pin or -verify-name")
+	}
+	for _, p := range o.ALPN {
+		if p == "" || len(p) > 255 {
+			return fmt.Errorf("invalid -alpn %q: protocol names are 1-255 bytes", p)
+		}
+	}
+	if o.RequireALPN && len(o.ALPN) == 0 {
+		return fmt.Errorf("-require-alpn needs at least one -alpn")
+	}
+	switch o.Revocation {
+	case "", revocationOff:
+		if len(o.CRLFiles) > 0 {
+			return fmt.Errorf("-crl needs -revocation %s or %s", revocationSoft, revocationHard)
+		}
+	case revocationSoft, revocationHard:
+		if o.PinMode == pinModeReplace || o.TOFUFile != "" {
+			return fmt.Errorf("-revocation needs a verified chain; it cannot be combined with -pin-mode %s or -tofu-file", pinModeReplace)
+		}
+	default:
+		return fmt.Errorf("invalid -revocation %q: want %s, %s or %s", o.Revocation, revocationOff, revocationSoft, revocationHard)
+	}
+	return nil
+}
+
+// validateServerName checks that name is a bare DNS name (no port, scheme or
+// wildcard), or an IP literal when allowIP is set. SNI cannot carry IP
+// literals (RFC 6066), but a certificate can be verified against one.
+func validateServerName(flagName, name string, allowIP bool) error {
+	if ip := net.ParseIP(name); ip != nil {
+		if !allowIP {
+			return fmt.Errorf("invalid %s %q: SNI must be a DNS name, not an IP address", flagName, name)
+		}
+		return nil
+	}
+	host := strings.TrimSuffix(name, ".")
+	if host == "" || len(host) > 253 {
+		return fmt.Errorf("invalid %s %q: want a DNS name", flagName, name)
+	}
+	for _, label := range strings.Split(host, ".") {
+		if label == "" || len(label) > 63 || label[0] == '-' || label[len(label)-1] == '-' {
+			return fmt.Errorf("invalid %s %q: want a DNS name", flagName, name)
+		}
+		for _, r := range label {
+			if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '_') {
+				return fmt.Errorf("invalid %s %q: want a DNS name without port or scheme", flagName, name)
+			}
+		}
+	}
+	return nil
+}
+
+// peerVerifier runs the upstream checks crypto/tls cannot express on its
+// own, as tls.Config.VerifyConnection. It sees resumed sessions too. A soft
+// -revocation problem is returned as a *revocationWarning, which only
+// upstream.dial knows to let through.
+type peerVerifier struct {
+	// roots is nil for the system pool, same as tls.Config.RootCAs.
+	roots *x509.CertPool
+	// verifyName, when set, means crypto/tls skipped chain verification
+	// (InsecureSkipVerify) and the chain is verified here for this name.
+	verifyName string
+	// skipChain disables chain verification entirely (pin-mode replace).
+	skipChain bool
+	pins      []pin
+	// tofu, when set, checks the leaf key against the store entry tofuKey.
+	tofu    *tofuStore
+	tofuKey string
+	// requireALPN, when set, rejects handshakes that negotiated no protocol.
+	requireALPN []string
+	// revocation, when set, checks the verified chain for revocation.
+	revocation *revocationChecker
+}
+
+func (v *peerVerifier) verifyConnection(cs tls.ConnectionState) error {
+	if len(v.requireALPN) > 0 && cs.NegotiatedProtocol == "" {
+		return fmt.Errorf("alpn: upstream selected none of %s", strings.Join(v.requireALPN, ", "))
+	}
+	if len(cs.PeerCertificates) == 0 {
+		return errors.New("upstream sent no certificate")
+	}
+	leaf := cs.PeerCertificates[0]
+	chains := cs.VerifiedChains
+	if v.verifyName != "" && !v.skipChain {
+		var err error
+		if chains, err = verifyChain(v.roots, v.verifyName, cs.PeerCertificates); err != nil {
+			return err
+		}
+	}
+	if len(v.pins) > 0 {
+		if err := checkPins(v.pins, leaf, chains); err != nil {
+			return err
+		}
+	}
+	// A soft revocation warning is returned only once every other check
+	// has passed.
+	var warning error
+	if v.revocation != nil {
+		if err := v.revocation.check(cs, chains); err != nil {
+			var w *revocationWarning
+			if !errors.As(err, &w) {
+				return err
+			}
+			warning = err
+		}
+	}
+	if v.tofu != nil {
+		if err := v.tofu.check(v.tofuKey, leaf); err != nil {
+			return err
+		}
+	}
+	return warning
+}
+
+// verifyChain does what crypto/tls does by default, but for name instead
+// of the SNI.
+func verifyChain(roots *x509.CertPool, name string, certs []*x509.Certificate) ([][]*x509.Certificate, error) {
+	opts := x509.VerifyOptions{
+		Roots:         roots,
+		DNSName:       name,
+		Intermediates: x509.NewCertPool(),
+	}
+	for _, c := range certs[1:] {
+		opts.Intermediates.AddCert(c)
+	}
+	return certs[0].Verify(opts)
+}
+
+// rootCAs returns nil (use the system pool) when no CA options are set.
+func (o *tlsOptions) rootCAs() (*x509.CertPool, error) {
+	if len(o.CAFiles) == 0 && len(o.CADirs) == 0 {
+		if o.NoSystemCAs {
+			return nil, fmt.Errorf("-no-system-ca needs at least one -ca-file or -ca-dir")
+		}
+		return nil, nil
+	}
+	var pool *x509.CertPool
+	if o.NoSystemCAs {
+		pool = x509.NewCertPool()
+	} else {
+		sys, err := x509.SystemCertPool()
+		if err != nil {
+			return nil, fmt.Errorf("load system CA pool (use -no-system-ca to skip it): %w", err)
+		}
+		pool = sys
+	}
+	for _, file := range o.CAFiles {
+		if err := appendCAFile(pool, file); err != nil {
+			return nil, err
+		}
+	}
+	for _, dir := range o.CADirs {
+		if err := appendCADir(pool, dir); err != nil {
+			return nil, err
+		}
+	}
+	return pool, nil
+}
+
+// caDirExts are the file extensions appendCADir picks up.
+var caDirExts = map[string]bool{".pem": true, ".crt": true, ".cer": true}
+
+func appendCADir(pool *x509.CertPool, dir string) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return fmt.Errorf("read CA directory: %w", err)
+	}
+	loaded := 0
+	for _, e := range entries {
+		if e.IsDir() || !caDirExts[strings.ToLower(filepath.Ext(e.Name()))] {
+			continue
+		}
+		if err := appendCAFile(pool, filepath.Join(dir, e.Name())); err != nil {
+			return err
+		}
+		loaded++
+	}
+	if loaded == 0 {
+		return fmt.Errorf("CA directory %s: no .pem, .crt or .cer files", dir)
+	}
+	return nil
+}
+
+// appendCAFile adds every CERTIFICATE block in file to pool. Unlike
+// CertPool.AppendCertsFromPEM it fails on the first unparsable certificate
+// and on files without any certificate, so a truncated or wrong file is
+// reported at startup rather than silently trusting nothing.
+func appendCAFile(pool *x509.CertPool, file string) error {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return fmt.Errorf("read CA file: %w", err)
+	}
+	n := 0
+	for block, rest := pem.Decode(data); block != nil; block, rest = pem.Decode(rest) {
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return fmt.Errorf("CA file %s: certificate #%d: %w", file, n+1, err)
+		}
+		pool.AddCert(cert)
+		n++
+	}
+	if n == 0 {
+		return fmt.Errorf("CA file %s: no PEM certificates found", file)
+	}
+	return nil
+}
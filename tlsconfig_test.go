@@ -0,0 +1,280 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestConnectUpstream_CustomCATrustsSelfSigned: the same self-signed peer that
+// TestConnectUpstream_UntrustedTLSClosesDownstream rejects must be accepted
+// once its certificate is supplied as a CA, whether from a file or a
+// directory, and with or without the system pool.
+func TestConnectUpstream_CustomCATrustsSelfSigned(t *testing.T) {
+	tests := []struct {
+		name string
+		opts func(file, dir string) tlsOptions
+	}{
+		{name: "ca file", opts: func(file, _ string) tlsOptions {
+			return tlsOptions{CAFiles: []string{file}}
+		}},
+		{name: "ca dir", opts: func(_, dir string) tlsOptions {
+			return tlsOptions{CADirs: []string{dir}}
+		}},
+		{name: "ca file without system pool", opts: func(file, _ string) tlsOptions {
+			return tlsOptions{CAFiles: []string{file}, NoSystemCAs: true}
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			up := mustTestUpstream(t, nil)
+			opts := tt.opts(up.caFile, filepath.Dir(up.caFile))
+			cfg, err := opts.clientConfig("")
+			if err != nil {
+				t.Fatalf("clientConfig: %v", err)
+			}
+			withUpstreamTLS(t, cfg)
+
+			client, server := net.Pipe()
+			defer func() { _ = client.Close() }()
+			defer func() { _ = server.Close() }()
+
+			upstream, err := connectUpstream(t.Context(), server, testTunnel(up.addr))
+			if err != nil {
+				t.Fatalf("connectUpstream with trusted CA: %v", err)
+			}
+			defer func() { _ = upstream.Close() }()
+
+			_ = upstream.SetDeadline(time.Now().Add(2 * time.Second))
+			if _, err := upstream.Write([]byte("ping")); err != nil {
+				t.Fatalf("write: %v", err)
+			}
+			buf := make([]byte, 4)
+			if _, err := io.ReadFull(upstream, buf); err != nil {
+				t.Fatalf("read echo: %v", err)
+			}
+			if string(buf) != "ping" {
+				t.Fatalf("echo=%q, want %q", buf, "ping")
+			}
+		})
+	}
+}
+
+// TestConnectUpstream_WrongCAStillRejected: trusting some other CA with
+// -no-system-ca must not make an unrelated self-signed peer acceptable.
+func TestConnectUpstream_WrongCAStillRejected(t *testing.T) {
+	up := mustTestUpstream(t, nil)
+	other := mustTestUpstream(t, nil)
+
+	opts := tlsOptions{CAFiles: []string{other.caFile}, NoSystemCAs: true}
+	cfg, err := opts.clientConfig("")
+	if err != nil {
+		t.Fatalf("clientConfig: %v", err)
+	}
+	withUpstreamTLS(t, cfg)
+
+	client, server := net.Pipe()
+	defer func() { _ = client.Close() }()
+
+	if _, err := connectUpstream(t.Context(), server, testTunnel(up.addr)); err == nil {
+		t.Fatal("expected verification error for peer signed by an untrusted CA")
+	}
+}
+
+func TestTLSOptions_ClientConfigErrors(t *testing.T) {
+	dir := t.TempDir()
+	garbage := filepath.Join(dir, "garbage.pem")
+	if err := os.WriteFile(garbage, []byte("not a certificate\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	corrupt := filepath.Join(dir, "corrupt.pem")
+	if err := os.WriteFile(corrupt, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: []byte("junk")}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	emptyDir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(emptyDir, "README"), []byte("hi"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		opts    tlsOptions
+		wantSub string
+	}{
+		{name: "no system ca alone", opts: tlsOptions{NoSystemCAs: true}, wantSub: "-no-system-ca"},
+		{name: "missing file", opts: tlsOptions{CAFiles: []string{filepath.Join(dir, "nope.pem")}}, wantSub: "nope.pem"},
+		{name: "no pem blocks", opts: tlsOptions{CAFiles: []string{garbage}}, wantSub: "no PEM certificates"},
+		{name: "corrupt certificate", opts: tlsOptions{CAFiles: []string{corrupt}}, wantSub: "certificate #1"},
+		{name: "missing dir", opts: tlsOptions{CADirs: []string{filepath.Join(dir, "nope")}}, wantSub: "CA directory"},
+		{name: "dir without certs", opts: tlsOptions{CADirs: []string{emptyDir}}, wantSub: "no .pem"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := tt.opts.clientConfig("")
+			if err == nil {
+				t.Fatal("expected error")
+			}
+			if !strings.Contains(err.Error(), tt.wantSub) {
+				t.Fatalf("err=%q, want it to mention %q", err, tt.wantSub)
+			}
+		})
+	}
+}
+
+func TestTLSOptions_DefaultUsesSystemPool(t *testing.T) {
+	var opts tlsOptions
+	cfg, err := opts.clientConfig("")
+	if err != nil {
+		t.Fatalf("clientConfig: %v", err)
+	}
+	// nil RootCAs is how crypto/tls selects the system pool.
+	if cfg.RootCAs != nil {
+		t.Fatal("zero options must leave RootCAs nil (system pool)")
+	}
+}
+
+// testUpstreamTLS is the config testTunnel dials with; tests swap it with
+// withUpstreamTLS the same way they override dialTimeout.
+var testUpstreamTLS = &tls.Config{}
+
+// withUpstreamTLS swaps the upstream config for the test.
+func withUpstreamTLS(t *testing.T, cfg *tls.Config) {
+	t.Helper()
+	old := testUpstreamTLS
+	testUpstreamTLS = cfg
+	t.Cleanup(func() { testUpstreamTLS = old })
+}
+
+// testTunnel is an unnamed tunnel to remote using testUpstreamTLS.
+func testTunnel(remote string) *tunnel {
+	u := &upstream{addr: remote}
+	u.tls.Store(testUpstreamTLS)
+	return &tunnel{remote: remote, upstreams: []*upstream{u}}
+}
+
+// serveTLSEcho completes the handshake for every client on ln and echoes
+// bytes back until the client goes away.
+func serveTLSEcho(ln net.Listener) {
+	for {
+		c, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer func() { _ = c.Close() }()
+			_, _ = io.Copy(c, c)
+		}()
+	}
+}
+
+func writeCertPEM(t *testing.T, path string, certs ...*x509.Certificate) {
+	t.Helper()
+	var buf []byte
+	for _, c := range certs {
+		buf = append(buf, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.Raw})...)
+	}
+	if err := os.WriteFile(path, buf, 0o600); err != nil {
+		t.Fatalf("write %s: %v", path, err)
+	}
+}
+
+// TestConnectUpstream_ServerNameOverrides dials 127.0.0.1 while the peer's
+// certificate only covers public.example, the tailnet-IP-behind-a-public-name
+// case. The listener echoes the SNI it received.
+func TestConnectUpstream_ServerNameOverrides(t *testing.T) {
+	tests := []struct {
+		name       string
+		sni        string
+		verifyName string
+		wantSNI    string
+		wantErr    bool
+	}{
+		{name: "defaults verify the dial ip", wantErr: true},
+		{name: "verify name only", verifyName: "public.example", wantSNI: "-"},
+		{name: "sni doubles as verify name", sni: "public.example", wantSNI: "public.example"},
+		{name: "sni and verify name differ", sni: "router.internal", verifyName: "public.example", wantSNI: "router.internal"},
+		{name: "sni alone must match cert", sni: "router.internal", wantErr: true},
+		{name: "wrong verify name", sni: "public.example", verifyName: "other.example", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			up := mustTestUpstream(t, func(c *tls.Conn) string {
+				if sni := c.ConnectionState().ServerName; sni != "" {
+					return sni
+				}
+				return "-"
+			}, "public.example")
+
+			opts := tlsOptions{ServerName: tt.sni, VerifyName: tt.verifyName}
+			trustOnly(t, &opts, up.cert)
+			cfg, err := opts.clientConfig("")
+			if err != nil {
+				t.Fatalf("clientConfig: %v", err)
+			}
+			withUpstreamTLS(t, cfg)
+
+			client, server := net.Pipe()
+			defer func() { _ = client.Close() }()
+			upstream, err := connectUpstream(t.Context(), server, testTunnel(up.addr))
+			if tt.wantErr {
+				if err == nil {
+					_ = upstream.Close()
+					t.Fatal("expected certificate name mismatch")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("connectUpstream: %v", err)
+			}
+			defer func() { _ = upstream.Close() }()
+			_ = upstream.SetDeadline(time.Now().Add(2 * time.Second))
+			line, err := bufio.NewReader(upstream).ReadString('\n')
+			if err != nil {
+				t.Fatalf("read SNI: %v", err)
+			}
+			if got := strings.TrimSuffix(line, "\n"); got != tt.wantSNI {
+				t.Fatalf("upstream saw SNI %q, want %q", got, tt.wantSNI)
+			}
+		})
+	}
+}
+
+func TestValidateServerName(t *testing.T) {
+	tests := []struct {
+		name    string
+		in      string
+		allowIP bool
+		wantErr bool
+	}{
+		{name: "dns name", in: "example.com"},
+		{name: "trailing dot", in: "example.com."},
+		{name: "single label", in: "router"},
+		{name: "underscore label", in: "_srv.example.com"},
+		{name: "ipv4 allowed", in: "127.0.0.1", allowIP: true},
+		{name: "ipv6 allowed", in: "::1", allowIP: true},
+		{name: "ipv4 as sni", in: "127.0.0.1", wantErr: true},
+		{name: "with port", in: "example.com:443", wantErr: true},
+		{name: "with scheme", in: "https://example.com", wantErr: true},
+		{name: "wildcard", in: "*.example.com", wantErr: true},
+		{name: "empty label", in: "example..com", wantErr: true},
+		{name: "leading hyphen", in: "-example.com", wantErr: true},
+		{name: "space", in: "exa mple.com", wantErr: true},
+		{name: "only dot", in: ".", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateServerName("-sni", tt.in, tt.allowIP)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("validateServerName(%q) err=%v wantErr=%v", tt.in, err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+)
+
+// defaultCertExpiryWarn is how far ahead of the upstream leaf's NotAfter
+// each connection starts logging a warning (-cert-expiry-warn).
+const defaultCertExpiryWarn = 14 * 24 * time.Hour
+
+// logTLSDetails writes the per-connection summary of a finished upstream
+// handshake, e.g.
+//
+//	conn/127.0.0.1:5000: tls 1.3 TLS_AES_128_GCM_SHA256 alpn=none resumed=false peer="CN=a" issuer="CN=b" expires=2027-01-01T00:00:00Z
+//
+// followed by a warning line when the leaf expires within expiryWarn (0
+// disables the warning).
+func logTLSDetails(label string, cs tls.ConnectionState, expiryWarn time.Duration) {
+	proto := cs.NegotiatedProtocol
+	if proto == "" {
+		proto = "none"
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s: tls %s %s alpn=%s resumed=%t",
+		label, strings.TrimPrefix(tls.VersionName(cs.Version), "TLS "), tls.CipherSuiteName(cs.CipherSuite), proto, cs.DidResume)
+	if len(cs.PeerCertificates) > 0 {
+		leaf := cs.PeerCertificates[0]
+		fmt.Fprintf(&b, " peer=%q issuer=%q expires=%s",
+			leaf.Subject.String(), leaf.Issuer.String(), leaf.NotAfter.UTC().Format(time.RFC3339))
+	}
+	if upstreamSessions != nil {
+		fmt.Fprintf(&b, " session-cache(%s)", upstreamSessions.stats())
+	}
+	log.Print(b.String())
+
+	if expiryWarn <= 0 || len(cs.PeerCertificates) == 0 {
+		return
+	}
+	leaf := cs.PeerCertificates[0]
+	if left := time.Until(leaf.NotAfter); left < expiryWarn {
+		log.Printf("%s: warning: upstream certificate %q expires in %s (%s)",
+			label, leaf.Subject.String(), left.Round(time.Minute), leaf.NotAfter.UTC().Format(time.RFC3339))
+	}
+}
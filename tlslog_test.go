@@ -0,0 +1,101 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestConnectUpstream_LogsTLSDetails checks the per-connection summary line
+// for a CA-issued upstream on a pinned TLS 1.2 suite.
+func TestConnectUpstream_LogsTLSDetails(t *testing.T) {
+	ca := mustCA(t, "details-ca", nil)
+	tmpl := serverLeafTemplate("details-leaf")
+	tmpl.NotAfter = time.Date(2099, 1, 2, 3, 4, 5, 0, time.UTC)
+	leaf, key := ca.issue(t, tmpl)
+	ln := mustServeTLS(t, []*x509.Certificate{leaf, ca.cert}, key, func(c *tls.Config) {
+		c.MaxVersion = tls.VersionTLS12
+		c.CipherSuites = []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256}
+		c.NextProtos = []string{"x-game"}
+	})
+	defer func() { _ = ln.Close() }()
+
+	opts := tlsOptions{ALPN: []string{"x-game"}}
+	trustOnly(t, &opts, ca.cert)
+	cfg, err := opts.clientConfig("")
+	if err != nil {
+		t.Fatalf("clientConfig: %v", err)
+	}
+	withUpstreamTLS(t, cfg)
+
+	got := captureConnectLog(t, testTunnel(ln.Addr().String()))
+	want := `conn/pipe: tls 1.2 TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256 alpn=x-game resumed=false peer="CN=details-leaf" issuer="CN=details-ca" expires=2099-01-02T03:04:05Z`
+	if !strings.Contains(got, want) {
+		t.Fatalf("log=%q\nwant line %q", got, want)
+	}
+	if strings.Contains(got, "warning") {
+		t.Fatalf("far-future certificate must not warn: %q", got)
+	}
+}
+
+// TestConnectUpstream_CertExpiryWarning: a leaf inside the window gets a
+// warning line; widening or disabling the window changes that.
+func TestConnectUpstream_CertExpiryWarning(t *testing.T) {
+	leaf, key := mustCert(t, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "expiring"},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		IPAddresses: []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotAfter:    time.Now().Add(48 * time.Hour),
+	}, nil, nil)
+	ln := mustServeTLS(t, []*x509.Certificate{leaf}, key, nil)
+	defer func() { _ = ln.Close() }()
+
+	var opts tlsOptions
+	trustOnly(t, &opts, leaf)
+	cfg, err := opts.clientConfig("")
+	if err != nil {
+		t.Fatalf("clientConfig: %v", err)
+	}
+	withUpstreamTLS(t, cfg)
+
+	for _, tt := range []struct {
+		window   time.Duration
+		wantWarn bool
+	}{
+		{window: 14 * 24 * time.Hour, wantWarn: true},
+		{window: 24 * time.Hour, wantWarn: false},
+		{window: 0, wantWarn: false},
+	} {
+		tun := testTunnel(ln.Addr().String())
+		tun.certExpiryWarn = tt.window
+		got := captureConnectLog(t, tun)
+		warned := strings.Contains(got, `conn/pipe: warning: upstream certificate "CN=expiring" expires in 4`)
+		if warned != tt.wantWarn {
+			t.Fatalf("window=%v: warned=%v, want %v; log=%q", tt.window, warned, tt.wantWarn, got)
+		}
+	}
+}
+
+// captureConnectLog runs one successful connectUpstream and returns the log.
+func captureConnectLog(t *testing.T, tun *tunnel) string {
+	t.Helper()
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+
+	client, server := net.Pipe()
+	defer func() { _ = client.Close() }()
+	upstream, err := connectUpstream(t.Context(), server, tun)
+	if err != nil {
+		t.Fatalf("connectUpstream: %v", err)
+	}
+	_ = upstream.Close()
+	return buf.String()
+}
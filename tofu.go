@@ -0,0 +1,259 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// tofuStore is an SSH known_hosts-style record of upstream public keys,
+// keyed by the -t address. The file is re-read on every check so `untls pins`
+// edits take effect without restarting a running proxy.
+type tofuStore struct {
+	path string
+	mu   sync.Mutex
+}
+
+// tofuEntry is one remembered upstream.
+type tofuEntry struct {
+	Pin       string    `json:"pin"`
+	Subject   string    `json:"subject,omitempty"`
+	FirstSeen time.Time `json:"first_seen"`
+}
+
+// tofuMismatchError is the loud failure: the upstream key differs from the
+// one recorded on first use.
+type tofuMismatchError struct {
+	remote string
+	stored string
+	got    pin
+}
+
+func (e *tofuMismatchError) Error() string {
+	return fmt.Sprintf("tofu: UPSTREAM KEY CHANGED for %s: stored %s, upstream presented %s; "+
+		"if the change is expected run `untls pins accept %s`", e.remote, e.stored, e.got, e.remote)
+}
+
+// tofuStores shares one store (and its lock) per file across configs.
+var (
+	tofuStoresMu sync.Mutex
+	tofuStores   = map[string]*tofuStore{}
+)
+
+func openTOFUStore(path string) *tofuStore {
+	tofuStoresMu.Lock()
+	defer tofuStoresMu.Unlock()
+	if s, ok := tofuStores[path]; ok {
+		return s
+	}
+	s := &tofuStore{path: path}
+	tofuStores[path] = s
+	return s
+}
+
+// check records leaf's key for remote on first sight and afterwards
+// requires the same key.
+func (s *tofuStore) check(remote string, leaf *x509.Certificate) error {
+	got := pin{kind: pinSPKI, hash: certHash(pinSPKI, leaf)}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	entries, err := s.load()
+	if err != nil {
+		return err
+	}
+	if e, ok := entries[remote]; ok {
+		if e.Pin != got.String() {
+			return &tofuMismatchError{remote: remote, stored: e.Pin, got: got}
+		}
+		return nil
+	}
+	entries[remote] = tofuEntry{Pin: got.String(), Subject: leaf.Subject.String(), FirstSeen: time.Now().UTC()}
+	if err := s.save(entries); err != nil {
+		return err
+	}
+	log.Printf("info: tofu: trusting %s on first use: %s", remote, got)
+	return nil
+}
+
+// load returns an empty map when the file does not exist yet.
+func (s *tofuStore) load() (map[string]tofuEntry, error) {
+	entries := map[string]tofuEntry{}
+	data, err := os.ReadFile(s.path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return entries, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("tofu: read %s: %w", s.path, err)
+	}
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return nil, fmt.Errorf("tofu: parse %s: %w", s.path, err)
+	}
+	return entries, nil
+}
+
+// save replaces the file atomically so a crash never leaves it half written.
+func (s *tofuStore) save(entries map[string]tofuEntry) error {
+	data, err := json.MarshalIndent(entries, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(s.path), ".tofu-*")
+	if err != nil {
+		return fmt.Errorf("tofu: write %s: %w", s.path, err)
+	}
+	defer func() { _ = os.Remove(tmp.Name()) }()
+	if _, err := tmp.Write(append(data, '\n')); err != nil {
+		_ = tmp.Close()
+		return fmt.Errorf("tofu: write %s: %w", s.path, err)
+	}
+	if err := tmp.Chmod(0o600); err != nil {
+		_ = tmp.Close()
+		return fmt.Errorf("tofu: write %s: %w", s.path, err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("tofu: write %s: %w", s.path, err)
+	}
+	if err := os.Rename(tmp.Name(), s.path); err != nil {
+		return fmt.Errorf("tofu: write %s: %w", s.path, err)
+	}
+	return nil
+}
+
+// update runs fn on the entries under the lock and saves the result.
+func (s *tofuStore) update(fn func(map[string]tofuEntry) error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	entries, err := s.load()
+	if err != nil {
+		return err
+	}
+	if err := fn(entries); err != nil {
+		return err
+	}
+	return s.save(entries)
+}
+
+const pinsUsage = `usage: untls pins -tofu-file <path> <command>
+
+commands:
+  list                     show stored upstream keys
+  accept <host:port> [pin] store pin for host:port, or the key it presents now
+  forget <host:port>       remove host:port so the next connection re-trusts
+`
+
+// pinsCommand implements `untls pins ...` and returns the exit code.
+func pinsCommand(args []string, stdout, stderr io.Writer) int {
+	flags := flag.NewFlagSet("pins", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	flags.Usage = func() { _, _ = fmt.Fprint(stderr, pinsUsage) }
+	path := flags.String("tofu-file", "", "TOFU pin store")
+	sni := flags.String("sni", "", "SNI server name for accept (default: host part of the address)")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if *path == "" || flags.NArg() == 0 {
+		flags.Usage()
+		return 2
+	}
+	store := openTOFUStore(*path)
+	cmd, rest := flags.Arg(0), flags.Args()[1:]
+	var err error
+	switch {
+	case cmd == "list" && len(rest) == 0:
+		err = listPins(store, stdout)
+	case cmd == "accept" && (len(rest) == 1 || len(rest) == 2):
+		err = acceptPin(store, rest, *sni, stdout)
+	case cmd == "forget" && len(rest) == 1:
+		err = store.update(func(entries map[string]tofuEntry) error {
+			if _, ok := entries[rest[0]]; !ok {
+				return fmt.Errorf("no stored pin for %s", rest[0])
+			}
+			delete(entries, rest[0])
+			return nil
+		})
+		if err == nil {
+			_, _ = fmt.Fprintf(stdout, "forgot %s\n", rest[0])
+		}
+	default:
+		flags.Usage()
+		return 2
+	}
+	if err != nil {
+		_, _ = fmt.Fprintf(stderr, "untls pins: %s\n", err)
+		return 1
+	}
+	return 0
+}
+
+func listPins(store *tofuStore, w io.Writer) error {
+	store.mu.Lock()
+	entries, err := store.load()
+	store.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	remotes := make([]string, 0, len(entries))
+	for r := range entries {
+		remotes = append(remotes, r)
+	}
+	sort.Strings(remotes)
+	for _, r := range remotes {
+		e := entries[r]
+		_, _ = fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", r, e.Pin, e.FirstSeen.Format(time.RFC3339), e.Subject)
+	}
+	return nil
+}
+
+// acceptPin stores an explicit pin, or dials remote and stores whatever key
+// it presents (replacing any previous entry).
+func acceptPin(store *tofuStore, args []string, sni string, w io.Writer) error {
+	remote := args[0]
+	if err := validateRemote(remote); err != nil {
+		return err
+	}
+	var entry tofuEntry
+	if len(args) == 2 {
+		p, err := parsePin(args[1])
+		if err != nil {
+			return err
+		}
+		if p.kind != pinSPKI {
+			return fmt.Errorf("tofu pins are %s; got %s", pinSPKI, p.kind)
+		}
+		entry.Pin = p.String()
+	} else {
+		ctx, cancel := context.WithTimeout(context.Background(), dialTimeout)
+		defer cancel()
+		// The point is to see the key whatever the chain says.
+		cfg := &tls.Config{InsecureSkipVerify: true, ServerName: sni} //nolint:gosec // key is shown and pinned, not trusted via CA.
+		conn, err := (&tls.Dialer{Config: cfg}).DialContext(ctx, "tcp", remote)
+		if err != nil {
+			return err
+		}
+		leaf := conn.(*tls.Conn).ConnectionState().PeerCertificates[0]
+		_ = conn.Close()
+		entry.Pin = pin{kind: pinSPKI, hash: certHash(pinSPKI, leaf)}.String()
+		entry.Subject = leaf.Subject.String()
+	}
+	entry.FirstSeen = time.Now().UTC()
+	if err := store.update(func(entries map[string]tofuEntry) error {
+		entries[remote] = entry
+		return nil
+	}); err != nil {
+		return err
+	}
+	_, _ = fmt.Fprintf(w, "accepted %s %s\n", remote, entry.Pin)
+	return nil
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+// TestConnectUpstream_TOFU: the first self-signed key is recorded, the same
+// key keeps working, and a different key under the same -t fails loudly
+// until an operator forgets or accepts it.
+func TestConnectUpstream_TOFU(t *testing.T) {
+	first, second := mustTestUpstream(t, nil), mustTestUpstream(t, nil)
+
+	file := filepath.Join(t.TempDir(), "pins.json")
+	const remote = "home.example:443"
+	opts := tlsOptions{TOFUFile: file}
+	cfg, err := opts.clientConfig(remote)
+	if err != nil {
+		t.Fatalf("clientConfig: %v", err)
+	}
+	withUpstreamTLS(t, cfg)
+
+	dial := func(up *testUpstream) error {
+		client, server := net.Pipe()
+		defer func() { _ = client.Close() }()
+		upstream, err := connectUpstream(t.Context(), server, testTunnel(up.addr))
+		if err == nil {
+			_ = upstream.Close()
+		}
+		return err
+	}
+
+	if err := dial(first); err != nil {
+		t.Fatalf("first use: %v", err)
+	}
+	if runtime.GOOS != "windows" {
+		fi, err := os.Stat(file)
+		if err != nil {
+			t.Fatalf("stat pin store: %v", err)
+		}
+		if perm := fi.Mode().Perm(); perm != 0o600 {
+			t.Fatalf("pin store mode %o, want 600", perm)
+		}
+	}
+	if err := dial(first); err != nil {
+		t.Fatalf("same key again: %v", err)
+	}
+
+	err = dial(second)
+	var me *tofuMismatchError
+	if !errors.As(err, &me) {
+		t.Fatalf("changed key: err=%v, want tofuMismatchError", err)
+	}
+	wantStored := pin{kind: pinSPKI, hash: certHash(pinSPKI, first.cert)}.String()
+	wantGot := pin{kind: pinSPKI, hash: certHash(pinSPKI, second.cert)}.String()
+	if msg := err.Error(); !strings.Contains(msg, "UPSTREAM KEY CHANGED for "+remote) ||
+		!strings.Contains(msg, wantStored) || !strings.Contains(msg, wantGot) {
+		t.Fatalf("mismatch error %q should name remote, stored and presented keys", msg)
+	}
+
+	// `untls pins forget` is picked up by the running config.
+	var out, errOut bytes.Buffer
+	if code := pinsCommand([]string{"-tofu-file", file, "forget", remote}, &out, &errOut); code != 0 {
+		t.Fatalf("pins forget exit %d: %s", code, errOut.String())
+	}
+	if err := dial(second); err != nil {
+		t.Fatalf("after forget: %v", err)
+	}
+	if err := dial(first); !errors.As(err, &me) {
+		t.Fatalf("old key after re-trust: err=%v, want tofuMismatchError", err)
+	}
+}
+
+func TestPinsCommand(t *testing.T) {
+	up := mustTestUpstream(t, nil)
+	file := filepath.Join(t.TempDir(), "pins.json")
+	live := pin{kind: pinSPKI, hash: certHash(pinSPKI, up.cert)}.String()
+	explicit := "spki-sha256:" + strings.Repeat("ab", 32)
+
+	run := func(args ...string) (int, string, string) {
+		var out, errOut bytes.Buffer
+		code := pinsCommand(append([]string{"-tofu-file", file}, args...), &out, &errOut)
+		return code, out.String(), errOut.String()
+	}
+
+	if code, out, _ := run("list"); code != 0 || out != "" {
+		t.Fatalf("list on missing file: code=%d out=%q", code, out)
+	}
+	if code, _, errOut := run("accept", up.addr); code != 0 {
+		t.Fatalf("accept by dialing: code=%d %s", code, errOut)
+	}
+	if code, _, errOut := run("accept", "b.example:443", explicit); code != 0 {
+		t.Fatalf("accept explicit: code=%d %s", code, errOut)
+	}
+	code, out, _ := run("list")
+	if code != 0 {
+		t.Fatalf("list: code=%d", code)
+	}
+	lines := strings.Split(strings.TrimSpace(out), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("list=%q, want 2 entries", out)
+	}
+	if !strings.HasPrefix(lines[0], up.addr+"\t"+live) {
+		t.Fatalf("list[0]=%q, want %s with the live key", lines[0], up.addr)
+	}
+	if !strings.HasPrefix(lines[1], "b.example:443\t"+explicit) {
+		t.Fatalf("list[1]=%q, want b.example:443 with the explicit pin", lines[1])
+	}
+
+	if code, _, _ := run("forget", "b.example:443"); code != 0 {
+		t.Fatalf("forget: code=%d", code)
+	}
+	if code, _, errOut := run("forget", "b.example:443"); code != 1 || !strings.Contains(errOut, "no stored pin") {
+		t.Fatalf("forget twice: code=%d err=%q", code, errOut)
+	}
+	if code, _, errOut := run("accept", "b.example:443", "cert-sha256:"+strings.Repeat("ab", 32)); code != 1 || !strings.Contains(errOut, "spki-sha256") {
+		t.Fatalf("accept cert pin: code=%d err=%q", code, errOut)
+	}
+	for _, args := range [][]string{{}, {"list", "extra"}, {"accept"}, {"frobnicate"}} {
+		if code, _, _ := run(args...); code != 2 {
+			t.Fatalf("pins %v: code=%d, want usage exit 2", args, code)
+		}
+	}
+}
+
+func TestTLSOptions_TOFUValidation(t *testing.T) {
+	good := "spki-sha256:" + strings.Repeat("ab", 32)
+	for _, opts := range []tlsOptions{
+		{TOFUFile: "pins.json", Pins: []string{good}},
+		{TOFUFile: "pins.json", VerifyName: "example.com"},
+	} {
+		if _, err := opts.clientConfig("a:1"); err == nil || !strings.Contains(err.Error(), "-tofu-file") {
+			t.Fatalf("%+v: err=%v, want -tofu-file conflict", opts, err)
+		}
+	}
+}
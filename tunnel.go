@@ -0,0 +1,284 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// tunnel is one listen → upstream pair. Every tunnel runs its own accept
+// loop; all of them share the process shutdown context.
+type tunnel struct {
+	// name labels the tunnel's log lines. It is "" for the classic single
+	// -l/-t invocation, which keeps the historical conn/<addr> format.
+	name   string
+	listen string // CreateListener address
+	// remote is -t as given: host:port, or a comma-separated failover list.
+	remote string
+	opts   tlsOptions
+	// upstreams is remote set up for dialing, in priority order.
+	upstreams []*upstream
+	// balance is the -balance strategy; "" means failover.
+	balance string
+	// schedule and rr drive round-robin: rr counts picks into schedule.
+	schedule []int
+	rr       atomic.Uint64
+	// health is the -health-check probing of upstreams.
+	health healthCheck
+	// breaker is the -breaker-* circuit breaker around upstream dials.
+	breaker breakerConfig
+	// pool is the -pool-* pre-warmed connections per upstream.
+	pool poolConfig
+	// dialTimeout and certExpiryWarn are the -dial-timeout and
+	// -cert-expiry-warn the definition was loaded with, so a reload never
+	// changes what a running connection reads. See dialLimit for 0.
+	dialTimeout    time.Duration
+	certExpiryWarn time.Duration
+	// origin locates the tunnel's TLS options in a -config file
+	// ("untls.json:12: tunnels[0].tls") for setup errors; "" for flags.
+	origin string
+	// socket is the systemd socket this tunnel serves instead of binding
+	// listen; nil without socket activation.
+	socket *systemdSocket
+	// live is the definition a SIGHUP reload swapped in for a tunnel that
+	// kept its listen address; nil until the first reload. The accept loop
+	// reads it once per connection, so sessions already running keep the
+	// settings they were dialled with.
+	live atomic.Pointer[tunnel]
+}
+
+// current is the definition new connections on t's listener use.
+func (t *tunnel) current() *tunnel {
+	if l := t.live.Load(); l != nil {
+		return l
+	}
+	return t
+}
+
+// dialLimit bounds one upstream dial: -dial-timeout, or the dialTimeout
+// default for a tunnel set up outside a config.
+func (t *tunnel) dialLimit() time.Duration {
+	if t.dialTimeout > 0 {
+		return t.dialTimeout
+	}
+	return dialTimeout
+}
+
+// check validates the upstream addresses, -balance, -health-check,
+// -breaker-* and -pool-* and builds the TLS config from opts. It reads the
+// files opts names but creates none and changes no global, so `untls check`
+// can run it.
+func (t *tunnel) check() ([]*upstream, *tls.Config, error) {
+	ups, err := parseRemotes(t.remote)
+	if err != nil {
+		return nil, nil, t.wrap(err)
+	}
+	if err := validateBalance(t.balance, ups); err != nil {
+		return nil, nil, t.wrap(err)
+	}
+	if err := t.health.validate(); err != nil {
+		return nil, nil, t.wrap(err)
+	}
+	if err := t.breaker.validate(); err != nil {
+		return nil, nil, t.wrap(err)
+	}
+	if err := t.pool.validate(); err != nil {
+		return nil, nil, t.wrap(err)
+	}
+	cfg, err := t.opts.clientConfig(ups[0].addr)
+	if err != nil {
+		return nil, nil, t.wrap(err)
+	}
+	return ups, cfg, nil
+}
+
+// setup checks t and readies it for dialing: it opens the key log, if any,
+// and gives every upstream its TLS config. opts is the tunnel's own copy, so
+// its reloadable material (client certificate, CRLs) belongs to this tunnel
+// alone.
+func (t *tunnel) setup() error {
+	ups, cfg, err := t.check()
+	if err != nil {
+		return err
+	}
+	if t.opts.KeyLogFile != "" {
+		w, err := openKeyLog(t.opts.KeyLogFile)
+		if err != nil {
+			return t.wrap(err)
+		}
+		cfg.KeyLogWriter = w
+	}
+	for _, u := range ups {
+		u.tls.Store(t.opts.configFor(cfg, t.name, u.addr))
+		if t.pool.enabled() {
+			u.pool = newConnPool(t.pool)
+		}
+	}
+	t.upstreams = ups
+	t.schedule = smoothSchedule(ups)
+	return nil
+}
+
+// startWorkers runs t's background work, the health checks and the
+// connection pools, until ctx is done or the returned stop is called.
+func (t *tunnel) startWorkers(ctx context.Context) (stop func()) {
+	stopHealth := t.startHealthChecks(ctx)
+	stopPools := t.startPools(ctx)
+	return func() {
+		stopHealth()
+		stopPools()
+	}
+}
+
+// logArea prefixes a tunnel-wide log line about area ("health"):
+// "tunnel a: health: ", or just "health: " for an unnamed tunnel.
+func (t *tunnel) logArea(area string) string {
+	if t.name == "" {
+		return area + ": "
+	}
+	return "tunnel " + t.name + ": " + area + ": "
+}
+
+func (t *tunnel) wrap(err error) error {
+	switch {
+	case t.origin != "":
+		return fmt.Errorf("%s: tunnel %s: %w", t.origin, t.name, err)
+	case t.name != "":
+		return fmt.Errorf("tunnel %s: %w", t.name, err)
+	}
+	return err
+}
+
+// tag is a log prefix area ("conn", "error/accept") qualified with the
+// tunnel name when there is one: "conn/db", "error/accept/db".
+func (t *tunnel) tag(area string) string {
+	if t.name == "" {
+		return area
+	}
+	return area + "/" + t.name
+}
+
+// connLabel is the per-connection log prefix, e.g. "conn/db/127.0.0.1:5000".
+func (t *tunnel) connLabel(addr net.Addr) string {
+	return t.tag("conn") + "/" + addr.String()
+}
+
+// intList is a repeatable int flag.
+type intList []int
+
+func (l *intList) String() string {
+	if l == nil {
+		return ""
+	}
+	s := make([]string, len(*l))
+	for i, n := range *l {
+		s[i] = strconv.Itoa(n)
+	}
+	return strings.Join(s, ",")
+}
+
+func (l *intList) Set(v string) error {
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		return fmt.Errorf("not a port number: %q", v)
+	}
+	*l = append(*l, n)
+	return nil
+}
+
+// tunnelsFromFlags pairs the repeatable -t, -l / -listen and -name flags by
+// position: the first -t with the first listen address, and so on. A single
+// -t keeps the old defaults (127.0.0.1, ephemeral port, no name); with
+// several, every tunnel needs its listen address and is named after its -t
+// unless -name says otherwise. TLS options are shared by all tunnels.
+func tunnelsFromFlags(names, remotes, listens []string, ports []int, opts tlsOptions) ([]*tunnel, error) {
+	if len(remotes) == 0 {
+		return nil, validateRemote("")
+	}
+	for _, p := range ports {
+		if err := validateLocalPort(p); err != nil {
+			return nil, err
+		}
+	}
+	if len(listens) > 0 && len(ports) > 0 && len(remotes) > 1 {
+		return nil, fmt.Errorf("-listen and -l cannot be combined with several -t; use -listen for every tunnel")
+	}
+	if len(names) > 0 && len(names) != len(remotes) {
+		return nil, fmt.Errorf("got %d -name for %d -t; give one per tunnel or none", len(names), len(remotes))
+	}
+
+	var addrs []string
+	switch {
+	case len(remotes) == 1 && len(listens) <= 1 && len(ports) <= 1:
+		var listen string
+		var port int
+		if len(listens) == 1 {
+			listen = listens[0]
+		}
+		if len(ports) == 1 {
+			port = ports[0]
+		}
+		addr, err := listenAddress(listen, port)
+		if err != nil {
+			return nil, err
+		}
+		addrs = []string{addr}
+	case len(listens) == len(remotes):
+		for _, l := range listens {
+			addr, err := listenAddress(l, 0)
+			if err != nil {
+				return nil, err
+			}
+			addrs = append(addrs, addr)
+		}
+	case len(ports) == len(remotes):
+		for _, p := range ports {
+			addr, err := listenAddress("", p)
+			if err != nil {
+				return nil, err
+			}
+			addrs = append(addrs, addr)
+		}
+	default:
+		return nil, fmt.Errorf("got %d -t but %d listen addresses; pair every -t with an -l or -listen", len(remotes), len(listens)+len(ports))
+	}
+
+	tunnels := make([]*tunnel, len(remotes))
+	seen := map[string]bool{}
+	for i, remote := range remotes {
+		t := &tunnel{listen: addrs[i], remote: remote, opts: opts}
+		switch {
+		case len(names) > 0:
+			t.name = names[i]
+		case len(remotes) > 1:
+			t.name = remote
+		}
+		if len(remotes) > 1 || t.name != "" {
+			if err := validateTunnelName(t.name); err != nil {
+				return nil, err
+			}
+			if seen[t.name] {
+				return nil, fmt.Errorf("duplicate tunnel name %q; give each tunnel a distinct -name", t.name)
+			}
+			seen[t.name] = true
+		}
+		tunnels[i] = t
+	}
+	return tunnels, nil
+}
+
+// validateTunnelName keeps names usable inside log prefixes.
+func validateTunnelName(name string) error {
+	if name == "" {
+		return fmt.Errorf("empty tunnel name")
+	}
+	if strings.ContainsAny(name, " \t\r\n/") {
+		return fmt.Errorf("invalid tunnel name %q: no spaces or slashes", name)
+	}
+	return nil
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestTunnelsFromFlags(t *testing.T) {
+	type want struct{ name, listen, remote string }
+	tests := []struct {
+		name    string
+		names   []string
+		remotes []string
+		listens []string
+		ports   []int
+		want    []want
+		wantErr string
+	}{
+		{name: "classic defaults", remotes: []string{"a:443"}, want: []want{{"", "127.0.0.1:0", "a:443"}}},
+		{name: "classic port", remotes: []string{"a:443"}, ports: []int{25565}, want: []want{{"", "127.0.0.1:25565", "a:443"}}},
+		{name: "classic listen", remotes: []string{"a:443"}, listens: []string{"[::1]:80"}, want: []want{{"", "[::1]:80", "a:443"}}},
+		{name: "named single", names: []string{"mc"}, remotes: []string{"a:443"}, want: []want{{"mc", "127.0.0.1:0", "a:443"}}},
+		{name: "pairs by port", remotes: []string{"a:443", "b:443"}, ports: []int{1000, 2000},
+			want: []want{{"a:443", "127.0.0.1:1000", "a:443"}, {"b:443", "127.0.0.1:2000", "b:443"}}},
+		{name: "pairs by listen with names", names: []string{"db", "web"}, remotes: []string{"a:443", "b:443"}, listens: []string{"unix:/run/db.sock", ":8080"},
+			want: []want{{"db", "unix:/run/db.sock", "a:443"}, {"web", ":8080", "b:443"}}},
+		{name: "missing -t", wantErr: "missing tcp socket"},
+		{name: "unpaired", remotes: []string{"a:443", "b:443"}, ports: []int{1000}, wantErr: "got 2 -t but 1 listen"},
+		{name: "default listen with several", remotes: []string{"a:443", "b:443"}, wantErr: "got 2 -t but 0 listen"},
+		{name: "mixed kinds", remotes: []string{"a:443", "b:443"}, ports: []int{1000}, listens: []string{":2000"}, wantErr: "cannot be combined"},
+		{name: "both for one", remotes: []string{"a:443"}, ports: []int{1000}, listens: []string{":2000"}, wantErr: "cannot be combined"},
+		{name: "name count", names: []string{"x"}, remotes: []string{"a:443", "b:443"}, ports: []int{1, 2}, wantErr: "got 1 -name for 2 -t"},
+		{name: "duplicate default names", remotes: []string{"a:443", "a:443"}, ports: []int{1, 2}, wantErr: "duplicate tunnel name"},
+		{name: "bad name", names: []string{"a/b"}, remotes: []string{"a:443"}, wantErr: "invalid tunnel name"},
+		{name: "bad port", remotes: []string{"a:443"}, ports: []int{70000}, wantErr: "invalid -l port"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tunnelsFromFlags(tt.names, tt.remotes, tt.listens, tt.ports, tlsOptions{})
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("err=%v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("tunnelsFromFlags: %v", err)
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("got %d tunnels, want %d", len(got), len(tt.want))
+			}
+			for i, w := range tt.want {
+				if g := (want{got[i].name, got[i].listen, got[i].remote}); g != w {
+					t.Errorf("tunnel %d = %+v, want %+v", i, g, w)
+				}
+			}
+		})
+	}
+}
+
+// TestTunnel_Setup: every tunnel gets its own config, and setup errors say
+// which tunnel they belong to.
+func TestTunnel_Setup(t *testing.T) {
+	tunnels, err := tunnelsFromFlags([]string{"a", "b"}, []string{"a.example:443", "b.example:443"}, nil, []int{1, 2}, tlsOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tun := range tunnels {
+		if err := tun.setup(); err != nil {
+			t.Fatalf("setup: %v", err)
+		}
+	}
+	if tunnels[0].upstreams[0].tls.Load() == nil || tunnels[0].upstreams[0].tls.Load() == tunnels[1].upstreams[0].tls.Load() {
+		t.Fatal("tunnels must not share a tls.Config")
+	}
+
+	bad := &tunnel{name: "db", remote: "nope"}
+	if err := bad.setup(); err == nil || !strings.HasPrefix(err.Error(), "tunnel db: ") {
+		t.Fatalf("setup err=%v, want it prefixed with the tunnel name", err)
+	}
+}
+
+// TestAcceptLoop_MultipleTunnels runs two named tunnels to two different
+// upstreams on one shutdown context: each proxies to its own upstream, logs
+// under its own name, and both stop on cancel.
+func TestAcceptLoop_MultipleTunnels(t *testing.T) {
+	var buf bytes.Buffer
+	var mu sync.Mutex
+	log.SetOutput(&lockedWriter{w: &buf, mu: &mu})
+	defer log.SetOutput(os.Stderr)
+
+	ctx, cancel := context.WithCancel(t.Context())
+	defer cancel()
+
+	var loops sync.WaitGroup
+	addrs := map[string]string{}
+	for _, name := range []string{"alpha", "beta"} {
+		up := mustTestUpstream(t, nil)
+		tun := mustSetupTunnel(t, &tunnel{name: name, remote: up.addr}, up.cert)
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		go func() {
+			<-ctx.Done()
+			_ = ln.Close()
+		}()
+		addrs[name] = ln.Addr().String()
+		loops.Add(1)
+		go func() {
+			defer loops.Done()
+			if err := acceptLoop(ctx, ln, tun); err != nil {
+				t.Errorf("acceptLoop %s: %v", name, err)
+			}
+		}()
+	}
+
+	for name, addr := range addrs {
+		c, err := net.DialTimeout("tcp", addr, 2*time.Second)
+		if err != nil {
+			t.Fatalf("dial %s: %v", name, err)
+		}
+		_ = c.SetDeadline(time.Now().Add(2 * time.Second))
+		if _, err := c.Write([]byte(name)); err != nil {
+			t.Fatal(err)
+		}
+		got := make([]byte, len(name))
+		if _, err := io.ReadFull(c, got); err != nil || string(got) != name {
+			t.Fatalf("tunnel %s echoed %q, %v", name, got, err)
+		}
+		_ = c.Close()
+	}
+
+	cancel()
+	done := make(chan struct{})
+	go func() { loops.Wait(); close(done) }()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("accept loops did not stop on cancel")
+	}
+
+	mu.Lock()
+	out := buf.String()
+	mu.Unlock()
+	for _, name := range []string{"alpha", "beta"} {
+		if !strings.Contains(out, "conn/"+name+"/127.0.0.1:") || !strings.Contains(out, ": tls 1.3 ") {
+			t.Fatalf("log lacks conn/%s/ prefix:\n%s", name, out)
+		}
+	}
+}
+
+// lockedWriter serializes log output shared with background goroutines.
+type lockedWriter struct {
+	w  io.Writer
+	mu *sync.Mutex
+}
+
+func (l *lockedWriter) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.w.Write(p)
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"os"
+	"os/user"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// unixPrefix marks a -listen address as a Unix domain socket path.
+// "unix:@name" is a Linux abstract-namespace socket (no file on disk).
+const unixPrefix = "unix:"
+
+// unixSocketPerms is applied to socket files CreateListener creates. A zero
+// mode and uid/gid -1 leave what the OS picked (0777 minus umask, our owner).
+type unixSocketPerms struct {
+	mode     fs.FileMode
+	uid, gid int
+}
+
+// unixPerms is set by main from -unix-mode / -unix-owner.
+var unixPerms = unixSocketPerms{uid: -1, gid: -1}
+
+// parseUnixPerms parses -unix-mode (octal, e.g. 0660) and -unix-owner
+// (user, user:group or :group; names or numeric ids).
+func parseUnixPerms(mode, owner string) (unixSocketPerms, error) {
+	p := unixSocketPerms{uid: -1, gid: -1}
+	if mode != "" {
+		m, err := strconv.ParseUint(mode, 8, 32)
+		if err != nil || m == 0 || m > 0o777 {
+			return p, fmt.Errorf("invalid -unix-mode %q: want octal permission bits like 0660", mode)
+		}
+		p.mode = fs.FileMode(m)
+	}
+	if owner == "" {
+		return p, nil
+	}
+	name, group, _ := strings.Cut(owner, ":")
+	if name != "" {
+		uid, err := lookupID(name, func(s string) (string, error) {
+			u, err := user.Lookup(s)
+			if err != nil {
+				return "", err
+			}
+			return u.Uid, nil
+		})
+		if err != nil {
+			return p, fmt.Errorf("invalid -unix-owner %q: %w", owner, err)
+		}
+		p.uid = uid
+	}
+	if group != "" {
+		gid, err := lookupID(group, func(s string) (string, error) {
+			g, err := user.LookupGroup(s)
+			if err != nil {
+				return "", err
+			}
+			return g.Gid, nil
+		})
+		if err != nil {
+			return p, fmt.Errorf("invalid -unix-owner %q: %w", owner, err)
+		}
+		p.gid = gid
+	}
+	if p.uid == -1 && p.gid == -1 {
+		return p, fmt.Errorf("invalid -unix-owner %q: want user, user:group or :group", owner)
+	}
+	return p, nil
+}
+
+// lookupID accepts a numeric id as is and resolves anything else by name.
+func lookupID(s string, lookup func(string) (string, error)) (int, error) {
+	if n, err := strconv.Atoi(s); err == nil && n >= 0 {
+		return n, nil
+	}
+	id, err := lookup(s)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(id)
+}
+
+// validateUnixPath checks the path part of a unix: -listen address.
+func validateUnixPath(path string) error {
+	if path == "" || path == "@" {
+		return fmt.Errorf("invalid -listen address %q: missing socket path", unixPrefix+path)
+	}
+	if strings.HasPrefix(path, "@") && runtime.GOOS != "linux" {
+		return fmt.Errorf("invalid -listen address %q: abstract sockets are Linux-only", unixPrefix+path)
+	}
+	return nil
+}
+
+// listenUnix binds a Unix socket, clearing a stale socket file left behind by
+// a crash first. The file is removed again when the listener is closed.
+func listenUnix(path string) (net.Listener, error) {
+	abstract := strings.HasPrefix(path, "@")
+	if abstract && (unixPerms.mode != 0 || unixPerms.uid != -1 || unixPerms.gid != -1) {
+		return nil, errors.New("-unix-mode/-unix-owner do not apply to abstract sockets")
+	}
+	if !abstract {
+		if err := removeStaleSocket(path); err != nil {
+			return nil, err
+		}
+	}
+	// With -unix-mode the file must not be reachable under the default
+	// permissions between the bind and the chmod below.
+	restore := func() {}
+	if !abstract && unixPerms.mode != 0 {
+		restore = privateUmask()
+	}
+	l, err := net.ListenUnix("unix", &net.UnixAddr{Name: path, Net: "unix"})
+	restore()
+	if err != nil {
+		return nil, err
+	}
+	l.SetUnlinkOnClose(!abstract)
+	if !abstract {
+		if err := applyUnixPerms(path, unixPerms); err != nil {
+			_ = l.Close()
+			return nil, err
+		}
+	}
+	return &unixListener{UnixListener: l}, nil
+}
+
+func applyUnixPerms(path string, p unixSocketPerms) error {
+	if p.uid != -1 || p.gid != -1 {
+		if err := os.Chown(path, p.uid, p.gid); err != nil {
+			return fmt.Errorf("-unix-owner: %w", err)
+		}
+	}
+	if p.mode != 0 {
+		if err := os.Chmod(path, p.mode); err != nil {
+			return fmt.Errorf("-unix-mode: %w", err)
+		}
+	}
+	return nil
+}
+
+// removeStaleSocket deletes path when it is a socket nobody listens on.
+// A live socket means another instance is running, and anything that is not
+// a socket is left alone: both are errors rather than something to delete.
+func removeStaleSocket(path string) error {
+	fi, err := os.Lstat(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if fi.Mode()&fs.ModeSocket == 0 {
+		return fmt.Errorf("%s exists and is not a socket; refusing to replace it", path)
+	}
+	if c, err := net.DialTimeout("unix", path, time.Second); err == nil {
+		_ = c.Close()
+		return fmt.Errorf("%s is in use by another process", path)
+	}
+	if err := os.Remove(path); err != nil {
+		return fmt.Errorf("remove stale socket: %w", err)
+	}
+	return nil
+}
+
+// unixListener numbers its clients: Unix peers are usually unnamed, and the
+// conn/<addr> log prefix needs something to tell connections apart.
+type unixListener struct {
+	*net.UnixListener
+	n atomic.Uint64
+}
+
+func (l *unixListener) Accept() (net.Conn, error) {
+	c, err := l.UnixListener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &unixClient{Conn: c, addr: &net.UnixAddr{Name: fmt.Sprintf("unix#%d", l.n.Add(1)), Net: "unix"}}, nil
+}
+
+type unixClient struct {
+	net.Conn
+	addr net.Addr
+}
+
+func (c *unixClient) RemoteAddr() net.Addr { return c.addr }
@@ -0,0 +1,6 @@
+//go:build !unix
+
+package main
+
+// privateUmask is a no-op: there is no umask outside Unix.
+func privateUmask() (restore func()) { return func() {} }
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// shortSocketDir returns a directory for socket files: t.TempDir paths can
+// exceed the ~104-byte sun_path limit on macOS.
+func shortSocketDir(t *testing.T) string {
+	t.Helper()
+	dir, err := os.MkdirTemp("", "untls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = os.RemoveAll(dir) })
+	return dir
+}
+
+// TestCreateListener_Unix: a unix: address serves clients, applies
+// -unix-mode, labels connections, and removes the socket file on Close.
+func TestCreateListener_Unix(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("socket file modes are not meaningful on windows")
+	}
+	t.Setenv("LISTEN_PID", "")
+	prev := unixPerms
+	t.Cleanup(func() { unixPerms = prev })
+	unixPerms = unixSocketPerms{mode: 0o660, uid: -1, gid: -1}
+
+	path := filepath.Join(shortSocketDir(t), "u.sock")
+	ln, source, err := CreateListener(unixPrefix + path)
+	if err != nil {
+		t.Fatalf("CreateListener: %v", err)
+	}
+	if source != unixPrefix+path {
+		t.Fatalf("source=%q", source)
+	}
+	if got := listenLabel(ln, source); got != unixPrefix+path {
+		t.Fatalf("listenLabel=%q, want %q", got, unixPrefix+path)
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode().Perm() != 0o660 {
+		t.Fatalf("socket mode=%v, want 0660", fi.Mode().Perm())
+	}
+
+	for i := 1; i <= 2; i++ {
+		go func() {
+			c, err := net.DialTimeout("unix", path, 2*time.Second)
+			if err != nil {
+				return
+			}
+			defer func() { _ = c.Close() }()
+			_, _ = c.Write([]byte("ping"))
+		}()
+		c, err := ln.Accept()
+		if err != nil {
+			t.Fatalf("Accept: %v", err)
+		}
+		if got, want := c.RemoteAddr().String(), "unix#"+strconv.Itoa(i); got != want {
+			t.Fatalf("RemoteAddr=%q, want %q", got, want)
+		}
+		buf := make([]byte, 4)
+		_ = c.SetDeadline(time.Now().Add(2 * time.Second))
+		if _, err := io.ReadFull(c, buf); err != nil || string(buf) != "ping" {
+			t.Fatalf("read %q, %v", buf, err)
+		}
+		_ = c.Close()
+	}
+
+	_ = ln.Close()
+	if _, err := os.Lstat(path); !os.IsNotExist(err) {
+		t.Fatalf("socket file left after Close: %v", err)
+	}
+}
+
+// TestCreateListener_UnixStale: a dead socket from a crashed run is replaced;
+// a live one or a regular file is not touched.
+func TestCreateListener_UnixStale(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("unix socket files behave differently on windows")
+	}
+	t.Setenv("LISTEN_PID", "")
+	dir := shortSocketDir(t)
+
+	stale := filepath.Join(dir, "stale.sock")
+	dead, err := net.ListenUnix("unix", &net.UnixAddr{Name: stale, Net: "unix"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	dead.SetUnlinkOnClose(false)
+	_ = dead.Close()
+	ln, _, err := CreateListener(unixPrefix + stale)
+	if err != nil {
+		t.Fatalf("stale socket not replaced: %v", err)
+	}
+	defer func() { _ = ln.Close() }()
+
+	if _, _, err := CreateListener(unixPrefix + stale); err == nil || !strings.Contains(err.Error(), "in use") {
+		t.Fatalf("second listener on a live socket: err=%v", err)
+	}
+
+	file := filepath.Join(dir, "file")
+	if err := os.WriteFile(file, []byte("keep"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := CreateListener(unixPrefix + file); err == nil || !strings.Contains(err.Error(), "not a socket") {
+		t.Fatalf("regular file: err=%v", err)
+	}
+	if data, err := os.ReadFile(file); err != nil || string(data) != "keep" {
+		t.Fatalf("regular file was modified: %q, %v", data, err)
+	}
+}
+
+func TestCreateListener_UnixAbstract(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("abstract sockets are Linux-only")
+	}
+	t.Setenv("LISTEN_PID", "")
+	name := "@untls-test-" + strconv.Itoa(os.Getpid())
+	ln, _, err := CreateListener(unixPrefix + name)
+	if err != nil {
+		t.Fatalf("CreateListener: %v", err)
+	}
+	defer func() { _ = ln.Close() }()
+
+	c, err := net.DialTimeout("unix", name, 2*time.Second)
+	if err != nil {
+		t.Fatalf("dial abstract socket: %v", err)
+	}
+	_ = c.Close()
+}
+
+func TestListenAddress_Unix(t *testing.T) {
+	if got, err := listenAddress("unix:/run/untls.sock", 0); err != nil || got != "unix:/run/untls.sock" {
+		t.Fatalf("got %q, %v", got, err)
+	}
+	if _, err := listenAddress("unix:", 0); err == nil || !strings.Contains(err.Error(), "missing socket path") {
+		t.Fatalf("empty path: err=%v", err)
+	}
+	if _, err := listenAddress("unix:/run/untls.sock", 8080); err == nil {
+		t.Fatal("expected error combining unix: with -l")
+	}
+}
+
+func TestParseUnixPerms(t *testing.T) {
+	tests := []struct {
+		mode, owner string
+		want        unixSocketPerms
+		wantErr     string
+	}{
+		{want: unixSocketPerms{uid: -1, gid: -1}},
+		{mode: "0660", want: unixSocketPerms{mode: 0o660, uid: -1, gid: -1}},
+		{mode: "600", want: unixSocketPerms{mode: 0o600, uid: -1, gid: -1}},
+		{owner: "1000", want: unixSocketPerms{uid: 1000, gid: -1}},
+		{owner: "1000:1001", want: unixSocketPerms{uid: 1000, gid: 1001}},
+		{owner: ":1001", want: unixSocketPerms{uid: -1, gid: 1001}},
+		{mode: "0999", wantErr: "-unix-mode"},
+		{mode: "rw-rw----", wantErr: "-unix-mode"},
+		{mode: "01777", wantErr: "-unix-mode"},
+		{owner: ":", wantErr: "-unix-owner"},
+		{owner: "no-such-user-untls", wantErr: "-unix-owner"},
+	}
+	for _, tt := range tests {
+		got, err := parseUnixPerms(tt.mode, tt.owner)
+		if tt.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("parseUnixPerms(%q, %q) err=%v, want %q", tt.mode, tt.owner, err, tt.wantErr)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("parseUnixPerms(%q, %q) = %+v, %v; want %+v", tt.mode, tt.owner, got, err, tt.want)
+		}
+	}
+}
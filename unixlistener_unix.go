@@ -0,0 +1,23 @@
+//go:build unix
+
+package main
+
+import (
+	"sync"
+	"syscall"
+)
+
+// umaskMu serializes binds that narrow the process-wide umask.
+var umaskMu sync.Mutex
+
+// privateUmask narrows the umask so a new socket file starts out 0600: until
+// applyUnixPerms sets -unix-mode, nobody else can connect to it. The returned
+// func restores the previous mask.
+func privateUmask() (restore func()) {
+	umaskMu.Lock()
+	old := syscall.Umask(0o177)
+	return func() {
+		syscall.Umask(old)
+		umaskMu.Unlock()
+	}
+}
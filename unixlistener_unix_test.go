@@ -0,0 +1,37 @@
+//go:build unix
+
+package main
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+// TestPrivateUmask: a socket bound under privateUmask is 0600 whatever the
+// process umask, and the umask is restored afterwards.
+func TestPrivateUmask(t *testing.T) {
+	old := syscall.Umask(0o022)
+	defer syscall.Umask(old)
+
+	path := filepath.Join(shortSocketDir(t), "s")
+	restore := privateUmask()
+	l, err := net.Listen("unix", path)
+	restore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = l.Close() }()
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if perm := fi.Mode().Perm(); perm != 0o600 {
+		t.Errorf("socket mode = %#o, want 0600", perm)
+	}
+	if got := syscall.Umask(0o022); got != 0o022 {
+		t.Errorf("umask after restore = %#o, want 0022", got)
+	}
+}